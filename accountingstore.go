@@ -0,0 +1,263 @@
+/*
+ * Copyright (c) 2013 IBM Corp.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ *
+ * Contributors:
+ *    Seth Hoenig
+ *    Allan Stockdill-Mander
+ *    Mike Robertson
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/90poe/paho.mqtt.golang/packets"
+)
+
+// maxStoreWait is the longest that storing an inbound message will be delayed when the store is full.
+// This bounds the backpressure so that flows that need further packets to be read before space can be
+// freed (e.g. a QoS 2 message awaiting its PUBREL) cannot deadlock.
+const maxStoreWait = 5 * time.Second
+
+// StoreStats provides details of the messages held in the persistence store
+type StoreStats struct {
+	Messages int // number of messages in the store
+	Bytes    int // approximate size of the messages in the store
+	MaxBytes int // limit set with SetMaxStoreBytes (0 if unlimited)
+}
+
+// accountingStore wraps a Store keeping track of the (approximate) amount of memory used by the messages
+// within it. If maxBytes is non-zero then storing inbound messages that would exceed the limit is delayed
+// until space is freed (i.e. the message is acknowledged); as the inbound messages are stored by the
+// routine that reads from the network this applies backpressure to the broker. If maxBytes is zero the
+// sizes are not tracked; they are only calculated when stats are requested.
+// The underlying store can be replaced, whilst in use, with migrate.
+type accountingStore struct {
+	Store
+	storeMu  sync.RWMutex // protects Store (held for writing whilst migrating)
+	mu       sync.Mutex
+	cond     *sync.Cond
+	sizes    map[string]int
+	bytes    int
+	maxBytes int
+	open     bool
+	logs     *loggers // nil for the package level loggers
+}
+
+func newAccountingStore(s Store, maxBytes int) *accountingStore {
+	a := &accountingStore{Store: s, sizes: make(map[string]int), maxBytes: maxBytes}
+	a.cond = sync.NewCond(&a.mu)
+	return a
+}
+
+// packetSize returns the approximate size of the packet (the size of the encoded packet is used for
+// publish packets; other packets are small so an estimate is sufficient)
+func packetSize(m packets.ControlPacket) int {
+	switch p := m.(type) {
+	case *packets.PublishPacket:
+		return 2 + 2 + len(p.TopicName) + 2 + len(p.Payload)
+	case *packets.SubscribePacket:
+		size := 4
+		for _, t := range p.Topics {
+			size += 3 + len(t)
+		}
+		return size
+	case *packets.UnsubscribePacket:
+		size := 4
+		for _, t := range p.Topics {
+			size += 2 + len(t)
+		}
+		return size
+	}
+	return 4
+}
+
+// Open opens the underlying store and accounts for any messages already within it
+func (a *accountingStore) Open() {
+	a.storeMu.RLock()
+	defer a.storeMu.RUnlock()
+	a.Store.Open()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.sizes = make(map[string]int)
+	a.bytes = 0
+	if a.maxBytes > 0 {
+		a.sizes, a.bytes = storeSizes(a.Store)
+	}
+	a.open = true
+}
+
+// storeSizes returns the size of each message in s (which must be open) and their total
+func storeSizes(s Store) (map[string]int, int) {
+	sizes := make(map[string]int)
+	bytes := 0
+	for _, key := range s.All() {
+		if m := s.Get(key); m != nil {
+			sizes[key] = packetSize(m)
+			bytes += sizes[key]
+		}
+	}
+	return sizes, bytes
+}
+
+// Put stores the message; if the store is full and this is an inbound publish it will block until
+// space is freed (or maxStoreWait passes)
+func (a *accountingStore) Put(key string, message packets.ControlPacket) {
+	if a.maxBytes <= 0 {
+		a.storeMu.RLock()
+		a.Store.Put(key, message)
+		a.storeMu.RUnlock()
+		return
+	}
+	size := packetSize(message)
+	a.mu.Lock()
+	if _, isPub := message.(*packets.PublishPacket); isPub && a.maxBytes > 0 && isKeyInbound(key) {
+		deadline := time.Now().Add(maxStoreWait)
+		for a.open && a.bytes > 0 && a.bytes-a.sizes[key]+size > a.maxBytes {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				orGlobalLoggers(a.logs).WARN.Println(STR, "store limit exceeded whilst waiting for space, storing message anyway:", key)
+				break
+			}
+			orGlobalLoggers(a.logs).DEBUG.Println(STR, "store full, waiting for space before storing:", key)
+			t := time.AfterFunc(remaining, a.cond.Broadcast)
+			a.cond.Wait()
+			t.Stop()
+		}
+	}
+	a.bytes += size - a.sizes[key]
+	a.sizes[key] = size
+	a.mu.Unlock()
+	a.storeMu.RLock()
+	a.Store.Put(key, message)
+	a.storeMu.RUnlock()
+}
+
+// utilisation returns the memory used by the store as a percentage of maxBytes (0 if there is no limit)
+func (a *accountingStore) utilisation() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.maxBytes <= 0 {
+		return 0
+	}
+	return a.bytes * 100 / a.maxBytes
+}
+
+// Get retrieves the message from the underlying store
+func (a *accountingStore) Get(key string) packets.ControlPacket {
+	a.storeMu.RLock()
+	defer a.storeMu.RUnlock()
+	return a.Store.Get(key)
+}
+
+// All returns the keys of the messages in the underlying store
+func (a *accountingStore) All() []string {
+	a.storeMu.RLock()
+	defer a.storeMu.RUnlock()
+	return a.Store.All()
+}
+
+// Del removes the message from the store (waking anything waiting for space)
+func (a *accountingStore) Del(key string) {
+	a.storeMu.RLock()
+	a.Store.Del(key)
+	a.storeMu.RUnlock()
+	if a.maxBytes <= 0 {
+		return
+	}
+	a.mu.Lock()
+	a.bytes -= a.sizes[key]
+	delete(a.sizes, key)
+	a.cond.Broadcast()
+	a.mu.Unlock()
+}
+
+// Close closes the underlying store (releasing anything waiting for space)
+func (a *accountingStore) Close() {
+	a.storeMu.RLock()
+	a.Store.Close()
+	a.storeMu.RUnlock()
+	a.mu.Lock()
+	a.open = false
+	a.cond.Broadcast()
+	a.mu.Unlock()
+}
+
+// Reset clears the underlying store
+func (a *accountingStore) Reset() {
+	a.storeMu.RLock()
+	a.Store.Reset()
+	a.storeMu.RUnlock()
+	a.mu.Lock()
+	a.sizes = make(map[string]int)
+	a.bytes = 0
+	a.cond.Broadcast()
+	a.mu.Unlock()
+}
+
+// migrate copies the messages in the underlying store to s and then uses s in its place (the
+// previous store is reset and closed). Other operations on the store block whilst this runs. If
+// the store is not open, s simply replaces it. Should the copy be incomplete the previous store
+// remains in use and an error is returned.
+func (a *accountingStore) migrate(s Store) error {
+	if s == nil {
+		return errors.New("store must not be nil")
+	}
+	a.storeMu.Lock()
+	defer a.storeMu.Unlock()
+	if s == a.Store {
+		return nil
+	}
+	a.mu.Lock()
+	open := a.open
+	a.mu.Unlock()
+	if !open {
+		a.Store = s
+		return nil
+	}
+	s.Open()
+	keys := a.Store.All()
+	copied := 0
+	for _, key := range keys {
+		if m := a.Store.Get(key); m != nil {
+			s.Put(key, m)
+			copied++
+		}
+	}
+	if n := len(s.All()); n < copied {
+		s.Close()
+		return fmt.Errorf("store migration incomplete: %d of %d messages copied", n, copied)
+	}
+	a.Store.Reset()
+	a.Store.Close()
+	a.Store = s
+	return nil
+}
+
+// stats returns details of the current store usage
+func (a *accountingStore) stats() StoreStats {
+	if a.maxBytes <= 0 {
+		a.storeMu.RLock()
+		defer a.storeMu.RUnlock()
+		a.mu.Lock()
+		open := a.open
+		a.mu.Unlock()
+		if !open {
+			return StoreStats{}
+		}
+		sizes, bytes := storeSizes(a.Store)
+		return StoreStats{Messages: len(sizes), Bytes: bytes}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return StoreStats{Messages: len(a.sizes), Bytes: a.bytes, MaxBytes: a.maxBytes}
+}
@@ -19,9 +19,13 @@ package mqtt
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/url"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -62,6 +66,9 @@ type Client interface {
 	// IsConnectionOpen return a bool signifying whether the client has an active
 	// connection to mqtt broker, i.e not in disconnected or reconnect mode
 	IsConnectionOpen() bool
+	// IsReconnecting returns a bool signifying whether the client has lost its
+	// connection and is attempting to reestablish it automatically
+	IsReconnecting() bool
 	// Connect will create a connection to the message broker, by default
 	// it will attempt to connect at v3.1.1 and auto retry at v3.1 if that
 	// fails
@@ -70,10 +77,25 @@ type Client interface {
 	// the specified number of milliseconds to wait for existing work to be
 	// completed.
 	Disconnect(quiesce uint)
+	// Reconnect drops the current connection (if any) and immediately attempts
+	// to reconnect, resetting the reconnection backoff
+	Reconnect()
 	// Publish will publish a message with the specified QoS and content
 	// to the specified topic.
 	// Returns a token to track delivery of the message to the broker
 	Publish(topic string, qos byte, retained bool, payload interface{}) Token
+	// PublishReader will publish a message (as per Publish) reading the payload,
+	// of the specified size, from r
+	PublishReader(topic string, qos byte, retained bool, r io.Reader, size int64) Token
+	// PublishWithContext will publish a message (as per Publish); if ctx is done before the
+	// publish completes its message ID and stored copy are released
+	PublishWithContext(ctx context.Context, topic string, qos byte, retained bool, payload interface{}) Token
+	// Request publishes payload to requestTopic and waits for, and returns, the response published
+	// to a topic beneath responseTopic (see DecodeRequest)
+	Request(ctx context.Context, requestTopic string, qos byte, payload []byte, responseTopic string, timeout time.Duration) (Message, error)
+	// TryPublish will publish a message (as per Publish) only if it can be queued without
+	// blocking, returning false (having queued nothing) if not
+	TryPublish(topic string, qos byte, retained bool, payload interface{}) (Token, bool)
 	// Subscribe starts a new subscription. Provide a MessageHandler to be executed when
 	// a message is published on the topic provided, or nil for the default handler
 	Subscribe(topic string, qos byte, callback MessageHandler) Token
@@ -81,21 +103,116 @@ type Client interface {
 	// be executed when a message is published on one of the topics provided, or nil for the
 	// default handler
 	SubscribeMultiple(filters map[string]byte, callback MessageHandler) Token
+	// SubscribeFunc starts a new subscription (as per Subscribe) returning a Subscription that
+	// can be used to wait for the subscription to complete and, later, to unsubscribe
+	SubscribeFunc(topic string, qos byte, callback MessageHandler) *Subscription
+	// SubscribeWithRetry starts a new subscription (as per Subscribe) retrying, with backoff
+	// as per the policy, if it fails
+	SubscribeWithRetry(topic string, qos byte, callback MessageHandler, policy RetryPolicy) Token
+	// SubscribeWithSchema starts a new subscription (as per Subscribe) passing only messages
+	// whose payload is accepted by the validator to the callback
+	SubscribeWithSchema(topic string, qos byte, schema PayloadValidator, callback MessageHandler) Token
+	// SubscribeWithOptions starts a new subscription (as per Subscribe) with the specified options
+	// (e.g. failing, rather than replacing the handler, if a route for the filter exists)
+	SubscribeWithOptions(topic string, qos byte, callback MessageHandler, opts SubOptions) Token
+	// SubscribeShared subscribes to filter as a member of a shared subscription group and
+	// distributes the messages received between a number of worker goroutines, preserving
+	// the order of messages that have the same key (as returned by keyFunc)
+	SubscribeShared(group, filter string, qos byte, workers int, keyFunc MessageKeyFunc, handler MessageHandler) Token
+	// SubscribeBatch starts a new subscription (as per Subscribe) passing the messages received to
+	// handler in batches of up to maxBatch messages (or those received within maxWait)
+	SubscribeBatch(filter string, qos byte, maxBatch int, maxWait time.Duration, handler BatchMessageHandler) Token
+	// SubscribeSys subscribes (at QoS 0) to a filter within the broker's $SYS topic tree
+	SubscribeSys(filter string, handler MessageHandler) Token
 	// Unsubscribe will end the subscription from each of the topics provided.
 	// Messages published to those topics from other clients will no longer be
 	// received.
+	// Only routes whose filter exactly matches one of the topics are removed; messages
+	// matching other (overlapping) active subscriptions will still be delivered (a warning is logged).
 	Unsubscribe(topics ...string) Token
 	// AddRoute allows you to add a handler for messages on a specific topic
 	// without making a subscription. For example having a different handler
 	// for parts of a wildcard subscription
 	AddRoute(topic string, callback MessageHandler)
+	// ReplaceHandler replaces the handler for an existing subscription without resubscribing
+	// (ErrNotSubscribed is returned if there is no active subscription to the filter)
+	ReplaceHandler(filter string, handler MessageHandler) error
+	// SetDefaultHandler replaces the handler called for messages that do not match any route
+	SetDefaultHandler(handler MessageHandler)
+	// AddObserver adds a handler that will be called for every message received, in
+	// addition to the handler(s) for any matching routes
+	AddObserver(observer MessageHandler)
 	// OptionsReader returns a ClientOptionsReader which is a copy of the clientoptions
 	// in use by the client.
 	OptionsReader() ClientOptionsReader
+	// Dump returns a snapshot of the state of the client (for diagnostic purposes)
+	Dump() ClientState
+	// PendingAcks returns the number of messages passed to handlers that have not yet been
+	// acknowledged (only relevant if AutoAckDisabled is set)
+	PendingAcks() int
+	// ActiveHandlerGoroutines returns the number of goroutines currently running message
+	// handlers (only used when SetOrderMatters(false) is in place; see SetReceiveMaximum)
+	ActiveHandlerGoroutines() int
+	// StopDispatch stops messages being passed to handlers, without disconnecting, until
+	// StartDispatch is called; QoS 1/2 messages are not acknowledged in the meantime
+	StopDispatch()
+	// StartDispatch passes any messages held since StopDispatch to the handlers (in the
+	// order received) and then resumes normal dispatch
+	StartDispatch()
+	// PressureLevel returns a value from 0 to 100 indicating how close the client is to the
+	// limits on inflight publishes, store size and message IDs (see the method for details)
+	PressureLevel() int
+	// StoreStats returns details of the messages held in the persistence store
+	StoreStats() StoreStats
+	// MigrateStore moves the messages in the persistence store to s and then uses s in its place
+	MigrateStore(s Store) error
+	// PendingInbound returns the inbound messages held in the persistence store that have
+	// not yet been acknowledged (the messages are not acknowledged by this call)
+	PendingInbound() []Message
+	// SubscriptionStats returns statistics for the messages delivered to the route with
+	// the filter provided (only available if SetSubscriptionStats(true) is used)
+	SubscriptionStats(filter string) SubStat
+	// LocalAddr returns the local network address of the active connection (nil if
+	// not connected)
+	LocalAddr() net.Addr
+	// RemoteAddr returns the remote network address of the active connection (nil if
+	// not connected)
+	RemoteAddr() net.Addr
+	// EffectiveKeepAlive returns the keepalive in force on the active connection (0 if not
+	// connected or the keepalive is disabled)
+	EffectiveKeepAlive() time.Duration
+	// LastConnectedAt returns when the connection was last established (the zero time if never)
+	LastConnectedAt() time.Time
+	// LastDisconnectedAt returns when the connection was last lost or closed (the zero time if never)
+	LastDisconnectedAt() time.Time
+	// ConnectedBroker returns the URL of the broker that the client is currently
+	// connected to (nil if not connected)
+	ConnectedBroker() *url.URL
+	// DroppedEvents returns the number of events that could not be sent to the
+	// EventSink because it was full
+	DroppedEvents() uint64
+	// Errors returns a channel that receives internal errors that did not, in
+	// themselves, result in the connection being lost (for diagnostic purposes)
+	Errors() <-chan error
+	// DroppedErrors returns the number of errors that could not be sent to the
+	// Errors channel because it was full
+	DroppedErrors() uint64
 }
 
 // client implements the Client interface
 type client struct {
+	pendingAcks   int64  // messages awaiting Ack() when AutoAckDisabled is set (first so it is 64-bit aligned for atomic access)
+	droppedEvents uint64 // events that could not be sent to the EventSink (also 64-bit aligned for atomic access)
+	lastPingRTT   int64  // time.Duration - round trip time of the last PINGREQ (also 64-bit aligned for atomic access)
+	droppedErrors uint64 // errors that could not be sent to the errs channel (also 64-bit aligned for atomic access)
+	requestSeq    uint64 // sequence number included in Request correlation IDs (also 64-bit aligned for atomic access)
+
+	pingSentAt        atomic.Value // time.Time - when the outstanding PINGREQ was sent
+	reconnectAttempts uint32       // number of automatic reconnection attempts made
+
+	lastConnectedAt    atomic.Value // time.Time - when the client last moved to the connected state
+	lastDisconnectedAt atomic.Value // time.Time - when the client last moved out of the connected state
+
 	lastSent        atomic.Value // time.Time - the last time a packet was successfully sent to network
 	lastReceived    atomic.Value // time.Time - the last time a packet was successfully received from network
 	pingOutstanding int32        // set to 1 if a ping has been sent but response not ret received
@@ -114,12 +231,35 @@ type client struct {
 
 	conn   net.Conn   // the network connection, must only be set with connMu locked (only used when starting/stopping workers)
 	connMu sync.Mutex // mutex for the connection (again only used in two functions)
+	broker *url.URL   // the broker that conn is (or will be) connected to, protected by connMu (nil for ExistingConn)
 
 	stop         chan struct{}        // Closed to request that workers stop
 	workers      sync.WaitGroup       // used to wait for workers to complete (ping, keepalive, errwatch, resume)
 	commsStopped chan struct{}        // closed when the comms routines have stopped (kept running until after workers have closed to avoid deadlocks)
+	routerDone   chan struct{}        // closed when the router has dispatched every message received on the connection
 	commsobound  chan *PacketAndToken // outgoing publish packets serviced by active comms go routines (maintains compatibility)
 	commsoboundP chan *PacketAndToken // outgoing 'priotity' packet serviced by active comms go routines (maintains compatibility)
+
+	reconnectNow chan struct{} // signals the (re)connect retry loop to stop sleeping and retry immediately
+
+	deferredSubs   []*PacketAndToken // subscribe requests made while disconnected (only if DeferredSubscribe is set)
+	deferredSubsMu sync.Mutex        // protects deferredSubs
+
+	subscriptions   map[string]byte // active subscriptions (filter -> requested QoS) used by AlwaysResubscribeOnSessionAbsent
+	subscriptionsMu sync.Mutex      // protects subscriptions
+
+	subscriptionWorkers   map[string]subscriptionWorker // workers started by SubscribeShared/SubscribeWithOptions/SubscribeBatch (keyed by route)
+	subscriptionWorkersMu sync.Mutex                    // protects subscriptionWorkers
+
+	storeAccounting *accountingStore // wraps options.Store (as persist) to track memory usage
+	ownRetained     *ownRetained     // retained messages recently published (nil unless SuppressOwnRetained is set)
+	dedup           *dedupCache      // keys of recently received messages (nil unless SetDedupWindow has been used)
+	coalescer       *coalescer       // last-value-wins publish coalescing (nil unless CoalesceTopics is set)
+	subStats        *subStats        // per route message statistics (nil unless SubscriptionStats is set)
+	netDialer       *netDialer       // resolver/DNS cache used when dialing brokers (nil for the defaults)
+	publishInflight chan struct{}    // limits QoS 1/2 publishes awaiting acknowledgement (nil unless MaxInflight is set)
+	errs            chan error       // non-fatal internal errors (see Errors)
+	logs            *loggers         // loggers that prefix each line with the ConnectionID
 }
 
 // NewClient will create an MQTT v3.1.1 client with all of the options specified
@@ -133,6 +273,15 @@ func NewClient(o *ClientOptions) Client {
 	if c.options.Store == nil {
 		c.options.Store = NewMemoryStore()
 	}
+	if c.options.ExistingConn != nil {
+		// the connection cannot be re-established so reconnecting is not possible
+		c.options.AutoReconnect = false
+		c.options.ConnectRetry = false
+	}
+	if c.options.SessionExpiryInterval > 0 {
+		// MQTT 3.1.1 has no session expiry so the closest match is a persistent session
+		c.options.CleanSession = false
+	}
 	switch c.options.ProtocolVersion {
 	case 3, 4:
 		c.options.protocolVersionExplicit = true
@@ -142,13 +291,43 @@ func NewClient(o *ClientOptions) Client {
 		c.options.ProtocolVersion = 4
 		c.options.protocolVersionExplicit = false
 	}
-	c.persist = c.options.Store
+	if c.options.ConnectionID == "" {
+		c.options.ConnectionID = newConnectionID()
+	}
+	c.logs = newLoggers(c.options.ConnectionID)
+	c.storeAccounting = newAccountingStore(c.options.Store, c.options.MaxStoreBytes)
+	c.storeAccounting.logs = c.logs
+	c.persist = c.storeAccounting
 	c.status = disconnected
-	c.messageIds = messageIds{index: make(map[uint16]tokenCompletor)}
+	c.messageIds = messageIds{index: make(map[uint16]tokenCompletor), allocator: c.options.MessageIDAllocator, logs: c.logs}
 	c.msgRouter = newRouter()
 	c.msgRouter.setDefaultHandler(c.options.DefaultPublishHandler)
+	c.msgRouter.setReceiveMaximum(c.options.ReceiveMaximum)
 	c.obound = make(chan *PacketAndToken)
 	c.oboundP = make(chan *PacketAndToken)
+	c.reconnectNow = make(chan struct{}, 1)
+	c.subscriptionWorkers = make(map[string]subscriptionWorker)
+	c.subscriptions = make(map[string]byte)
+	if c.options.SuppressOwnRetained {
+		c.ownRetained = newOwnRetained()
+	}
+	if c.options.DedupKeyFunc != nil && c.options.DedupWindow > 0 {
+		c.dedup = newDedupCache(c.options.DedupKeyFunc, c.options.DedupWindow)
+	}
+	if len(c.options.CoalesceTopics) > 0 {
+		c.coalescer = newCoalescer(c.options.CoalesceTopics, c.logs)
+	}
+	if c.options.SubscriptionStats {
+		c.subStats = newSubStats()
+	}
+	c.netDialer = newNetDialer(&c.options)
+	if c.netDialer != nil {
+		c.netDialer.logs = c.logs
+	}
+	c.errs = make(chan error, errorsChannelDepth)
+	if c.options.MaxInflight > 0 {
+		c.publishInflight = make(chan struct{}, c.options.MaxInflight)
+	}
 	return c
 }
 
@@ -157,15 +336,108 @@ func NewClient(o *ClientOptions) Client {
 // for parts of a wildcard subscription
 func (c *client) AddRoute(topic string, callback MessageHandler) {
 	if callback != nil {
-		c.msgRouter.addRoute(topic, callback)
+		c.msgRouter.addRoute(c.prefixTopic(topic), callback)
 	}
 }
 
+// ErrNotSysTopic is returned (via the token) by SubscribeSys if the filter is not within $SYS/
+var ErrNotSysTopic = errors.New("filter is not within the $SYS topic tree")
+
+// SubscribeSys subscribes to filter, which must begin with $SYS/, at QoS 0 for monitoring broker
+// internals (the content of the $SYS topics is broker specific). Application routes that begin with a
+// wildcard (e.g. # or +/b) never match $SYS topics so these messages are only passed to handler (or
+// the default handler). The TopicPrefix is not applied to $SYS topics.
+func (c *client) SubscribeSys(filter string, handler MessageHandler) Token {
+	if !strings.HasPrefix(filter, "$SYS/") {
+		token := newToken(packets.Subscribe).(*SubscribeToken)
+		token.setError(ErrNotSysTopic)
+		return token
+	}
+	return c.Subscribe(filter, 0, handler)
+}
+
+// ErrNotSubscribed is returned by ReplaceHandler if there is no active subscription to the filter
+var ErrNotSubscribed = errors.New("no active subscription to filter")
+
+// ReplaceHandler replaces the handler for an existing subscription without sending SUBSCRIBE or
+// UNSUBSCRIBE (so no messages are missed); messages dispatched after it returns are passed to handler.
+// filter must be identical to that passed to Subscribe; ErrNotSubscribed is returned if there is no
+// such active subscription. Note that handler is used as is (e.g. a dedicated worker requested via
+// SubscribeWithOptions will no longer be used).
+func (c *client) ReplaceHandler(filter string, handler MessageHandler) error {
+	if handler == nil {
+		return errors.New("handler must not be nil")
+	}
+	filter = c.prefixTopic(filter)
+	c.subscriptionsMu.Lock()
+	defer c.subscriptionsMu.Unlock() // held so the subscription cannot be removed while the route is updated
+	if _, ok := c.subscriptions[filter]; !ok {
+		return ErrNotSubscribed
+	}
+	c.msgRouter.addRoute(routeTopic(filter), handler)
+	return nil
+}
+
+// SetDefaultHandler replaces the handler that is called for messages that do not match any route
+// (initially the DefaultPublishHandler from the options). It may be called at any time, taking
+// effect for messages dispatched after it returns; nil removes the default handler.
+func (c *client) SetDefaultHandler(handler MessageHandler) {
+	c.msgRouter.setDefaultHandler(handler)
+}
+
+// AddObserver adds a handler that will be called for every message received, whether or not it
+// matches any route, before the route handlers (or the default handler) are called. This is
+// useful for metrics or audit logging. Observers are called, in the order they were added, by the
+// goroutine that routes messages so must not block; a panicking observer is logged and ignored.
+// Observers cannot acknowledge messages (they are acknowledged as normal once handled).
+func (c *client) AddObserver(observer MessageHandler) {
+	if observer != nil {
+		c.msgRouter.addObserver(observer)
+	}
+}
+
+// prefixTopic returns the topic with the configured TopicPrefix (if any) applied. For shared
+// subscriptions ($share/group/filter and $queue/filter) the prefix is added to the filter. The
+// broker's $SYS topics are never prefixed.
+func (c *client) prefixTopic(topic string) string {
+	prefix := c.options.TopicPrefix
+	if prefix == "" {
+		return topic
+	}
+	switch {
+	case strings.HasPrefix(topic, "$SYS/"):
+		return topic
+	case strings.HasPrefix(topic, "$share/"):
+		parts := strings.SplitN(topic, "/", 3)
+		if len(parts) == 3 {
+			return parts[0] + "/" + parts[1] + "/" + prefix + parts[2]
+		}
+	case strings.HasPrefix(topic, "$queue/"):
+		return "$queue/" + prefix + strings.TrimPrefix(topic, "$queue/")
+	}
+	return prefix + topic
+}
+
 // IsConnected returns a bool signifying whether
 // the client is connected or not.
-// connected means that the connection is up now OR it will
-// be established/reestablished automatically when possible
+// connected means that a CONNACK accepting the connection has been
+// received and the connection has not been lost since; while reconnecting
+// (or retrying the initial connection) false is returned
 func (c *client) IsConnected() bool {
+	return c.connectionStatus() == connected
+}
+
+// IsReconnecting returns a bool signifying whether the client has lost its
+// connection and is attempting to reestablish it automatically
+func (c *client) IsReconnecting() bool {
+	return c.connectionStatus() == reconnecting
+}
+
+// isConnectedOrPending returns a bool signifying whether the connection is up
+// now OR it will be established/reestablished automatically when possible
+// (publish/subscribe requests made in this state will be stored and sent
+// once the connection is up)
+func (c *client) isConnectedOrPending() bool {
 	c.RLock()
 	defer c.RUnlock()
 	status := atomic.LoadUint32(&c.status)
@@ -205,7 +477,13 @@ func (c *client) connectionStatus() uint32 {
 func (c *client) setConnected(status uint32) {
 	c.Lock()
 	defer c.Unlock()
-	atomic.StoreUint32(&c.status, status)
+	prev := atomic.SwapUint32(&c.status, status)
+	switch {
+	case status == connected && prev != connected:
+		c.lastConnectedAt.Store(time.Now())
+	case prev == connected && status != connected:
+		c.lastDisconnectedAt.Store(time.Now())
+	}
 }
 
 //ErrNotConnected is the error returned from function calls that are
@@ -223,8 +501,46 @@ var (
 	ErrPublishUnknownPayload   = errors.New("unknown payload type")
 	ErrPublishNoMsgIDAvailable = errors.New("no message IDs available")
 	ErrPublishTimeout          = errors.New("publish was broken by timeout")
+	ErrPublishPayloadSize      = errors.New("invalid payload size")
 )
 
+// maxPayloadSize is the largest payload that can be encoded (the maximum remaining length of an MQTT
+// packet less the minimum topic and message id overhead)
+const maxPayloadSize = 268435455 - 4
+
+// ConnackError is the error set on the ConnectToken when the broker rejects the connection;
+// Code is the return code from the CONNACK (e.g. packets.ErrRefusedNotAuthorised). Use
+// errors.As to retrieve it.
+type ConnackError struct {
+	Code byte
+}
+
+func (e *ConnackError) Error() string {
+	if err, ok := packets.ConnErrors[e.Code]; ok && err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("connection refused, return code %d", e.Code)
+}
+
+// Unwrap returns the matching error from packets.ConnErrors (so errors.Is may be used to check it)
+func (e *ConnackError) Unwrap() error {
+	return packets.ConnErrors[e.Code]
+}
+
+// ServerDisconnectError is the error passed to the OnConnectionLost handler when the broker sent a
+// DISCONNECT (only MQTT 5 brokers do this) before closing the connection; ReasonCode is the reason
+// given (e.g. 0x89 server busy or 0x8E session taken over). Use errors.As to retrieve it.
+type ServerDisconnectError struct {
+	ReasonCode byte
+}
+
+func (e *ServerDisconnectError) Error() string {
+	if reason, ok := packets.DisconnectReasonCodes[e.ReasonCode]; ok {
+		return fmt.Sprintf("disconnected by server: %s", reason)
+	}
+	return fmt.Sprintf("disconnected by server, reason code %#x", e.ReasonCode)
+}
+
 // Connect will create a connection to the message broker, by default
 // it will attempt to connect at v3.1.1 and auto retry at v3.1 if that
 // fails
@@ -233,47 +549,78 @@ var (
 // because queued messages may be delivered immediatly post connection
 func (c *client) Connect() Token {
 	t := newToken(packets.Connect).(*ConnectToken)
-	DEBUG.Println(CLI, "Connect()")
+	c.logs.DEBUG.Println(CLI, "Connect()")
 
 	if c.options.ConnectRetry && atomic.LoadUint32(&c.status) != disconnected {
 		// if in any state other than disconnected and ConnectRetry is
 		// enabled then the connection will come up automatically
 		// client can assume connection is up
-		WARN.Println(CLI, "Connect() called but not disconnected")
+		c.logs.WARN.Println(CLI, "Connect() called but not disconnected")
 		t.returnCode = packets.Accepted
 		t.flowComplete()
 		return t
 	}
 
+	if c.options.httpProxyErr != nil {
+		c.logs.ERROR.Println(CLI, c.options.httpProxyErr)
+		t.setError(c.options.httpProxyErr)
+		return t
+	}
+
+	if problem := checkClientID(&c.options); problem != "" {
+		c.logs.WARN.Println(CLI, problem)
+	}
+	if problem := checkWillProperties(&c.options); problem != "" {
+		c.logs.WARN.Println(CLI, problem)
+	}
+
 	c.persist.Open()
+	c.loadPersistedSubscriptions()
 	if c.options.ConnectRetry {
 		c.reserveStoredPublishIDs() // Reserve IDs to allow publish before connect complete
 	}
 	c.setConnected(connecting)
 
 	go func() {
-		if len(c.options.Servers) == 0 {
+		if len(c.options.Servers) == 0 && c.options.ExistingConn == nil {
 			t.setError(fmt.Errorf("no servers defined to connect to"))
 			return
 		}
 
+		attempts := 0
 	RETRYCONN:
 		var conn net.Conn
 		var rc byte
+		var sessionPresent bool
+		var timings ConnectTimings
 		var err error
-		conn, rc, t.sessionPresent, err = c.attemptConnection()
+		conn, rc, sessionPresent, err = c.attemptConnection(&timings)
+		t.m.Lock() // the token may already be being read (e.g. Timings() whilst waiting)
+		t.sessionPresent, t.timings = sessionPresent, timings
+		t.m.Unlock()
 		if err != nil {
-			if c.options.ConnectRetry {
-				DEBUG.Println(CLI, "Connect failed, sleeping for", int(c.options.ConnectRetryInterval.Seconds()), "seconds and will then retry")
-				time.Sleep(c.options.ConnectRetryInterval)
+			attempts++
+			if c.options.ConnectRetry && c.options.MaxInitialConnectAttempts > 0 && attempts >= c.options.MaxInitialConnectAttempts {
+				c.logs.WARN.Println(CLI, "Connect failed after", attempts, "attempts, giving up")
+			} else if c.options.ConnectRetry && c.options.FailFastOnDNSError && isHostNotFound(err) {
+				c.logs.WARN.Println(CLI, "Connect failed as broker host names do not exist, not retrying:", err)
+			} else if c.options.ConnectRetry {
+				c.logs.DEBUG.Println(CLI, "Connect failed, sleeping for", int(c.options.ConnectRetryInterval.Seconds()), "seconds and will then retry")
+				select {
+				case <-time.After(c.options.ConnectRetryInterval):
+				case <-c.reconnectNow:
+					c.logs.DEBUG.Println(CLI, "Reconnect() called, retrying connection immediately")
+				}
 
 				if atomic.LoadUint32(&c.status) == connecting {
 					goto RETRYCONN
 				}
 			}
-			ERROR.Println(CLI, "Failed to connect to a broker")
+			c.logs.ERROR.Println(CLI, "Failed to connect to a broker")
+			c.emitEvent(ClientEvent{Type: EventError, Err: err})
 			c.setConnected(disconnected)
 			c.persist.Close()
+			c.failDeferredSubscribes(ErrNotConnected)
 			t.returnCode = rc
 			t.setError(err)
 			return
@@ -283,26 +630,33 @@ func (c *client) Connect() Token {
 			// Take care of any messages in the store
 			if !c.options.CleanSession {
 				c.resume(c.options.ResumeSubs, inboundFromStore)
+				if c.options.PersistSubscriptions && !t.sessionPresent {
+					c.resubscribe()
+				}
 			} else {
 				c.persist.Reset()
 			}
+			c.flushDeferredSubscribes()
 		} else {
-			WARN.Println(CLI, "Connect() called but connection established in another goroutine")
+			c.logs.WARN.Println(CLI, "Connect() called but connection established in another goroutine")
 		}
 
 		close(inboundFromStore)
 		t.flowComplete()
-		DEBUG.Println(CLI, "exit startClient")
+		c.logs.DEBUG.Println(CLI, "exit startClient")
 	}()
 	return t
 }
 
 // internal function used to reconnect the client when it loses its connection
 func (c *client) reconnect() {
-	DEBUG.Println(CLI, "enter reconnect")
+	c.logs.DEBUG.Println(CLI, "enter reconnect")
 	var (
-		sleep = time.Duration(1 * time.Second)
-		conn  net.Conn
+		policy         = RetryPolicy{InitialInterval: time.Second, MaxInterval: c.options.MaxReconnectInterval}
+		sleep          = policy.initial()
+		conn           net.Conn
+		sessionPresent bool
+		attempts       int
 	)
 
 	for {
@@ -310,18 +664,27 @@ func (c *client) reconnect() {
 			c.options.OnReconnecting(c, &c.options)
 		}
 		var err error
-		conn, _, _, err = c.attemptConnection()
+		atomic.AddUint32(&c.reconnectAttempts, 1)
+		conn, _, sessionPresent, err = c.attemptConnection(&ConnectTimings{})
 		if err == nil {
 			break
 		}
-		DEBUG.Println(CLI, "Reconnect failed, sleeping for", int(sleep.Seconds()), "seconds:", err)
-		time.Sleep(sleep)
-		if sleep < c.options.MaxReconnectInterval {
-			sleep *= 2
+		c.emitEvent(ClientEvent{Type: EventError, Err: err})
+		attempts++
+		if max := c.options.MaxReconnectAttempts; max > 0 && attempts >= max {
+			c.reconnectExhausted(attempts)
+			return
 		}
-
-		if sleep > c.options.MaxReconnectInterval {
-			sleep = c.options.MaxReconnectInterval
+		c.logs.DEBUG.Println(CLI, "Reconnect failed, sleeping for", int(sleep.Seconds()), "seconds:", err)
+		select {
+		case <-time.After(sleep):
+			sleep = policy.next(sleep)
+			if sleep > c.options.MaxReconnectInterval {
+				sleep = c.options.MaxReconnectInterval // MaxInterval of 0 means no maximum so retain the original clamp
+			}
+		case <-c.reconnectNow:
+			c.logs.DEBUG.Println(CLI, "Reconnect() called, retrying immediately")
+			sleep = policy.initial() // reset the backoff
 		}
 		// Disconnect may have been called
 		if atomic.LoadUint32(&c.status) == disconnected {
@@ -332,17 +695,63 @@ func (c *client) reconnect() {
 	// Disconnect() must have been called while we were trying to reconnect.
 	if c.connectionStatus() == disconnected {
 		conn.Close()
-		DEBUG.Println(CLI, "Client moved to disconnected state while reconnecting, abandoning reconnect")
+		c.logs.DEBUG.Println(CLI, "Client moved to disconnected state while reconnecting, abandoning reconnect")
 		return
 	}
 
 	inboundFromStore := make(chan packets.ControlPacket) // there may be some inbound comms packets in the store that are awaitring processing
 	if c.startCommsWorkers(conn, inboundFromStore) {
 		c.resume(c.options.ResumeSubs, inboundFromStore)
+		if (c.options.AlwaysResubscribeOnSessionAbsent || c.options.PersistSubscriptions) && !c.options.CleanSession && !sessionPresent {
+			c.resubscribe()
+		}
+		c.flushDeferredSubscribes()
 	}
 	close(inboundFromStore)
 }
 
+// reconnectExhausted is called when MaxReconnectAttempts consecutive reconnection attempts have
+// failed; the client moves to the disconnected state and the OnReconnectExhausted handler is called
+func (c *client) reconnectExhausted(attempts int) {
+	c.Lock()
+	if atomic.LoadUint32(&c.status) == disconnected {
+		c.Unlock()
+		return // Disconnect has been called
+	}
+	atomic.StoreUint32(&c.status, disconnected)
+	c.Unlock()
+	c.logs.WARN.Println(CLI, "Reconnect failed after", attempts, "attempts, giving up")
+	c.disconnect()
+	c.emitEvent(ClientEvent{Type: EventDisconnected})
+	if c.options.OnReconnectExhausted != nil {
+		go c.options.OnReconnectExhausted()
+	}
+}
+
+// Reconnect drops the current connection (if any) and immediately attempts to reconnect,
+// resetting the reconnection backoff. This is useful when the application knows that the
+// network has changed and does not want to wait for the keepalive to detect a stale
+// connection. If the client is disconnected a connection attempt is started (as per Connect).
+// The OnConnectionLost handler is not called for a connection dropped by Reconnect.
+func (c *client) Reconnect() {
+	c.logs.DEBUG.Println(CLI, "Reconnect()")
+	switch c.connectionStatus() {
+	case connected:
+		if c.stopCommsWorkers() {
+			c.setConnected(reconnecting)
+			go c.reconnect()
+		}
+	case connecting, reconnecting:
+		// wake up the retry loop if it is sleeping (no need to block if a request is already pending)
+		select {
+		case c.reconnectNow <- struct{}{}:
+		default:
+		}
+	default:
+		c.Connect()
+	}
+}
+
 // attemptConnection makes a single attempt to connect to each of the brokers
 // the protocol version to use is passed in (as c.options.ProtocolVersion)
 // Note: Does not set c.conn in order to minimise race conditions
@@ -351,7 +760,8 @@ func (c *client) reconnect() {
 // byte - Return code (packets.Accepted indicates a successful connection).
 // bool - SessionPresent flag from the connect ack (only valid if packets.Accepted)
 // err - Error (err != nil guarantees that conn has been set to active connection).
-func (c *client) attemptConnection() (net.Conn, byte, bool, error) {
+// The time taken by each phase of the (last) attempt is recorded in timings.
+func (c *client) attemptConnection(timings *ConnectTimings) (net.Conn, byte, bool, error) {
 	protocolVersion := c.options.ProtocolVersion
 	var (
 		sessionPresent bool
@@ -360,25 +770,38 @@ func (c *client) attemptConnection() (net.Conn, byte, bool, error) {
 		rc             byte
 	)
 
+	if c.options.ExistingConn != nil {
+		return c.attemptExistingConnection(timings)
+	}
+
 	c.optionsMu.Lock() // Protect c.options.Servers so that servers can be added in test cases
 	brokers := c.options.Servers
 	c.optionsMu.Unlock()
+	var connectedBroker *url.URL
+	hostsNotFound := len(brokers) > 0 // true if no broker's host name exists
 	for _, broker := range brokers {
+		connectedBroker = broker
 		cm := newConnectMsgFromOptions(&c.options, broker)
-		DEBUG.Println(CLI, "about to write new connect msg")
+		c.logs.DEBUG.Println(CLI, "about to write new connect msg")
 	CONN:
+		*timings = ConnectTimings{}
 		// Start by opening the network connection (tcp, tls, ws) etc
-		conn, err = openConnection(broker, c.options.TLSConfig, c.options.ConnectTimeout, c.options.HTTPHeaders, c.options.WebsocketOptions)
+		conn, err = openConnection(broker, tlsConfigFromOptions(&c.options), c.options.ConnectTimeout, c.options.HTTPHeaders, c.options.WebsocketOptions, c.options.HTTPProxy, c.netDialer, timings, c.options.ConnectProgressHandler)
 		if err != nil {
-			ERROR.Println(CLI, err.Error())
-			WARN.Println(CLI, "failed to connect to broker, trying next")
+			c.logs.ERROR.Println(CLI, err.Error())
+			c.logs.WARN.Println(CLI, "failed to connect to broker, trying next")
+			c.reportError(fmt.Errorf("connecting to %s: %w", broker.Host, err))
 			rc = packets.ErrNetworkError
+			hostsNotFound = hostsNotFound && isHostNotFound(err)
 			continue
 		}
-		DEBUG.Println(CLI, "socket connected to broker")
+		hostsNotFound = false
+		c.logs.DEBUG.Println(CLI, "socket connected to broker")
 
 		// Now we send the perform the MQTT connection handshake
-		rc, sessionPresent = ConnectMQTT(conn, cm, protocolVersion)
+		handshakeStart := time.Now()
+		rc, sessionPresent = connectMQTT(conn, cm, protocolVersion, c.options.ConnectProgressHandler, c.logs)
+		timings.MQTTHandshake = time.Since(handshakeStart)
 		if rc == packets.Accepted {
 			break // successfully connected
 		}
@@ -388,36 +811,63 @@ func (c *client) attemptConnection() (net.Conn, byte, bool, error) {
 			conn.Close()
 		}
 		if !c.options.protocolVersionExplicit && protocolVersion == 4 { // try falling back to 3.1?
-			DEBUG.Println(CLI, "Trying reconnect using MQTT 3.1 protocol")
+			c.logs.DEBUG.Println(CLI, "Trying reconnect using MQTT 3.1 protocol")
 			protocolVersion = 3
 			goto CONN
 		}
 		if c.options.protocolVersionExplicit { // to maintain logging from previous version
-			ERROR.Println(CLI, "Connecting to", broker, "CONNACK was not CONN_ACCEPTED, but rather", packets.ConnackReturnCodes[rc])
+			c.logs.ERROR.Println(CLI, "Connecting to", broker, "CONNACK was not CONN_ACCEPTED, but rather", packets.ConnackReturnCodes[rc])
 		}
 	}
 	// If the connection was successful we set member variable and lock in the protocol version for future connection attempts (and users)
 	if rc == packets.Accepted {
 		c.options.ProtocolVersion = protocolVersion
 		c.options.protocolVersionExplicit = true
+		c.connMu.Lock()
+		c.broker = connectedBroker
+		c.connMu.Unlock()
 	} else {
 		// Maintain same error format as used previously
-		if rc != packets.ErrNetworkError { // mqtt error
-			err = packets.ConnErrors[rc]
-		} else { // network error (if this occured in ConnectMQTT then err will be nil)
+		switch {
+		case rc != packets.ErrNetworkError: // mqtt error
+			err = &ConnackError{Code: rc}
+		case hostsNotFound: // wrapped so that isHostNotFound (and errors.As) can identify the cause
+			err = fmt.Errorf("%s : %w", packets.ConnErrors[rc], err)
+		default: // network error (if this occured in ConnectMQTT then err will be nil)
 			err = fmt.Errorf("%s : %s", packets.ConnErrors[rc], err)
 		}
 	}
 	return conn, rc, sessionPresent, err
 }
 
+// attemptExistingConnection performs the MQTT handshake over options.ExistingConn (see attemptConnection
+// for details of the return values). As the connection cannot be reopened there is no fallback to MQTT 3.1.
+func (c *client) attemptExistingConnection(timings *ConnectTimings) (net.Conn, byte, bool, error) {
+	conn := c.options.ExistingConn
+	cm := newConnectMsgFromOptions(&c.options, &url.URL{})
+	c.logs.DEBUG.Println(CLI, "about to write new connect msg to existing connection")
+	*timings = ConnectTimings{}
+	handshakeStart := time.Now()
+	rc, sessionPresent := connectMQTT(conn, cm, c.options.ProtocolVersion, c.options.ConnectProgressHandler, c.logs)
+	timings.MQTTHandshake = time.Since(handshakeStart)
+	if rc != packets.Accepted {
+		conn.Close()
+		if rc != packets.ErrNetworkError {
+			return nil, rc, false, &ConnackError{Code: rc}
+		}
+		return nil, rc, false, fmt.Errorf("%s : existing connection", packets.ConnErrors[rc])
+	}
+	c.options.protocolVersionExplicit = true
+	return conn, rc, sessionPresent, nil
+}
+
 // Disconnect will end the connection with the server, but not before waiting
 // the specified number of milliseconds to wait for existing work to be
 // completed.
 func (c *client) Disconnect(quiesce uint) {
 	status := atomic.LoadUint32(&c.status)
 	if status == connected {
-		DEBUG.Println(CLI, "disconnecting")
+		c.logs.DEBUG.Println(CLI, "disconnecting")
 		c.setConnected(disconnected)
 
 		dm := packets.NewControlPacket(packets.Disconnect).(*packets.DisconnectPacket)
@@ -425,25 +875,56 @@ func (c *client) Disconnect(quiesce uint) {
 		c.oboundP <- &PacketAndToken{p: dm, t: dt}
 
 		// wait for work to finish, or quiesce time consumed
-		DEBUG.Println(CLI, "calling WaitTimeout")
+		c.logs.DEBUG.Println(CLI, "calling WaitTimeout")
+		deadline := time.Now().Add(time.Duration(quiesce) * time.Millisecond)
 		dt.WaitTimeout(time.Duration(quiesce) * time.Millisecond)
-		DEBUG.Println(CLI, "WaitTimeout done")
+		c.logs.DEBUG.Println(CLI, "WaitTimeout done")
+		if c.options.DrainOnDisconnect {
+			c.drainInbound(time.Until(deadline))
+		}
 	} else {
-		WARN.Println(CLI, "Disconnect() called but not connected (disconnected/reconnecting)")
+		c.logs.WARN.Println(CLI, "Disconnect() called but not connected (disconnected/reconnecting)")
 		c.setConnected(disconnected)
 	}
 
+	c.failDeferredSubscribes(ErrNotConnected)
+	c.stopAllSubscriptionWorkers()
 	c.disconnect()
+	c.emitEvent(ClientEvent{Type: EventDisconnected})
+}
+
+// drainInbound waits, for up to timeout, for the messages already received to be dispatched and for
+// any handlers running in their own goroutines to return (see SetDrainOnDisconnect). The connection
+// must be closing (i.e. the DISCONNECT sent) so that the router will stop.
+func (c *client) drainInbound(timeout time.Duration) {
+	c.connMu.Lock()
+	routerDone := c.routerDone
+	c.connMu.Unlock()
+	if routerDone == nil {
+		return
+	}
+	drained := make(chan struct{})
+	go func() {
+		<-routerDone
+		c.msgRouter.handlers.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		c.logs.DEBUG.Println(CLI, "inbound messages drained")
+	case <-time.After(timeout):
+		c.logs.WARN.Println(CLI, "quiesce time elapsed before inbound messages were drained")
+	}
 }
 
 // forceDisconnect will end the connection with the mqtt broker immediately (used for tests only)
 func (c *client) forceDisconnect() {
-	if !c.IsConnected() {
-		WARN.Println(CLI, "already disconnected")
+	if !c.isConnectedOrPending() {
+		c.logs.WARN.Println(CLI, "already disconnected")
 		return
 	}
 	c.setConnected(disconnected)
-	DEBUG.Println(CLI, "forcefully disconnecting")
+	c.logs.DEBUG.Println(CLI, "forcefully disconnecting")
 	c.disconnect()
 }
 
@@ -451,7 +932,7 @@ func (c *client) forceDisconnect() {
 func (c *client) disconnect() {
 	c.stopCommsWorkers()
 	c.messageIds.cleanUp()
-	DEBUG.Println(CLI, "disconnected")
+	c.logs.DEBUG.Println(CLI, "disconnected")
 	c.persist.Close()
 }
 
@@ -460,10 +941,10 @@ func (c *client) internalConnLost(err error) {
 	// It is possible that internalConnLost will be called multiple times simultaneously
 	// (including after sending a DisconnectPacket) as such we only do cleanup etc if the
 	// routines were actually running and are not being disconnected at users request
-	DEBUG.Println(CLI, "internalConnLost called")
+	c.logs.DEBUG.Println(CLI, "internalConnLost called")
 	status := atomic.LoadUint32(&c.status)
 	if status != disconnected && c.stopCommsWorkers() {
-		DEBUG.Println(CLI, "internalConnLost stopped workers")
+		c.logs.DEBUG.Println(CLI, "internalConnLost stopped workers")
 		if c.options.CleanSession && !c.options.AutoReconnect {
 			c.messageIds.cleanUp()
 		}
@@ -476,45 +957,54 @@ func (c *client) internalConnLost(err error) {
 		if c.options.OnConnectionLost != nil {
 			go c.options.OnConnectionLost(c, err)
 		}
+		c.emitEvent(ClientEvent{Type: EventConnectionLost, Err: err})
 	}
-	DEBUG.Println(CLI, "internalConnLost exiting")
+	c.logs.DEBUG.Println(CLI, "internalConnLost exiting")
 }
 
 // startCommsWorkers is called when the connection is up. It starts off all of the routines needed to process incomming and
 // outdoing messages.
 // Returns true if the comms workers were started (i.e. they were not already running)
 func (c *client) startCommsWorkers(conn net.Conn, inboundFromStore <-chan packets.ControlPacket) bool {
-	DEBUG.Println(CLI, "startCommsWorkers called")
+	c.logs.DEBUG.Println(CLI, "startCommsWorkers called")
 	c.connMu.Lock()
 	defer c.connMu.Unlock()
 	if c.conn != nil {
-		WARN.Println(CLI, "startCommsWorkers called when commsworkers already running")
+		c.logs.WARN.Println(CLI, "startCommsWorkers called when commsworkers already running")
 		conn.Close() // No use for the new network connection
 		return false
 	}
 	c.conn = conn // Store the connection
 
 	c.stop = make(chan struct{})
-	if c.options.KeepAlive != 0 {
+	if c.options.KeepAlive > 0 {
 		atomic.StoreInt32(&c.pingOutstanding, 0)
 		c.lastReceived.Store(time.Now())
 		c.lastSent.Store(time.Now())
 		c.workers.Add(1)
-		go keepalive(c, conn)
+		go keepalive(c)
+	}
+	if c.options.AppHeartbeatTopic != "" && c.options.AppHeartbeatInterval > 0 {
+		c.workers.Add(1)
+		go appHeartbeat(c)
 	}
 
 	incomingPubChan := make(chan *packets.PublishPacket)
+	routerDone := make(chan struct{})
+	c.routerDone = routerDone
 	c.workers.Add(1)
 	go func() {
 		c.msgRouter.matchAndDispatch(incomingPubChan, c.options.Order, c)
+		close(routerDone)
 		c.workers.Done()
 	}()
 
 	c.setConnected(connected)
-	DEBUG.Println(CLI, "client is connected/reconnected")
+	c.logs.DEBUG.Println(CLI, "client is connected/reconnected")
 	if c.options.OnConnect != nil {
 		go c.options.OnConnect(c)
 	}
+	c.emitEvent(ClientEvent{Type: EventConnected})
 
 	// c.oboundP and c.obound need to stay active for the life of the client because, depending upon the options,
 	// messages may be published while the client is disconnected (they will block unless in a goroutine). However
@@ -529,9 +1019,12 @@ func (c *client) startCommsWorkers(conn net.Conn, inboundFromStore <-chan packet
 			case msg := <-c.oboundP:
 				c.commsoboundP <- msg
 			case msg := <-c.obound:
+				if c.coalescer != nil {
+					msg = c.coalescer.take(msg) // send the most recent publish to the topic
+				}
 				c.commsobound <- msg
 			case <-c.stop:
-				DEBUG.Println(CLI, "startCommsWorkers output redirector finnished")
+				c.logs.DEBUG.Println(CLI, "startCommsWorkers output redirector finnished")
 				return
 			}
 		}
@@ -558,15 +1051,16 @@ func (c *client) startCommsWorkers(conn net.Conn, inboundFromStore <-chan packet
 					commsErrors = nil
 					continue
 				}
-				ERROR.Println(CLI, "Connect comms goroutine - error triggered", err)
+				c.logs.ERROR.Println(CLI, "Connect comms goroutine - error triggered", err)
+				c.emitEvent(ClientEvent{Type: EventError, Err: err})
 				go c.internalConnLost(err) // no harm in calling this if the connection is already down (better than stopping!)
 				continue
 			}
 		}
-		DEBUG.Println(CLI, "comms goroutine done")
+		c.logs.DEBUG.Println(CLI, "comms goroutine done")
 		close(c.commsStopped)
 	}()
-	DEBUG.Println(CLI, "startCommsWorkers done")
+	c.logs.DEBUG.Println(CLI, "startCommsWorkers done")
 	return true
 }
 
@@ -574,12 +1068,12 @@ func (c *client) startCommsWorkers(conn net.Conn, inboundFromStore <-chan packet
 // Returns true if the workers were stopped (use as a signal to restart them if needed)
 // Note: This may block so run as a go routine if calling from any of the comms routines
 func (c *client) stopCommsWorkers() bool {
-	DEBUG.Println(CLI, "stopCommsWorkers called")
+	c.logs.DEBUG.Println(CLI, "stopCommsWorkers called")
 	// It is possible that this function will be called multiple times simultaneously due to the way things get shutdown
 	c.connMu.Lock()
 	defer c.connMu.Unlock()
 	if c.conn == nil {
-		DEBUG.Println(CLI, "stopCommsWorkers done (not running)")
+		c.logs.DEBUG.Println(CLI, "stopCommsWorkers done (not running)")
 		return false
 	}
 
@@ -594,16 +1088,16 @@ func (c *client) stopCommsWorkers() bool {
 	c.conn.Close() // Possible that this is already closed but no harm in closing again
 	c.conn = nil
 
-	DEBUG.Println(CLI, "stopCommsWorkers waiting for workers")
+	c.logs.DEBUG.Println(CLI, "stopCommsWorkers waiting for workers")
 	c.workers.Wait()
 
 	// As everything relying upon comms is notw stopped we can stop the comms outbound channels
 	close(c.commsobound)
 	close(c.commsoboundP)
-	DEBUG.Println(CLI, "stopCommsWorkers waiting for comms")
+	c.logs.DEBUG.Println(CLI, "stopCommsWorkers waiting for comms")
 	<-c.commsStopped // wait for comms routine to stop
 
-	DEBUG.Println(CLI, "stopCommsWorkers done")
+	c.logs.DEBUG.Println(CLI, "stopCommsWorkers done")
 	return true
 }
 
@@ -611,33 +1105,187 @@ func (c *client) stopCommsWorkers() bool {
 // to the specified topic.
 // Returns a token to track delivery of the message to the broker
 func (c *client) Publish(topic string, qos byte, retained bool, payload interface{}) Token {
+	c.logs.DEBUG.Println(CLI, "enter Publish")
+	token, pub, topic := c.newPublish(topic, qos, retained, payload)
+	if pub == nil {
+		return token
+	}
+	return c.publish(topic, pub, token)
+}
+
+// ErrPublishQueueFull is returned (via the token) by TryPublish when the message cannot be queued
+// without blocking
+var ErrPublishQueueFull = errors.New("publish queue full")
+
+// TryPublish publishes a message as per Publish but never blocks; if the message cannot be queued
+// for sending immediately (or the client is not connected) false is returned, along with a token
+// holding the reason, and nothing has been queued (or stored) so the message can be discarded. This
+// allows load to be shed rather than publishers being delayed. With SetMaxInflight a QoS 1/2 message
+// is only queued if a slot is free.
+func (c *client) TryPublish(topic string, qos byte, retained bool, payload interface{}) (Token, bool) {
+	c.logs.DEBUG.Println(CLI, "enter TryPublish")
+	token, pub, topic := c.newPublish(topic, qos, retained, payload)
+	if pub == nil {
+		return token, false
+	}
+	return token, c.tryPublish(topic, pub, token)
+}
+
+// newPublish validates the arguments to Publish and builds the publish packet, also returning the
+// topic after any OutboundTopicRewriter has been applied; if this fails the packet is nil and the
+// error is set on the token
+func (c *client) newPublish(topic string, qos byte, retained bool, payload interface{}) (*PublishToken, *packets.PublishPacket, string) {
 	token := newToken(packets.Publish).(*PublishToken)
-	DEBUG.Println(CLI, "enter Publish")
+	if err := validateQos(qos); err != nil {
+		token.setError(err)
+		return token, nil, topic
+	}
+	var data []byte
+	switch p := payload.(type) {
+	case string:
+		data = []byte(p)
+	case []byte:
+		data = p
+	case bytes.Buffer:
+		data = p.Bytes()
+	default:
+		token.setError(ErrPublishUnknownPayload)
+		return token, nil, topic
+	}
+	if c.options.OutboundTopicRewriter != nil {
+		topic = c.options.OutboundTopicRewriter(topic, data)
+	}
+	if err := validatePublishTopic(c.prefixTopic(topic)); err != nil {
+		token.setError(err)
+		return token, nil, topic
+	}
 	switch {
-	case !c.IsConnected():
+	case !c.isConnectedOrPending():
 		token.setError(ErrNotConnected)
-		return token
+		return token, nil, topic
 	case c.connectionStatus() == reconnecting && qos == 0:
 		token.setError(ErrConnStatusReconnecting)
-		return token
+		return token, nil, topic
 	}
 	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
 	pub.Qos = qos
-	pub.TopicName = topic
+	pub.TopicName = c.prefixTopic(topic)
 	pub.Retain = retained
-	switch p := payload.(type) {
-	case string:
-		pub.Payload = []byte(p)
-	case []byte:
-		pub.Payload = p
-	case bytes.Buffer:
-		pub.Payload = p.Bytes()
-	default:
-		token.setError(ErrPublishUnknownPayload)
+	pub.Payload = data
+	if retained && c.ownRetained != nil {
+		c.ownRetained.record(pub.TopicName, pub.Payload)
+	}
+	return token, pub, topic
+}
+
+// PublishReader publishes a message (as per Publish) whose payload of size bytes is read from r.
+// For QoS 0 the payload is copied directly from r to the network connection when the message is
+// sent, avoiding the need to hold it in memory (r must not be used until the token completes).
+// For QoS 1 and 2 the message may need to be resent so the payload is read into memory first.
+func (c *client) PublishReader(topic string, qos byte, retained bool, r io.Reader, size int64) Token {
+	if err := validateQos(qos); err != nil {
+		token := newToken(packets.Publish).(*PublishToken)
+		token.setError(err)
+		return token
+	}
+	if size < 0 || size > maxPayloadSize {
+		token := newToken(packets.Publish).(*PublishToken)
+		token.setError(ErrPublishPayloadSize)
+		return token
+	}
+	if qos > 0 {
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			token := newToken(packets.Publish).(*PublishToken)
+			token.setError(err)
+			return token
+		}
+		return c.Publish(topic, qos, retained, payload)
+	}
+
+	token := newToken(packets.Publish).(*PublishToken)
+	c.logs.DEBUG.Println(CLI, "enter PublishReader")
+	if c.options.OutboundTopicRewriter != nil {
+		topic = c.options.OutboundTopicRewriter(topic, nil) // the payload has not been read
+	}
+	if err := validatePublishTopic(c.prefixTopic(topic)); err != nil {
+		token.setError(err)
 		return token
 	}
+	switch {
+	case !c.isConnectedOrPending():
+		token.setError(ErrNotConnected)
+		return token
+	case c.connectionStatus() == reconnecting:
+		token.setError(ErrConnStatusReconnecting)
+		return token
+	}
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = c.prefixTopic(topic)
+	pub.Retain = retained
+	pub.PayloadReader = r
+	pub.PayloadSize = size
+	return c.publish(topic, pub, token)
+}
 
+// PublishWithContext publishes a message as per Publish but, if ctx is done before the flow
+// completes (PUBACK for QoS 1, PUBCOMP for QoS 2), the message is removed from the store (so it
+// will not be resent on reconnection) and the token completes with ctx.Err(). A message that is
+// still queued is not sent; its ID is released when it is dropped from the queue.
+// Note that the message may already have been sent, so the broker may still have received (and
+// delivered) it; cancellation only means that the client stops tracking delivery. QoS 0 messages
+// are not tracked so, once queued, cannot be cancelled.
+func (c *client) PublishWithContext(ctx context.Context, topic string, qos byte, retained bool, payload interface{}) Token {
+	if err := ctx.Err(); err != nil {
+		token := newToken(packets.Publish).(*PublishToken)
+		token.setError(err)
+		return token
+	}
+	token := c.Publish(topic, qos, retained, payload).(*PublishToken)
+	if token.messageID != 0 && ctx.Done() != nil {
+		go c.cancelPublishOnDone(ctx, token)
+	}
+	return token
+}
+
+// cancelPublishOnDone waits for token to complete and, if ctx is done first, abandons the publish
+func (c *client) cancelPublishOnDone(ctx context.Context, token *PublishToken) {
+	select {
+	case <-token.Done():
+		return
+	case <-ctx.Done():
+	}
+	if token.cancel() {
+		// Still queued; the ID is released when the outgoing goroutine drops the packet (so it
+		// cannot be reused whilst this packet may still be written)
+		if c.messageIds.getToken(token.messageID) != token {
+			return // the session was cleaned up in the meantime
+		}
+	} else if !c.messageIds.releaseID(token.messageID, token) {
+		return // the flow completed (or the session was cleaned up) in the meantime
+	}
+	c.persist.Del(outboundKeyFromMID(token.messageID))
+	c.logs.DEBUG.Println(CLI, "publish abandoned as context done, id:", token.messageID)
+	token.setError(ctx.Err())
+}
+
+// publish allocates a message id (if required) and stores/sends the publish packet
+func (c *client) publish(topic string, pub *packets.PublishPacket, token *PublishToken) Token {
+	token.topic = topic
+	publishWaitTimeout := c.options.WriteTimeout
+	if publishWaitTimeout == 0 {
+		publishWaitTimeout = time.Second * 30
+	}
 	if pub.Qos != 0 && pub.MessageID == 0 {
+		if c.publishInflight != nil {
+			select {
+			case c.publishInflight <- struct{}{}: // blocks until an earlier publish completes
+				token.onDone = func() { <-c.publishInflight }
+			case <-time.After(publishWaitTimeout):
+				token.setError(ErrPublishTimeout)
+				return token
+			}
+		}
 		mID := c.getID(token)
 		if mID == 0 {
 			token.setError(ErrPublishNoMsgIDAvailable)
@@ -649,19 +1297,27 @@ func (c *client) Publish(topic string, qos byte, retained bool, payload interfac
 	persistOutbound(c.persist, pub)
 	switch c.connectionStatus() {
 	case connecting:
-		DEBUG.Println(CLI, "storing publish message (connecting), topic:", topic)
+		c.logs.DEBUG.Println(CLI, "storing publish message (connecting), topic:", topic)
 		token.setError(ErrConnStatusConnecting)
 	case reconnecting:
-		DEBUG.Println(CLI, "storing publish message (reconnecting), topic:", topic)
+		c.logs.DEBUG.Println(CLI, "storing publish message (reconnecting), topic:", topic)
 		token.setError(ErrConnStatusReconnecting)
 	default:
-		DEBUG.Println(CLI, "sending publish message, topic:", topic)
-		publishWaitTimeout := c.options.WriteTimeout
-		if publishWaitTimeout == 0 {
-			publishWaitTimeout = time.Second * 30
+		c.logs.DEBUG.Println(CLI, "sending publish message, topic:", topic)
+		pt := &PacketAndToken{p: pub, t: token}
+		if c.coalescer != nil && c.coalescer.applies(topic, pub.Qos) {
+			if !c.coalescer.add(pt) {
+				return token // replaced a publish that is already queued
+			}
+			select {
+			case c.obound <- pt:
+			case <-time.After(publishWaitTimeout):
+				c.coalescer.abandon(pt).setError(ErrPublishTimeout)
+			}
+			return token
 		}
 		select {
-		case c.obound <- &PacketAndToken{p: pub, t: token}:
+		case c.obound <- pt:
 		case <-time.After(publishWaitTimeout):
 			token.setError(ErrPublishTimeout)
 		}
@@ -669,21 +1325,84 @@ func (c *client) Publish(topic string, qos byte, retained bool, payload interfac
 	return token
 }
 
+// tryPublish is the non-blocking equivalent of publish; returns false (with the error set on the
+// token) if the message could not be queued immediately, in which case nothing is retained
+func (c *client) tryPublish(topic string, pub *packets.PublishPacket, token *PublishToken) bool {
+	token.topic = topic
+	if c.connectionStatus() != connected {
+		token.setError(ErrNotConnected)
+		return false
+	}
+	if pub.Qos != 0 {
+		if c.publishInflight != nil {
+			select {
+			case c.publishInflight <- struct{}{}:
+				token.onDone = func() { <-c.publishInflight }
+			default:
+				token.setError(ErrPublishQueueFull)
+				return false
+			}
+		}
+		mID := c.getID(token)
+		if mID == 0 {
+			token.setError(ErrPublishNoMsgIDAvailable)
+			return false
+		}
+		pub.MessageID = mID
+		token.messageID = mID
+	}
+	persistOutbound(c.persist, pub)
+	pt := &PacketAndToken{p: pub, t: token}
+	coalesce := c.coalescer != nil && c.coalescer.applies(topic, pub.Qos)
+	if coalesce && !c.coalescer.add(pt) {
+		return true // replaced a publish that is already queued
+	}
+	select {
+	case c.obound <- pt:
+		c.logs.DEBUG.Println(CLI, "sending publish message, topic:", topic)
+		return true
+	default:
+	}
+	c.logs.DEBUG.Println(CLI, "publish queue full, topic:", topic)
+	if pub.Qos != 0 {
+		c.persist.Del(outboundKeyFromMID(pub.MessageID))
+		c.messageIds.releaseID(pub.MessageID, token)
+	}
+	if coalesce {
+		c.coalescer.abandon(pt).setError(ErrPublishQueueFull)
+	} else {
+		token.setError(ErrPublishQueueFull)
+	}
+	return false
+}
+
 // Subscribe starts a new subscription. Provide a MessageHandler to be executed when
 // a message is published on the topic provided.
 //
+// The route for callback is installed before the SUBSCRIBE packet is sent, so it is always in
+// place by the time the token completes; messages the broker delivers on the new subscription
+// ahead of (or alongside) the SUBACK are never dropped for lack of a route.
+//
 // Please note: you should try to keep the execution time of the callback to be
 // as low as possible, especially when SetOrderMatters(true) (the default) is in
 // place. Blocking calls in message handlers might otherwise delay delivery to
 // other message handlers.
 func (c *client) Subscribe(topic string, qos byte, callback MessageHandler) Token {
 	token := newToken(packets.Subscribe).(*SubscribeToken)
-	DEBUG.Println(CLI, "enter Subscribe")
-	if !c.IsConnected() {
-		token.setError(ErrNotConnected)
+	c.logs.DEBUG.Println(CLI, "enter Subscribe")
+	if err := validateTopicAndQos(topic, qos); err != nil {
+		token.setError(err)
 		return token
 	}
-	if !c.IsConnectionOpen() {
+	deferred := false
+	if !c.isConnectedOrPending() {
+		if !c.options.DeferredSubscribe {
+			token.setError(ErrNotConnected)
+			return token
+		}
+		deferred = true // will be sent when the connection comes up
+	}
+	if !deferred && !c.IsConnectionOpen() {
 		switch {
 		case !c.options.ResumeSubs:
 			// if not connected and resumesubs not set this sub will be thrown away
@@ -696,26 +1415,26 @@ func (c *client) Subscribe(topic string, qos byte, callback MessageHandler) Toke
 		}
 	}
 	sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
-	if err := validateTopicAndQos(topic, qos); err != nil {
-		token.setError(err)
-		return token
-	}
+	topic = c.prefixTopic(topic)
 	sub.Topics = append(sub.Topics, topic)
 	sub.Qoss = append(sub.Qoss, qos)
 
-	if strings.HasPrefix(topic, "$share/") {
-		topic = strings.Join(strings.Split(topic, "/")[2:], "/")
-	}
-
-	if strings.HasPrefix(topic, "$queue/") {
-		topic = strings.TrimPrefix(topic, "$queue/")
-	}
+	topic = routeTopic(topic)
 
+	// The route must be in place before the SUBSCRIBE is sent; the broker may start delivering
+	// on the new subscription before the SUBACK has been processed.
 	if callback != nil {
 		c.msgRouter.addRoute(topic, callback)
 	}
 
 	token.subs = append(token.subs, topic)
+	token.qoss = append(token.qoss, qos)
+	c.trackSubscriptions(sub)
+
+	if deferred && c.deferSubscribe(sub, token) {
+		c.logs.DEBUG.Println(CLI, "deferring subscribe message until connected, topic:", topic)
+		return token
+	}
 
 	if sub.MessageID == 0 {
 		mID := c.getID(token)
@@ -726,16 +1445,16 @@ func (c *client) Subscribe(topic string, qos byte, callback MessageHandler) Toke
 		sub.MessageID = mID
 		token.messageID = mID
 	}
-	DEBUG.Println(CLI, sub.String())
+	c.logs.DEBUG.Println(CLI, sub.String())
 
 	persistOutbound(c.persist, sub)
 	switch c.connectionStatus() {
 	case connecting:
-		DEBUG.Println(CLI, "storing subscribe message (connecting), topic:", topic)
+		c.logs.DEBUG.Println(CLI, "storing subscribe message (connecting), topic:", topic)
 	case reconnecting:
-		DEBUG.Println(CLI, "storing subscribe message (reconnecting), topic:", topic)
+		c.logs.DEBUG.Println(CLI, "storing subscribe message (reconnecting), topic:", topic)
 	default:
-		DEBUG.Println(CLI, "sending subscribe message, topic:", topic)
+		c.logs.DEBUG.Println(CLI, "sending subscribe message, topic:", topic)
 		subscribeWaitTimeout := c.options.WriteTimeout
 		if subscribeWaitTimeout == 0 {
 			subscribeWaitTimeout = time.Second * 30
@@ -746,21 +1465,145 @@ func (c *client) Subscribe(topic string, qos byte, callback MessageHandler) Toke
 			token.setError(errors.New("subscribe was broken by timeout"))
 		}
 	}
-	DEBUG.Println(CLI, "exit Subscribe")
+	c.logs.DEBUG.Println(CLI, "exit Subscribe")
 	return token
 }
 
+// Subscription is returned by SubscribeFunc. It is a Token that completes when the
+// subscription has been acknowledged by the broker (exactly as for Subscribe) and
+// provides an Unsubscribe method so the subscription can be removed without needing
+// to keep track of the topic.
+type Subscription struct {
+	Token
+	client *client
+	topic  string
+}
+
+// Unsubscribe ends the subscription (sending an UNSUBSCRIBE and removing the route);
+// the returned token completes when the broker acknowledges this.
+func (s *Subscription) Unsubscribe() Token {
+	return s.client.Unsubscribe(s.topic)
+}
+
+// SubscribeFunc starts a new subscription (as per Subscribe) returning a Subscription that
+// can be used to wait for the subscription to complete and, later, to unsubscribe:
+//   sub := c.SubscribeFunc("a/b", 1, handler)
+//   if sub.Wait() && sub.Error() != nil { ... }
+//   defer sub.Unsubscribe()
+func (c *client) SubscribeFunc(topic string, qos byte, callback MessageHandler) *Subscription {
+	return &Subscription{Token: c.Subscribe(topic, qos, callback), client: c, topic: topic}
+}
+
+// SubscribeWithRetry starts a new subscription (as per Subscribe) that is retried, waiting between
+// attempts as specified by policy, if the subscribe fails (the token has an error or the broker
+// rejects the subscription). The returned token completes when the subscription succeeds or, with
+// the error from the last attempt, when the policy is exhausted or the client has been disconnected.
+// The wait between attempts is cut short if the connection is lost or Disconnect is called.
+func (c *client) SubscribeWithRetry(topic string, qos byte, callback MessageHandler, policy RetryPolicy) Token {
+	token := newToken(packets.Subscribe).(*SubscribeToken)
+	token.subs = []string{topic}
+	token.qoss = []byte{qos}
+	go func() {
+		delay := policy.initial()
+		for attempt := 1; ; attempt++ {
+			t := c.Subscribe(topic, qos, callback)
+			t.Wait()
+			err := t.Error()
+			if st, ok := t.(*SubscribeToken); ok && err == nil {
+				for filter, rc := range st.Result() {
+					if rc == 0x80 {
+						err = fmt.Errorf("subscription to %q rejected by broker", filter)
+					}
+					token.m.Lock()
+					token.subResult[filter] = rc
+					token.m.Unlock()
+				}
+			}
+			if err == nil {
+				token.flowComplete()
+				return
+			}
+			if policy.exhausted(attempt) || c.connectionStatus() == disconnected {
+				token.setError(err)
+				return
+			}
+			c.logs.WARN.Println(CLI, "subscribe to", topic, "failed, retrying in", delay, ":", err)
+			c.reportError(fmt.Errorf("subscribe to %s failed (will retry): %w", topic, err))
+			c.connMu.Lock()
+			var stop chan struct{} // only set while connected so a stale (closed) channel is not used
+			if c.conn != nil {
+				stop = c.stop
+			}
+			c.connMu.Unlock()
+			select {
+			case <-time.After(delay):
+				delay = policy.next(delay)
+			case <-stop:
+				// Connection lost or Disconnect called; the status is checked after the next attempt
+			}
+		}
+	}()
+	return token
+}
+
+// PayloadValidator is implemented by types that can validate the payload of a message (e.g. against
+// a JSON schema); this allows any validation library to be used with SubscribeWithSchema.
+type PayloadValidator interface {
+	Validate(payload []byte) error
+}
+
+// SubscribeWithSchema starts a new subscription (as per Subscribe) where the payload of each message
+// received is validated by schema before callback is called. Messages that fail validation are passed
+// to the InvalidMessageHandler (if one is set) rather than callback; they are acknowledged either way.
+func (c *client) SubscribeWithSchema(topic string, qos byte, schema PayloadValidator, callback MessageHandler) Token {
+	if schema == nil || callback == nil {
+		return c.Subscribe(topic, qos, callback)
+	}
+	return c.Subscribe(topic, qos, validatingHandler(schema, callback, c.options.InvalidMessageHandler))
+}
+
+// validatingHandler returns a MessageHandler that only passes messages whose payload is accepted by
+// schema to callback (others are passed to invalid, if it is not nil)
+func validatingHandler(schema PayloadValidator, callback MessageHandler, invalid InvalidMessageHandler) MessageHandler {
+	return func(c Client, msg Message) {
+		if err := schema.Validate(msg.Payload()); err != nil {
+			cc, _ := c.(*client)
+			clientLoggers(cc).DEBUG.Println(CLI, "message on", msg.Topic(), "failed validation:", err)
+			if invalid != nil {
+				invalid(c, msg, err)
+			}
+			return
+		}
+		callback(c, msg)
+	}
+}
+
 // SubscribeMultiple starts a new subscription for multiple topics. Provide a MessageHandler to
 // be executed when a message is published on one of the topics provided.
+// As with Subscribe, routes are installed before the SUBSCRIBE packet is sent.
+// The broker may reject some of the filters (e.g. due to ACLs) while granting others; this does
+// not cause the token to fail, check SubscribeToken.Result() for the outcome of each filter.
 func (c *client) SubscribeMultiple(filters map[string]byte, callback MessageHandler) Token {
+	if n := c.options.MaxSubscribeBatch; n > 0 && len(filters) > n {
+		return c.subscribeBatches(filters, callback, n)
+	}
 	var err error
 	token := newToken(packets.Subscribe).(*SubscribeToken)
-	DEBUG.Println(CLI, "enter SubscribeMultiple")
-	if !c.IsConnected() {
-		token.setError(ErrNotConnected)
+	c.logs.DEBUG.Println(CLI, "enter SubscribeMultiple")
+	sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	if sub.Topics, sub.Qoss, err = validateSubscribeMap(filters); err != nil {
+		token.setError(err)
 		return token
 	}
-	if !c.IsConnectionOpen() {
+	deferred := false
+	if !c.isConnectedOrPending() {
+		if !c.options.DeferredSubscribe {
+			token.setError(ErrNotConnected)
+			return token
+		}
+		deferred = true // will be sent when the connection comes up
+	}
+	if !deferred && !c.IsConnectionOpen() {
 		switch {
 		case !c.options.ResumeSubs:
 			// if not connected and resumesubs not set this sub will be thrown away
@@ -772,19 +1615,26 @@ func (c *client) SubscribeMultiple(filters map[string]byte, callback MessageHand
 			return token
 		}
 	}
-	sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
-	if sub.Topics, sub.Qoss, err = validateSubscribeMap(filters); err != nil {
-		token.setError(err)
-		return token
+	for i := range sub.Topics {
+		sub.Topics[i] = c.prefixTopic(sub.Topics[i])
 	}
 
+	// Install routes before sending (see Subscribe)
 	if callback != nil {
-		for topic := range filters {
+		for _, topic := range sub.Topics {
 			c.msgRouter.addRoute(topic, callback)
 		}
 	}
 	token.subs = make([]string, len(sub.Topics))
 	copy(token.subs, sub.Topics)
+	token.qoss = make([]byte, len(sub.Qoss))
+	copy(token.qoss, sub.Qoss)
+	c.trackSubscriptions(sub)
+
+	if deferred && c.deferSubscribe(sub, token) {
+		c.logs.DEBUG.Println(CLI, "deferring subscribe message until connected, topics:", sub.Topics)
+		return token
+	}
 
 	if sub.MessageID == 0 {
 		mID := c.getID(token)
@@ -798,11 +1648,11 @@ func (c *client) SubscribeMultiple(filters map[string]byte, callback MessageHand
 	persistOutbound(c.persist, sub)
 	switch c.connectionStatus() {
 	case connecting:
-		DEBUG.Println(CLI, "storing subscribe message (connecting), topics:", sub.Topics)
+		c.logs.DEBUG.Println(CLI, "storing subscribe message (connecting), topics:", sub.Topics)
 	case reconnecting:
-		DEBUG.Println(CLI, "storing subscribe message (reconnecting), topics:", sub.Topics)
+		c.logs.DEBUG.Println(CLI, "storing subscribe message (reconnecting), topics:", sub.Topics)
 	default:
-		DEBUG.Println(CLI, "sending subscribe message, topics:", sub.Topics)
+		c.logs.DEBUG.Println(CLI, "sending subscribe message, topics:", sub.Topics)
 		subscribeWaitTimeout := c.options.WriteTimeout
 		if subscribeWaitTimeout == 0 {
 			subscribeWaitTimeout = time.Second * 30
@@ -813,10 +1663,230 @@ func (c *client) SubscribeMultiple(filters map[string]byte, callback MessageHand
 			token.setError(errors.New("subscribe was broken by timeout"))
 		}
 	}
-	DEBUG.Println(CLI, "exit SubscribeMultiple")
+	c.logs.DEBUG.Println(CLI, "exit SubscribeMultiple")
+	return token
+}
+
+// subscribeBatches splits filters into SUBSCRIBE packets of at most n filters each (see
+// SetMaxSubscribeBatch). The returned token aggregates the per-packet tokens; it completes when all
+// of them have, with the first error encountered (if any) and the granted QoS of every filter
+func (c *client) subscribeBatches(filters map[string]byte, callback MessageHandler, n int) Token {
+	token := newToken(packets.Subscribe).(*SubscribeToken)
+	topics, _, err := validateSubscribeMap(filters)
+	if err != nil { // validate everything up front so that no batch is sent if any filter is invalid
+		token.setError(err)
+		return token
+	}
+	sort.Strings(topics)
+	c.logs.DEBUG.Println(CLI, "splitting subscribe of", len(topics), "topics into batches of", n)
+
+	var batches []*SubscribeToken
+	for start := 0; start < len(topics); start += n {
+		end := start + n
+		if end > len(topics) {
+			end = len(topics)
+		}
+		batch := make(map[string]byte, end-start)
+		for _, topic := range topics[start:end] {
+			batch[topic] = filters[topic]
+		}
+		t := c.SubscribeMultiple(batch, callback).(*SubscribeToken)
+		token.subs = append(token.subs, t.subs...)
+		token.qoss = append(token.qoss, t.qoss...)
+		batches = append(batches, t)
+	}
+
+	go func() {
+		var err error
+		for _, t := range batches {
+			t.Wait()
+			if tErr := t.Error(); tErr != nil && err == nil {
+				err = tErr
+			}
+			token.m.Lock()
+			for topic, qos := range t.Result() {
+				token.subResult[topic] = qos
+			}
+			token.m.Unlock()
+		}
+		if err != nil {
+			token.setError(err)
+			return
+		}
+		token.flowComplete()
+	}()
 	return token
 }
 
+// deferSubscribe queues a subscribe request made while disconnected so that it can be sent once the
+// connection is up (see flushDeferredSubscribes). Returns false, without queueing anything, if the
+// connection came up in the meantime (in which case the request should be sent immediately)
+func (c *client) deferSubscribe(sub *packets.SubscribePacket, token *SubscribeToken) bool {
+	c.deferredSubsMu.Lock()
+	defer c.deferredSubsMu.Unlock()
+	if c.connectionStatus() == connected {
+		return false
+	}
+	c.deferredSubs = append(c.deferredSubs, &PacketAndToken{p: sub, t: token})
+	return true
+}
+
+// failDeferredSubscribes completes the tokens of any subscribe requests queued by deferSubscribe
+// with err (called when the connection will not come up, i.e. Connect fails or Disconnect is called)
+func (c *client) failDeferredSubscribes(err error) {
+	c.deferredSubsMu.Lock()
+	deferred := c.deferredSubs
+	c.deferredSubs = nil
+	c.deferredSubsMu.Unlock()
+
+	for _, pt := range deferred {
+		pt.t.setError(err)
+	}
+}
+
+// flushDeferredSubscribes sends any subscribe requests queued by deferSubscribe; the tokens will
+// complete when the matching SUBACK is received
+// Note: c.oboundP must be serviced while this runs (so it should only be called once the comms are up)
+func (c *client) flushDeferredSubscribes() {
+	c.deferredSubsMu.Lock()
+	deferred := c.deferredSubs
+	c.deferredSubs = nil
+	c.deferredSubsMu.Unlock()
+
+	for _, pt := range deferred {
+		sub := pt.p.(*packets.SubscribePacket)
+		token := pt.t.(*SubscribeToken)
+		mID := c.getID(token)
+		if mID == 0 {
+			token.setError(fmt.Errorf("no message IDs available"))
+			continue
+		}
+		sub.MessageID = mID
+		token.messageID = mID
+		persistOutbound(c.persist, sub)
+		c.logs.DEBUG.Println(CLI, "sending deferred subscribe message, topics:", sub.Topics)
+		c.oboundP <- pt
+	}
+}
+
+// trackSubscriptions records the filters in sub so that they can be resent by resubscribe
+func (c *client) trackSubscriptions(sub *packets.SubscribePacket) {
+	c.subscriptionsMu.Lock()
+	defer c.subscriptionsMu.Unlock()
+	for i, topic := range sub.Topics {
+		c.subscriptions[topic] = sub.Qoss[i]
+	}
+	c.persistSubscriptions()
+}
+
+// untrackSubscriptions removes the filters from those that will be resent by resubscribe
+func (c *client) untrackSubscriptions(topics []string) {
+	c.subscriptionsMu.Lock()
+	defer c.subscriptionsMu.Unlock()
+	for _, topic := range topics {
+		delete(c.subscriptions, topic)
+	}
+	c.persistSubscriptions()
+}
+
+// subscriptionsKey is the store key under which the active subscriptions are persisted (see
+// SetPersistSubscriptions); stores require keys of the form "X.[id]"
+const subscriptionsKey = "s.0"
+
+// persistSubscriptions writes the active subscriptions to the store (as a SUBSCRIBE packet) if
+// PersistSubscriptions is set. Note: c.subscriptionsMu must be held
+func (c *client) persistSubscriptions() {
+	if !c.options.PersistSubscriptions || c.options.CleanSession {
+		return
+	}
+	if len(c.subscriptions) == 0 {
+		c.persist.Del(subscriptionsKey)
+		return
+	}
+	sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	for topic := range c.subscriptions {
+		sub.Topics = append(sub.Topics, topic)
+	}
+	sort.Strings(sub.Topics)
+	for _, topic := range sub.Topics {
+		sub.Qoss = append(sub.Qoss, c.subscriptions[topic])
+	}
+	c.persist.Put(subscriptionsKey, sub)
+}
+
+// loadPersistedSubscriptions restores the subscriptions written to the store by a previous run (so
+// that they will be resent if the broker has lost the session) and then persists the combined set
+// (subscriptions made before the store was opened will not have been written); the store must be open
+func (c *client) loadPersistedSubscriptions() {
+	if !c.options.PersistSubscriptions || c.options.CleanSession {
+		return
+	}
+	var sub *packets.SubscribePacket
+	for _, key := range c.persist.All() { // avoid Get logging an error if nothing has been persisted
+		if key == subscriptionsKey {
+			sub, _ = c.persist.Get(key).(*packets.SubscribePacket)
+			break
+		}
+	}
+	c.subscriptionsMu.Lock()
+	defer c.subscriptionsMu.Unlock()
+	if sub != nil {
+		for i, topic := range sub.Topics {
+			if _, ok := c.subscriptions[topic]; !ok {
+				c.subscriptions[topic] = sub.Qoss[i]
+			}
+		}
+		c.logs.DEBUG.Println(CLI, "loaded persisted subscriptions:", sub.Topics)
+	}
+	if len(c.subscriptions) > 0 {
+		c.persistSubscriptions()
+	}
+}
+
+// warnOverlappingSubscriptions logs any active subscriptions that overlap the filters that have been
+// unsubscribed from (messages matching these will continue to be delivered)
+func (c *client) warnOverlappingSubscriptions(unsubscribed []string) {
+	c.subscriptionsMu.Lock()
+	defer c.subscriptionsMu.Unlock()
+	for _, filter := range unsubscribed {
+		for active := range c.subscriptions {
+			if filtersOverlap(filter, active) {
+				c.logs.WARN.Println(CLI, "unsubscribed from", filter, "but overlapping subscription", active, "remains active")
+			}
+		}
+	}
+}
+
+// resubscribe sends a SUBSCRIBE containing all tracked subscriptions; this is used when the broker
+// reports that it has no session for us (so the subscriptions made previously have been lost)
+// Note: c.oboundP must be serviced while this runs (so it should only be called once the comms are up)
+func (c *client) resubscribe() {
+	sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	c.subscriptionsMu.Lock()
+	for topic, qos := range c.subscriptions {
+		sub.Topics = append(sub.Topics, topic)
+		sub.Qoss = append(sub.Qoss, qos)
+	}
+	c.subscriptionsMu.Unlock()
+	if len(sub.Topics) == 0 {
+		return
+	}
+	token := newToken(packets.Subscribe).(*SubscribeToken)
+	token.subs = append(token.subs, sub.Topics...)
+	token.qoss = append(token.qoss, sub.Qoss...)
+	mID := c.getID(token)
+	if mID == 0 {
+		c.logs.ERROR.Println(CLI, "no message IDs available to resubscribe, topics:", sub.Topics)
+		c.reportError(fmt.Errorf("resubscribe to %v: %w", sub.Topics, ErrPublishNoMsgIDAvailable))
+		return
+	}
+	sub.MessageID = mID
+	token.messageID = mID
+	persistOutbound(c.persist, sub)
+	c.logs.DEBUG.Println(CLI, "session not present, resubscribing to topics:", sub.Topics)
+	c.oboundP <- &PacketAndToken{p: sub, t: token}
+}
+
 // reserveStoredPublishIDs reserves the ids for publish packets in the persistent store to ensure these are not duplicated
 func (c *client) reserveStoredPublishIDs() {
 	// The resume function sets the stored id for publish packets only (some other packets
@@ -854,7 +1924,7 @@ func (c *client) resume(subscription bool, ibound chan packets.ControlPacket) {
 			switch packet.(type) {
 			case *packets.SubscribePacket:
 				if subscription {
-					DEBUG.Println(STR, fmt.Sprintf("loaded pending subscribe (%d)", details.MessageID))
+					c.logs.DEBUG.Println(STR, fmt.Sprintf("loaded pending subscribe (%d)", details.MessageID))
 					subPacket := packet.(*packets.SubscribePacket)
 					token := newToken(packets.Subscribe).(*SubscribeToken)
 					token.messageID = details.MessageID
@@ -864,31 +1934,34 @@ func (c *client) resume(subscription bool, ibound chan packets.ControlPacket) {
 				}
 			case *packets.UnsubscribePacket:
 				if subscription {
-					DEBUG.Println(STR, fmt.Sprintf("loaded pending unsubscribe (%d)", details.MessageID))
+					c.logs.DEBUG.Println(STR, fmt.Sprintf("loaded pending unsubscribe (%d)", details.MessageID))
 					token := newToken(packets.Unsubscribe).(*UnsubscribeToken)
 					c.oboundP <- &PacketAndToken{p: packet, t: token}
 				}
 			case *packets.PubrelPacket:
-				DEBUG.Println(STR, fmt.Sprintf("loaded pending pubrel (%d)", details.MessageID))
+				c.logs.DEBUG.Println(STR, fmt.Sprintf("loaded pending pubrel (%d)", details.MessageID))
 				c.oboundP <- &PacketAndToken{p: packet, t: nil}
 			case *packets.PublishPacket:
 				token := newToken(packets.Publish).(*PublishToken)
 				token.messageID = details.MessageID
+				token.topic = strings.TrimPrefix(packet.(*packets.PublishPacket).TopicName, c.options.TopicPrefix)
 				c.claimID(token, details.MessageID)
-				DEBUG.Println(STR, fmt.Sprintf("loaded pending publish (%d)", details.MessageID))
-				DEBUG.Println(STR, details)
+				c.logs.DEBUG.Println(STR, fmt.Sprintf("loaded pending publish (%d)", details.MessageID))
+				c.logs.DEBUG.Println(STR, details)
 				c.obound <- &PacketAndToken{p: packet, t: token}
 			default:
-				ERROR.Println(STR, "invalid message type in store (discarded)")
+				c.logs.ERROR.Println(STR, "invalid message type in store (discarded)")
+				c.reportError(fmt.Errorf("invalid message type in store, key %s (discarded)", key))
 				c.persist.Del(key)
 			}
 		} else if isKeyInbound(key) {
 			switch packet.(type) {
 			case *packets.PubrelPacket:
-				DEBUG.Println(STR, fmt.Sprintf("loaded pending incomming (%d)", details.MessageID))
+				c.logs.DEBUG.Println(STR, fmt.Sprintf("loaded pending incomming (%d)", details.MessageID))
 				ibound <- packet
 			default:
-				ERROR.Println(STR, "invalid message type in store (discarded)")
+				c.logs.ERROR.Println(STR, "invalid message type in store (discarded)")
+				c.reportError(fmt.Errorf("invalid message type in store, key %s (discarded)", key))
 				c.persist.Del(key)
 			}
 		}
@@ -898,10 +1971,12 @@ func (c *client) resume(subscription bool, ibound chan packets.ControlPacket) {
 // Unsubscribe will end the subscription from each of the topics provided.
 // Messages published to those topics from other clients will no longer be
 // received.
+// Only routes whose filter exactly matches one of the topics are removed; messages
+// matching other (overlapping) active subscriptions will still be delivered (a warning is logged).
 func (c *client) Unsubscribe(topics ...string) Token {
 	token := newToken(packets.Unsubscribe).(*UnsubscribeToken)
-	DEBUG.Println(CLI, "enter Unsubscribe")
-	if !c.IsConnected() {
+	c.logs.DEBUG.Println(CLI, "enter Unsubscribe")
+	if !c.isConnectedOrPending() {
 		token.setError(ErrNotConnected)
 		return token
 	}
@@ -919,7 +1994,10 @@ func (c *client) Unsubscribe(topics ...string) Token {
 	}
 	unsub := packets.NewControlPacket(packets.Unsubscribe).(*packets.UnsubscribePacket)
 	unsub.Topics = make([]string, len(topics))
-	copy(unsub.Topics, topics)
+	for i, topic := range topics {
+		unsub.Topics[i] = c.prefixTopic(topic)
+	}
+	token.topics = topics
 
 	if unsub.MessageID == 0 {
 		mID := c.getID(token)
@@ -935,26 +2013,37 @@ func (c *client) Unsubscribe(topics ...string) Token {
 
 	switch c.connectionStatus() {
 	case connecting:
-		DEBUG.Println(CLI, "storing unsubscribe message (connecting), topics:", topics)
+		c.logs.DEBUG.Println(CLI, "storing unsubscribe message (connecting), topics:", topics)
 	case reconnecting:
-		DEBUG.Println(CLI, "storing unsubscribe message (reconnecting), topics:", topics)
+		c.logs.DEBUG.Println(CLI, "storing unsubscribe message (reconnecting), topics:", topics)
 	default:
-		DEBUG.Println(CLI, "sending unsubscribe message, topics:", topics)
+		c.logs.DEBUG.Println(CLI, "sending unsubscribe message, topics:", topics)
 		subscribeWaitTimeout := c.options.WriteTimeout
 		if subscribeWaitTimeout == 0 {
 			subscribeWaitTimeout = time.Second * 30
 		}
 		select {
 		case c.oboundP <- &PacketAndToken{p: unsub, t: token}:
-			for _, topic := range topics {
-				c.msgRouter.deleteRoute(topic)
+			c.untrackSubscriptions(unsub.Topics)
+			// Only the routes for exactly these filters are removed; routes for other filters are untouched
+			for i, topic := range topics {
+				c.stopSubscriptionWorkers(routeTopic(topic))
+				c.msgRouter.deleteRoute(unsub.Topics[i])
+				if rt := routeTopic(unsub.Topics[i]); rt != unsub.Topics[i] {
+					c.msgRouter.deleteRoute(rt) // Subscribe adds routes for shared subscriptions without the prefix
+				}
+				if c.subStats != nil {
+					c.subStats.remove(unsub.Topics[i])
+					c.subStats.remove(routeTopic(unsub.Topics[i]))
+				}
 			}
+			c.warnOverlappingSubscriptions(unsub.Topics)
 		case <-time.After(subscribeWaitTimeout):
 			token.setError(errors.New("unsubscribe was broken by timeout"))
 		}
 	}
 
-	DEBUG.Println(CLI, "exit Unsubscribe")
+	c.logs.DEBUG.Println(CLI, "exit Unsubscribe")
 	return token
 }
 
@@ -965,6 +2054,193 @@ func (c *client) OptionsReader() ClientOptionsReader {
 	return r
 }
 
+// StoreStats returns details of the messages held in the persistence store. Sizes are only tracked
+// when SetMaxStoreBytes is in use; otherwise the messages in the store are read to calculate them.
+func (c *client) StoreStats() StoreStats {
+	return c.storeAccounting.stats()
+}
+
+// MigrateStore moves the messages held in the persistence store (e.g. a MemoryStore) to s (e.g. a
+// FileStore) and then uses s in its place, without losing inflight messages; the previous store is
+// reset and closed. Publishing, acknowledging and anything else that uses the store is paused until
+// the messages have been copied (so the pause is proportional to the number of messages held). If
+// the client is not connected s simply replaces the store (and will be opened by Connect). An error
+// is returned, and the previous store remains in use, if not all of the messages could be copied.
+func (c *client) MigrateStore(s Store) error {
+	if err := c.storeAccounting.migrate(s); err != nil {
+		return err
+	}
+	c.optionsMu.Lock()
+	c.options.Store = s
+	c.optionsMu.Unlock()
+	return nil
+}
+
+// PendingInbound returns the inbound messages held in the persistence store that have not yet been
+// acknowledged (e.g. those received in a previous run when AutoAckDisabled is set) so that they can be
+// inspected. Calling Ack() on the returned messages does nothing; they remain unacknowledged, and in the
+// store, until handled through the normal delivery process.
+func (c *client) PendingInbound() []Message {
+	var msgs []Message
+	for _, key := range c.persist.All() {
+		if !isKeyInbound(key) && !strings.HasPrefix(key, pubPrefix) {
+			continue
+		}
+		if pub, ok := c.persist.Get(key).(*packets.PublishPacket); ok {
+			msgs = append(msgs, messageFromPublish(pub, func() {}))
+		}
+	}
+	return msgs
+}
+
+// SubscriptionStats returns statistics for the messages delivered to the route with the filter
+// provided. The zero value is returned if no messages have been received or SetSubscriptionStats(true)
+// was not used.
+func (c *client) SubscriptionStats(filter string) SubStat {
+	if c.subStats == nil {
+		return SubStat{}
+	}
+	return c.subStats.get(filter)
+}
+
+// ActiveHandlerGoroutines returns the number of goroutines currently running message handlers. When
+// SetOrderMatters(false) is in place each handler matching a message is called in its own goroutine so
+// slow handlers can cause these to accumulate; with ordered delivery this is always 0. SetReceiveMaximum
+// caps the number of messages being handled (and so, with a single matching route, this count).
+func (c *client) ActiveHandlerGoroutines() int {
+	return c.msgRouter.activeHandlers()
+}
+
+// StopDispatch stops messages being passed to handlers (handlers already running are not affected)
+// whilst keeping the connection, and so the session and subscriptions, alive. Packets continue to be
+// read; received messages are held in memory, unacknowledged, until StartDispatch is called. As QoS 1
+// and 2 messages are not acknowledged the broker will stop sending them once its inflight window for
+// the client is full, whereas QoS 0 messages continue to be received (and held) so, if stopped for a
+// long time, memory use may grow. If the connection is lost the held messages are discarded; QoS 1/2
+// messages will be redelivered by the broker if the session is resumed, QoS 0 messages are lost.
+func (c *client) StopDispatch() {
+	c.logs.DEBUG.Println(CLI, "stopping dispatch")
+	c.msgRouter.gate.stop()
+}
+
+// StartDispatch passes any messages held since StopDispatch was called to the handlers, in the order
+// they were received (returning once this is done), and then resumes normal dispatch.
+func (c *client) StartDispatch() {
+	c.logs.DEBUG.Println(CLI, "starting dispatch")
+	c.msgRouter.gate.start()
+}
+
+// PendingAcks returns the number of messages passed to handlers that have not yet been
+// acknowledged (only relevant if AutoAckDisabled is set)
+func (c *client) PendingAcks() int {
+	return int(atomic.LoadInt64(&c.pendingAcks))
+}
+
+// PressureLevel returns a value from 0 (idle) to 100 (saturated) that producers can use to slow down
+// before publishes start to block. It is the highest percentage utilisation of:
+//   - inflight QoS 1/2 publishes, relative to MaxInflight (ignored if not set);
+//   - the memory used by the store, relative to MaxStoreBytes (ignored if not set);
+//   - message IDs in use, relative to the 65535 available.
+//
+// The highest value is used (rather than an average) as whichever resource is exhausted first is
+// the one that will block the client.
+func (c *client) PressureLevel() int {
+	level := c.messageIds.inUse() * 100 / int(midMax)
+	if c.publishInflight != nil {
+		if l := len(c.publishInflight) * 100 / cap(c.publishInflight); l > level {
+			level = l
+		}
+	}
+	if l := c.storeAccounting.utilisation(); l > level {
+		level = l
+	}
+	if level > 100 {
+		level = 100
+	}
+	return level
+}
+
+// LocalAddr returns the local network address of the active connection (nil if
+// not connected)
+func (c *client) LocalAddr() net.Addr {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.LocalAddr()
+}
+
+// ConnectedBroker returns (a copy of) the URL of the broker that the client is currently
+// connected to; nil if not connected or the connection was provided with SetExistingConn
+func (c *client) ConnectedBroker() *url.URL {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if c.conn == nil || c.broker == nil {
+		return nil
+	}
+	u := *c.broker
+	return &u
+}
+
+// RemoteAddr returns the remote network address of the active connection (nil if
+// not connected)
+func (c *client) RemoteAddr() net.Addr {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.RemoteAddr()
+}
+
+// LastConnectedAt returns when the client last moved to the connected state, i.e. when the
+// connection was last established (the zero time if it never has been)
+func (c *client) LastConnectedAt() time.Time {
+	t, _ := c.lastConnectedAt.Load().(time.Time)
+	return t
+}
+
+// LastDisconnectedAt returns when the client last moved out of the connected state, i.e. when the
+// connection was last lost or closed by Disconnect (the zero time if this has not happened)
+func (c *client) LastDisconnectedAt() time.Time {
+	t, _ := c.lastDisconnectedAt.Load().(time.Time)
+	return t
+}
+
+// EffectiveKeepAlive returns the keepalive in force on the active connection (0 if not
+// connected or the keepalive is disabled). This is the value sent in the CONNECT packet, which
+// may differ from that requested (it is truncated to whole seconds and limited to 65535 seconds).
+// MQTT 5 brokers can override the keepalive in the CONNACK but this client connects using MQTT
+// 3.1/3.1.1 where the value sent is always the one in force.
+func (c *client) EffectiveKeepAlive() time.Duration {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if c.conn == nil {
+		return 0
+	}
+	return time.Duration(connectKeepAlive(&c.options)) * time.Second
+}
+
+// checkClientID returns a description of any problem with the ClientID in the options (an empty string
+// if there is none). An empty ClientID asks the broker to assign one but, in MQTT 3.1.1, this is only
+// permitted with CleanSession set (the broker must otherwise reject the connection).
+func checkClientID(o *ClientOptions) string {
+	if o.ClientID == "" && !o.CleanSession {
+		return "an empty ClientID requires CleanSession to be true; the broker is likely to reject the connection (identifier rejected)"
+	}
+	return ""
+}
+
+// checkWillProperties returns a description of any problem with the will properties in the options (an
+// empty string if there is none). Will properties are only sent with MQTT 5 so are ignored by this client.
+func checkWillProperties(o *ClientOptions) string {
+	if o.WillEnabled && (o.WillDelayInterval != 0 || o.WillPayloadUTF8 || o.WillContentType != "") {
+		return "will properties (delay interval, payload format and content type) require MQTT 5 and will not be sent"
+	}
+	return ""
+}
+
 //DefaultConnectionLostHandler is a definition of a function that simply
 //reports to the DEBUG log the reason for the client losing a connection.
 func DefaultConnectionLostHandler(client Client, reason error) {
@@ -1003,5 +2279,8 @@ func (c *client) persistInbound(m packets.ControlPacket) {
 
 // pingRespReceived will be called by the network routines when a ping response is received
 func (c *client) pingRespReceived() {
+	if sent, ok := c.pingSentAt.Load().(time.Time); ok && atomic.LoadInt32(&c.pingOutstanding) != 0 {
+		atomic.StoreInt64(&c.lastPingRTT, int64(time.Since(sent)))
+	}
 	atomic.StoreInt32(&c.pingOutstanding, 0)
 }
@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2013 IBM Corp.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ *
+ * Contributors:
+ *    Seth Hoenig
+ *    Allan Stockdill-Mander
+ *    Mike Robertson
+ */
+
+package mqtt
+
+import (
+	"sync"
+
+	"github.com/90poe/paho.mqtt.golang/packets"
+)
+
+// coalescer implements last-value-wins coalescing of QoS 0 publishes to the topics selected with
+// ClientOptions.SetCoalesceTopics. The first publish to a topic is queued as normal; until that
+// is taken from the queue any further publishes to the same topic replace its packet (and the
+// token of the replaced publish is completed) rather than being queued themselves.
+type coalescer struct {
+	sync.Mutex
+	filters []string
+	pending map[string]*PacketAndToken // topic name -> most recent publish
+	logs    *loggers
+}
+
+func newCoalescer(filters []string, logs *loggers) *coalescer {
+	return &coalescer{filters: filters, pending: make(map[string]*PacketAndToken), logs: logs}
+}
+
+// applies returns true if publishes to the topic (as passed to Publish) should be coalesced
+func (co *coalescer) applies(topic string, qos byte) bool {
+	if qos != 0 {
+		return false
+	}
+	for _, f := range co.filters {
+		if routeIncludesTopic(f, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// add records pt as the most recent publish to its topic. Returns true if pt needs to be queued;
+// otherwise it has replaced an already queued publish (whose token is completed).
+func (co *coalescer) add(pt *PacketAndToken) bool {
+	topic := pt.p.(*packets.PublishPacket).TopicName
+	co.Lock()
+	old, ok := co.pending[topic]
+	co.pending[topic] = pt
+	co.Unlock()
+	if !ok {
+		return true
+	}
+	co.logs.DEBUG.Println(CLI, "coalesced publish, topic:", topic)
+	old.t.flowComplete()
+	return false
+}
+
+// take is called when pt is removed from the queue and returns the publish that should be sent
+// in its place (the most recent publish to the topic).
+func (co *coalescer) take(pt *PacketAndToken) *PacketAndToken {
+	pub, ok := pt.p.(*packets.PublishPacket)
+	if !ok || pub.Qos != 0 {
+		return pt
+	}
+	co.Lock()
+	defer co.Unlock()
+	latest, ok := co.pending[pub.TopicName]
+	if !ok {
+		return pt
+	}
+	delete(co.pending, pub.TopicName)
+	return latest
+}
+
+// abandon is called if pt could not be queued and returns the token of the most recent publish to
+// the topic (which will not now be sent).
+func (co *coalescer) abandon(pt *PacketAndToken) tokenCompletor {
+	topic := pt.p.(*packets.PublishPacket).TopicName
+	co.Lock()
+	defer co.Unlock()
+	latest, ok := co.pending[topic]
+	if !ok {
+		return pt.t
+	}
+	delete(co.pending, topic)
+	return latest.t
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright (c) 2013 IBM Corp.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ *
+ * Contributors:
+ *    Seth Hoenig
+ *    Allan Stockdill-Mander
+ *    Mike Robertson
+ */
+
+package mqtt
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// dedupMaxKeys is the maximum number of keys remembered by the inbound deduplication cache (see
+// ClientOptions.SetDedupWindow); when full the oldest key is forgotten
+const dedupMaxKeys = 10000
+
+// dedupCache remembers the keys of recently received messages so that duplicates can be dropped
+type dedupCache struct {
+	sync.Mutex
+	keyFunc MessageKeyFunc
+	window  time.Duration
+	order   *list.List               // *dedupEntry, most recently seen first
+	index   map[string]*list.Element // key -> element in order
+}
+
+type dedupEntry struct {
+	key  string
+	seen time.Time
+}
+
+func newDedupCache(keyFunc MessageKeyFunc, window time.Duration) *dedupCache {
+	return &dedupCache{keyFunc: keyFunc, window: window, order: list.New(), index: make(map[string]*list.Element)}
+}
+
+// duplicate returns true if a message with the same key as m was seen within the window. Otherwise
+// the key is recorded (messages with an empty key are never treated as duplicates)
+func (d *dedupCache) duplicate(m Message) bool {
+	key := d.keyFunc(m)
+	if key == "" {
+		return false
+	}
+	now := time.Now()
+	d.Lock()
+	defer d.Unlock()
+	if e, ok := d.index[key]; ok {
+		entry := e.Value.(*dedupEntry)
+		if now.Sub(entry.seen) <= d.window {
+			return true // the window runs from the first sighting (duplicates do not extend it)
+		}
+		entry.seen = now
+		d.order.MoveToFront(e)
+		return false
+	}
+	// entries are ordered by the time seen so expired entries are at the back
+	for e := d.order.Back(); e != nil && (now.Sub(e.Value.(*dedupEntry).seen) > d.window || d.order.Len() >= dedupMaxKeys); e = d.order.Back() {
+		d.order.Remove(e)
+		delete(d.index, e.Value.(*dedupEntry).key)
+	}
+	d.index[key] = d.order.PushFront(&dedupEntry{key: key, seen: now})
+	return false
+}
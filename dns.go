@@ -0,0 +1,233 @@
+/*
+ * Copyright (c) 2013 IBM Corp.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ *
+ * Contributors:
+ *    Seth Hoenig
+ *    Allan Stockdill-Mander
+ *    Mike Robertson
+ */
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// netDialer holds the options used when dialing a broker directly (i.e. not through a proxy or
+// websocket); a nil *netDialer uses the system resolver without caching.
+type netDialer struct {
+	resolver      *net.Resolver // nil to use the default resolver
+	cache         *dnsCache     // nil if resolved addresses are not cached
+	fallbackDelay time.Duration // as per net.Dialer.FallbackDelay (0 for the default, negative to disable)
+	logs          *loggers      // nil for the package level loggers
+}
+
+// defaultFallbackDelay is the delay before the first connection attempt to the other address family
+// when a host resolves to both IPv4 and IPv6 addresses (the same default as net.Dialer)
+const defaultFallbackDelay = 300 * time.Millisecond
+
+// newNetDialer returns the netDialer for the options (nil if the defaults are to be used)
+func newNetDialer(o *ClientOptions) *netDialer {
+	if o.Resolver == nil && o.DNSCacheTTL <= 0 && o.DialFallbackDelay == 0 {
+		return nil
+	}
+	nd := &netDialer{resolver: o.Resolver, fallbackDelay: o.DialFallbackDelay}
+	if o.DNSCacheTTL > 0 {
+		nd.cache = newDNSCache(o.DNSCacheTTL)
+	}
+	return nd
+}
+
+// isHostNotFound returns true if err is the result of a host name definitively not existing (as opposed to
+// a transient failure to resolve it)
+func isHostNotFound(err error) bool {
+	var de *net.DNSError
+	return errors.As(err, &de) && de.IsNotFound
+}
+
+// dnsCache holds the addresses that host names resolved to for a limited time
+type dnsCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	entries map[string]dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	addrs   []net.IPAddr
+	expires time.Time
+}
+
+func newDNSCache(ttl time.Duration) *dnsCache {
+	return &dnsCache{ttl: ttl, entries: make(map[string]dnsCacheEntry)}
+}
+
+// lookup returns the addresses for host, using the cached result if it has not expired
+func (d *dnsCache) lookup(ctx context.Context, resolver *net.Resolver, host string) ([]net.IPAddr, error) {
+	d.Lock()
+	e, ok := d.entries[host]
+	d.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.addrs, nil
+	}
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	d.Lock()
+	d.entries[host] = dnsCacheEntry{addrs: addrs, expires: time.Now().Add(d.ttl)}
+	d.Unlock()
+	return addrs, nil
+}
+
+// forget removes host from the cache (used when none of the cached addresses could be reached)
+func (d *dnsCache) forget(host string) {
+	d.Lock()
+	defer d.Unlock()
+	delete(d.entries, host)
+}
+
+// dial connects to addr ("host:port") over TCP using the cached addresses for the host. As with
+// net.Dialer, if the host has both IPv4 and IPv6 addresses then connections to each family are
+// attempted concurrently ("Happy Eyeballs", RFC 8305) with the other family being started after
+// the fallback delay (or as soon as the first family fails). timings.DNS is set to the time taken to
+// resolve the host name and timings.Dial to the time taken to connect.
+func (nd *netDialer) dial(addr string, timeout time.Duration, timings *ConnectTimings) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	var ips []net.IPAddr
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IPAddr{{IP: ip}}
+	} else if ips, err = nd.cache.lookup(ctx, nd.resolver, host); err != nil {
+		timings.DNS = time.Since(start)
+		return nil, err
+	}
+	resolved := time.Now()
+	timings.DNS = resolved.Sub(start)
+	defer func() { timings.Dial = time.Since(resolved) }()
+
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no addresses found", Name: host}
+	}
+	conn, err := nd.dialParallel(ctx, ips, port)
+	if err != nil {
+		nd.cache.forget(host) // the addresses may be stale
+	}
+	return conn, err
+}
+
+// partitionAddrs splits the addresses into those of the same family as the first address and the rest
+func partitionAddrs(ips []net.IPAddr) (primaries, fallbacks []net.IPAddr) {
+	isV4 := ips[0].IP.To4() != nil
+	for _, ip := range ips {
+		if (ip.IP.To4() != nil) == isV4 {
+			primaries = append(primaries, ip)
+		} else {
+			fallbacks = append(fallbacks, ip)
+		}
+	}
+	return primaries, fallbacks
+}
+
+// dialSerial attempts to connect to each of the addresses in turn returning the first connection
+// established (or the first error if all attempts fail)
+func (nd *netDialer) dialSerial(ctx context.Context, ips []net.IPAddr, port string) (net.Conn, error) {
+	var (
+		d        net.Dialer
+		firstErr error
+	)
+	for _, ip := range ips {
+		conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		orGlobalLoggers(nd.logs).DEBUG.Println(NET, "failed to connect to", ip, err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// dialParallel races connections to the primary and fallback (other family) addresses, the fallbacks
+// being started after the fallback delay or when the primaries fail; the first connection wins.
+func (nd *netDialer) dialParallel(ctx context.Context, ips []net.IPAddr, port string) (net.Conn, error) {
+	primaries, fallbacks := partitionAddrs(ips)
+	if len(fallbacks) == 0 || nd.fallbackDelay < 0 {
+		return nd.dialSerial(ctx, append(primaries, fallbacks...), port)
+	}
+	delay := nd.fallbackDelay
+	if delay == 0 {
+		delay = defaultFallbackDelay
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // abandon the other attempt once we have a result
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan dialResult, 2)
+	race := func(addrs []net.IPAddr) {
+		conn, err := nd.dialSerial(ctx, addrs, port)
+		results <- dialResult{conn, err}
+	}
+	go race(primaries)
+	fallback := time.NewTimer(delay)
+	defer fallback.Stop()
+
+	pending, fallbackStarted := 1, false
+	var firstErr error
+	for {
+		select {
+		case <-fallback.C:
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				go race(fallbacks)
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				go func(n int) { // close any connection made by the losing attempt
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				go race(fallbacks)
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright (c) 2013 IBM Corp.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ *
+ * Contributors:
+ *    Seth Hoenig
+ *    Allan Stockdill-Mander
+ *    Mike Robertson
+ */
+
+package mqtt
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ClientEventType identifies the type of a ClientEvent
+type ClientEventType int
+
+// The types of event sent to the sink set with ClientOptions.SetEventSink. New types may be
+// added in the future (but existing values will not change) so unknown types should be ignored.
+const (
+	EventConnected      ClientEventType = iota // connection (or reconnection) established
+	EventConnectionLost                        // connection lost unexpectedly (Err holds the reason)
+	EventDisconnected                          // Disconnect called
+	EventSubscribed                            // SUBACK received (one event per filter; QoS holds the return code)
+	EventUnsubscribed                          // UNSUBACK received (one event per filter)
+	EventPublishAcked                          // QoS 1 or 2 publish acknowledged by the broker (Topic as passed to Publish)
+	EventError                                 // error that did not result in a connection loss (e.g. failed connection attempt)
+)
+
+// String returns the name of the event type
+func (t ClientEventType) String() string {
+	switch t {
+	case EventConnected:
+		return "connected"
+	case EventConnectionLost:
+		return "connection lost"
+	case EventDisconnected:
+		return "disconnected"
+	case EventSubscribed:
+		return "subscribed"
+	case EventUnsubscribed:
+		return "unsubscribed"
+	case EventPublishAcked:
+		return "publish acked"
+	case EventError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// ClientEvent describes something that happened within the client; only the fields relevant
+// to the Type are set.
+type ClientEvent struct {
+	Type         ClientEventType
+	Time         time.Time
+	ConnectionID string // ConnectionID of the client (see ClientOptions.SetConnectionID)
+	Topic        string // filter for EventSubscribed/EventUnsubscribed, topic for EventPublishAcked
+	QoS          byte   // return code for EventSubscribed
+	MessageID    uint16 // for EventPublishAcked
+	Err          error  // for EventConnectionLost and EventError
+}
+
+// emitEvent sends the event to the EventSink (if one is set) without blocking; if the sink
+// is full the event is dropped and counted (see DroppedEvents)
+func (c *client) emitEvent(e ClientEvent) {
+	if c.options.EventSink == nil {
+		return
+	}
+	e.Time = time.Now()
+	e.ConnectionID = c.options.ConnectionID
+	select {
+	case c.options.EventSink <- e:
+	default:
+		atomic.AddUint64(&c.droppedEvents, 1)
+	}
+}
+
+// DroppedEvents returns the number of events that could not be sent to the EventSink
+// because it was full
+func (c *client) DroppedEvents() uint64 {
+	return atomic.LoadUint64(&c.droppedEvents)
+}
+
+// errorsChannelDepth is the capacity of the channel returned by Errors
+const errorsChannelDepth = 100
+
+// reportError passes err to the Errors channel without blocking (it is dropped, and counted,
+// if the channel is full)
+func (c *client) reportError(err error) {
+	select {
+	case c.errs <- err:
+	default:
+		atomic.AddUint64(&c.droppedErrors, 1)
+	}
+}
+
+// Errors returns a channel that receives internal errors that did not, in themselves, result in the
+// connection being lost; for example a failed attempt to connect to one of several brokers,
+// a PUBREL for an unknown message (see SetReportOrphanPubrel) or a panicking message
+// handler. Errors that result in the connection being lost are passed to the OnConnectionLost
+// handler instead. The channel (which holds up to 100 errors) is never closed; errors are dropped
+// (see DroppedErrors) if it is full so there is no need to read from it.
+func (c *client) Errors() <-chan error {
+	return c.errs
+}
+
+// DroppedErrors returns the number of errors that could not be sent to the Errors channel
+// because it was full
+func (c *client) DroppedErrors() uint64 {
+	return atomic.LoadUint64(&c.droppedErrors)
+}
@@ -15,7 +15,10 @@
 package mqtt
 
 import (
+	"math"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/90poe/paho.mqtt.golang/packets"
 	"sync"
@@ -32,6 +35,12 @@ type Message interface {
 	MessageID() uint16
 	Payload() []byte
 	Ack()
+	// ServerTimestamp returns the time the message was received by the broker (or a proxy)
+	// if known; see ClientOptions.SetServerTimestampExtractor
+	ServerTimestamp() (time.Time, bool)
+	// RawHeader returns the first byte of the fixed header of the PUBLISH packet as received
+	// (packet type, DUP, QoS and RETAIN bits); intended for diagnostics
+	RawHeader() byte
 }
 
 type message struct {
@@ -43,6 +52,10 @@ type message struct {
 	payload   []byte
 	once      sync.Once
 	ack       func()
+
+	serverTime    time.Time
+	hasServerTime bool
+	rawHeader     byte
 }
 
 func (m *message) Duplicate() bool {
@@ -73,6 +86,27 @@ func (m *message) Ack() {
 	m.once.Do(m.ack)
 }
 
+func (m *message) ServerTimestamp() (time.Time, bool) {
+	return m.serverTime, m.hasServerTime
+}
+
+func (m *message) RawHeader() byte {
+	return m.rawHeader
+}
+
+// publishHeaderByte returns the first byte of the fixed header of p. All four flag bits of a PUBLISH
+// are decoded into the FixedHeader (including QoS 3, which is invalid) so this is the byte received.
+func publishHeaderByte(p *packets.PublishPacket) byte {
+	b := p.MessageType<<4 | p.Qos<<1
+	if p.Dup {
+		b |= 0x08
+	}
+	if p.Retain {
+		b |= 0x01
+	}
+	return b
+}
+
 func messageFromPublish(p *packets.PublishPacket, ack func()) Message {
 	return &message{
 		duplicate: p.Dup,
@@ -82,7 +116,34 @@ func messageFromPublish(p *packets.PublishPacket, ack func()) Message {
 		messageID: p.MessageID,
 		payload:   p.Payload,
 		ack:       ack,
+		rawHeader: publishHeaderByte(p),
+	}
+}
+
+// stripTopicPrefix removes prefix from the topic of the message (used to hide the TopicPrefix
+// from message handlers)
+func stripTopicPrefix(m Message, prefix string) Message {
+	if msg, ok := m.(*message); ok {
+		msg.topic = strings.TrimPrefix(msg.topic, prefix)
 	}
+	return m
+}
+
+// setTopic changes the topic of the message (used when an InboundTopicRewriter is in use)
+func setTopic(m Message, topic string) Message {
+	if msg, ok := m.(*message); ok {
+		msg.topic = topic
+	}
+	return m
+}
+
+// setServerTimestamp sets the time the message was received by the broker (as returned by the
+// ServerTimestampExtractor)
+func setServerTimestamp(m Message, t time.Time, ok bool) Message {
+	if msg, isMsg := m.(*message); isMsg {
+		msg.serverTime, msg.hasServerTime = t, ok
+	}
+	return m
 }
 
 func newConnectMsgFromOptions(options *ClientOptions, broker *url.URL) *packets.ConnectPacket {
@@ -121,7 +182,20 @@ func newConnectMsgFromOptions(options *ClientOptions, broker *url.URL) *packets.
 		}
 	}
 
-	m.Keepalive = uint16(options.KeepAlive)
+	m.Keepalive = connectKeepAlive(options)
 
 	return m
 }
+
+// connectKeepAlive returns the keepalive (in seconds) sent in the CONNECT packet; this is
+// options.KeepAlive limited to the range that can be encoded (0 disables the keepalive)
+func connectKeepAlive(options *ClientOptions) uint16 {
+	switch {
+	case options.KeepAlive <= 0:
+		return 0 // keepalive disabled
+	case options.KeepAlive > math.MaxUint16:
+		return math.MaxUint16
+	default:
+		return uint16(options.KeepAlive)
+	}
+}
@@ -15,6 +15,7 @@
 package mqtt
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"time"
@@ -25,9 +26,26 @@ import (
 // the client application.
 type MId uint16
 
+// MessageIDAllocator allows the allocation of message IDs to be coordinated externally (e.g.
+// between multiple client instances that share a persistent session). The contract is:
+//   - Allocate must return an ID in the range 1-65535 for which inUse returns false, or 0 if
+//     no ID is available (the request will then fail)
+//   - an ID must not be reused until Free has been called for it (IDs are in flight until then)
+//   - Free may also be called for IDs that were restored from the Store when resuming a session
+//     (these are reserved directly and so were never returned by Allocate)
+//
+// Calls are serialised by the client (they are made whilst the message ID lock is held) so
+// implementations must not block for long.
+type MessageIDAllocator interface {
+	Allocate(inUse func(id uint16) bool) uint16
+	Free(id uint16)
+}
+
 type messageIds struct {
 	sync.RWMutex
-	index map[uint16]tokenCompletor
+	index     map[uint16]tokenCompletor
+	allocator MessageIDAllocator // if nil IDs are allocated sequentially (lowest free ID first)
+	logs      *loggers           // nil for the package level loggers
 }
 
 const (
@@ -50,17 +68,46 @@ func (mids *messageIds) cleanUp() {
 		}
 		token.flowComplete()
 	}
+	if mids.allocator != nil {
+		for id := range mids.index {
+			mids.allocator.Free(id)
+		}
+	}
 	mids.index = make(map[uint16]tokenCompletor)
 	mids.Unlock()
-	DEBUG.Println(MID, "cleaned up")
+	orGlobalLoggers(mids.logs).DEBUG.Println(MID, "cleaned up")
+}
+
+// inUse returns the number of message IDs currently allocated
+func (mids *messageIds) inUse() int {
+	mids.RLock()
+	defer mids.RUnlock()
+	return len(mids.index)
 }
 
 func (mids *messageIds) freeID(id uint16) {
 	mids.Lock()
+	if _, ok := mids.index[id]; ok && mids.allocator != nil {
+		mids.allocator.Free(id)
+	}
 	delete(mids.index, id)
 	mids.Unlock()
 }
 
+// releaseID frees id if it is still held by token, returning false if it is not
+func (mids *messageIds) releaseID(id uint16, token tokenCompletor) bool {
+	mids.Lock()
+	defer mids.Unlock()
+	if t, ok := mids.index[id]; !ok || t != token {
+		return false
+	}
+	if mids.allocator != nil {
+		mids.allocator.Free(id)
+	}
+	delete(mids.index, id)
+	return true
+}
+
 func (mids *messageIds) claimID(token tokenCompletor, id uint16) {
 	mids.Lock()
 	defer mids.Unlock()
@@ -76,6 +123,21 @@ func (mids *messageIds) claimID(token tokenCompletor, id uint16) {
 func (mids *messageIds) getID(t tokenCompletor) uint16 {
 	mids.Lock()
 	defer mids.Unlock()
+	if mids.allocator != nil {
+		id := mids.allocator.Allocate(func(id uint16) bool {
+			_, ok := mids.index[id]
+			return ok
+		})
+		if id == 0 {
+			return 0
+		}
+		if _, ok := mids.index[id]; ok {
+			orGlobalLoggers(mids.logs).ERROR.Println(MID, "message id allocator returned an id that is in use:", id)
+			return 0
+		}
+		mids.index[id] = t
+		return id
+	}
 	for i := midMin; i <= midMax && i != 0; i++ {
 		if _, ok := mids.index[i]; !ok {
 			mids.index[i] = t
@@ -91,11 +153,19 @@ func (mids *messageIds) getToken(id uint16) tokenCompletor {
 	if token, ok := mids.index[id]; ok {
 		return token
 	}
-	return &DummyToken{id: id}
+	return &DummyToken{id: id, logs: mids.logs}
 }
 
+// closedChan is returned by Done() on tokens that are always complete
+var closedChan = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
 type DummyToken struct {
-	id uint16
+	id   uint16
+	logs *loggers // nil for the package level loggers
 }
 
 func (d *DummyToken) Wait() bool {
@@ -106,8 +176,16 @@ func (d *DummyToken) WaitTimeout(t time.Duration) bool {
 	return true
 }
 
+func (d *DummyToken) WaitContext(ctx context.Context) error {
+	return nil
+}
+
+func (d *DummyToken) Done() <-chan struct{} {
+	return closedChan
+}
+
 func (d *DummyToken) flowComplete() {
-	ERROR.Printf("A lookup for token %d returned nil\n", d.id)
+	orGlobalLoggers(d.logs).ERROR.Printf("A lookup for token %d returned nil\n", d.id)
 }
 
 func (d *DummyToken) Error() error {
@@ -131,6 +209,14 @@ func (p *PlaceHolderToken) WaitTimeout(t time.Duration) bool {
 	return true
 }
 
+func (p *PlaceHolderToken) WaitContext(ctx context.Context) error {
+	return nil
+}
+
+func (p *PlaceHolderToken) Done() <-chan struct{} {
+	return closedChan
+}
+
 func (p *PlaceHolderToken) flowComplete() {
 }
 
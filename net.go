@@ -15,9 +15,15 @@
 package mqtt
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"reflect"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/90poe/paho.mqtt.golang/packets"
@@ -30,29 +36,37 @@ const closedNetConnErrorText = "use of closed network connection" // error strin
 // cm - Connect Packet with everything other than the protocolname/version populated (historical reasons)
 // protocolVersion - The protocol version to attempt to connect with
 func ConnectMQTT(conn net.Conn, cm *packets.ConnectPacket, protocolVersion uint) (byte, bool) {
+	return connectMQTT(conn, cm, protocolVersion, nil, globalLoggers)
+}
+
+// connectMQTT is ConnectMQTT reporting progress through the handshake to progress (which may be nil)
+// and logging to logs
+func connectMQTT(conn net.Conn, cm *packets.ConnectPacket, protocolVersion uint, progress ConnectProgressHandler, logs *loggers) (byte, bool) {
 	switch protocolVersion {
 	case 3:
-		DEBUG.Println(CLI, "Using MQTT 3.1 protocol")
+		logs.DEBUG.Println(CLI, "Using MQTT 3.1 protocol")
 		cm.ProtocolName = "MQIsdp"
 		cm.ProtocolVersion = 3
 	case 0x83:
-		DEBUG.Println(CLI, "Using MQTT 3.1b protocol")
+		logs.DEBUG.Println(CLI, "Using MQTT 3.1b protocol")
 		cm.ProtocolName = "MQIsdp"
 		cm.ProtocolVersion = 0x83
 	case 0x84:
-		DEBUG.Println(CLI, "Using MQTT 3.1.1b protocol")
+		logs.DEBUG.Println(CLI, "Using MQTT 3.1.1b protocol")
 		cm.ProtocolName = "MQTT"
 		cm.ProtocolVersion = 0x84
 	default:
-		DEBUG.Println(CLI, "Using MQTT 3.1.1 protocol")
+		logs.DEBUG.Println(CLI, "Using MQTT 3.1.1 protocol")
 		cm.ProtocolName = "MQTT"
 		cm.ProtocolVersion = 4
 	}
+	progress.report(ConnectPhaseSendingConnect)
 	if err := cm.Write(conn); err != nil {
-		ERROR.Println(CLI, err)
+		logs.ERROR.Println(CLI, err)
 	}
 
-	rc, sessionPresent := verifyCONNACK(conn)
+	progress.report(ConnectPhaseWaitingConnack)
+	rc, sessionPresent := verifyCONNACK(conn, logs)
 	return rc, sessionPresent
 }
 
@@ -60,26 +74,26 @@ func ConnectMQTT(conn net.Conn, cm *packets.ConnectPacket, protocolVersion uint)
 // when the connection is first started.
 // This prevents receiving incoming data while resume
 // is in progress if clean session is false.
-func verifyCONNACK(conn net.Conn) (byte, bool) {
-	DEBUG.Println(NET, "connect started")
+func verifyCONNACK(conn net.Conn, logs *loggers) (byte, bool) {
+	logs.DEBUG.Println(NET, "connect started")
 
 	ca, err := packets.ReadPacket(conn)
 	if err != nil {
-		ERROR.Println(NET, "connect got error", err)
+		logs.ERROR.Println(NET, "connect got error", err)
 		return packets.ErrNetworkError, false
 	}
 	if ca == nil {
-		ERROR.Println(NET, "received nil packet")
+		logs.ERROR.Println(NET, "received nil packet")
 		return packets.ErrNetworkError, false
 	}
 
 	msg, ok := ca.(*packets.ConnackPacket)
 	if !ok {
-		ERROR.Println(NET, "received msg that was not CONNACK")
+		logs.ERROR.Println(NET, "received msg that was not CONNACK")
 		return packets.ErrNetworkError, false
 	}
 
-	DEBUG.Println(NET, "received connack")
+	logs.DEBUG.Println(NET, "received connack")
 	return msg.ReturnCode, msg.SessionPresent
 }
 
@@ -93,16 +107,16 @@ type inbound struct {
 
 // startIncoming initiates a goroutine that reads incoming messages off the wire and sends them to the channel (returned).
 // If there are any issues with the network connection then the returned cahnnel will be closed and the goroutine will exit
-// (so closing the connection will terminate the goroutine)
-func startIncoming(conn net.Conn) <-chan inbound {
+// (so closing the connection will terminate the goroutine). Packets larger than maxPacketSize (if not 0) result in an error.
+func startIncoming(conn net.Conn, maxPacketSize int, logs *loggers) <-chan inbound {
 	var err error
 	var cp packets.ControlPacket
 	ibound := make(chan inbound)
 
-	DEBUG.Println(NET, "incoming started")
+	logs.DEBUG.Println(NET, "incoming started")
 	go func() {
 		for {
-			if cp, err = packets.ReadPacket(conn); err != nil {
+			if cp, err = packets.ReadPacketWithLimit(conn, maxPacketSize); err != nil {
 				// We do not want to log the error if it is due to the network connection having been closed
 				// elsewhere (i.e. after sending DisconnectPacket). Detecting this situation is the subject of
 				// https://github.com/golang/go/issues/4373
@@ -110,10 +124,10 @@ func startIncoming(conn net.Conn) <-chan inbound {
 					ibound <- inbound{err: err}
 				}
 				close(ibound)
-				DEBUG.Println(NET, "incoming complete")
+				logs.DEBUG.Println(NET, "incoming complete")
 				return
 			}
-			DEBUG.Println(NET, "Received Message")
+			logs.DEBUG.Println(NET, "Received Message")
 			ibound <- inbound{cp: cp}
 		}
 	}()
@@ -137,36 +151,52 @@ func startIncommingComms(conn net.Conn,
 	c commsFns,
 	inboundFromStore <-chan packets.ControlPacket,
 ) <-chan incommingComms {
-	ibound := startIncoming(conn) // Start goroutine that reads from network connection
+	logs := commsLoggers(c)
+	maxPacketSize := 0
+	if cc, ok := c.(*client); ok {
+		maxPacketSize = cc.options.MaxPacketSize
+	}
+	ibound := startIncoming(conn, maxPacketSize, logs) // Start goroutine that reads from network connection
 	output := make(chan incommingComms)
 
-	DEBUG.Println(NET, "startIncommingComms started")
+	// With StrictOrderAcrossReconnect nothing is read from the network until all messages from the store have been processed
+	strictOrder := false
+	if cc, ok := c.(*client); ok {
+		strictOrder = cc.options.StrictOrderAcrossReconnect
+	}
+
+	logs.DEBUG.Println(NET, "startIncommingComms started")
 	go func() {
 		for {
 			if inboundFromStore == nil && ibound == nil {
 				close(output)
-				DEBUG.Println(NET, "startIncommingComms goroutine complete")
+				logs.DEBUG.Println(NET, "startIncommingComms goroutine complete")
 				return // As soon as ibound is closed we can exit (should have already processed an error)
 			}
-			DEBUG.Println(NET, "logic waiting for msg on ibound")
+			logs.DEBUG.Println(NET, "logic waiting for msg on ibound")
+
+			live := ibound
+			if strictOrder && inboundFromStore != nil {
+				live = nil // blocks until inboundFromStore is closed
+			}
 
 			var msg packets.ControlPacket
 			var ok bool
 			select {
 			case msg, ok = <-inboundFromStore:
 				if !ok {
-					DEBUG.Println(NET, "startIncommingComms: inboundFromStore complete")
+					logs.DEBUG.Println(NET, "startIncommingComms: inboundFromStore complete")
 					inboundFromStore = nil // should happen quickly as this is only for persisted messages
 					continue
 				}
-				DEBUG.Println(NET, "startIncommingComms: got msg from store")
-			case ibMsg, ok := <-ibound:
+				logs.DEBUG.Println(NET, "startIncommingComms: got msg from store")
+			case ibMsg, ok := <-live:
 				if !ok {
-					DEBUG.Println(NET, "startIncommingComms: ibound complete")
+					logs.DEBUG.Println(NET, "startIncommingComms: ibound complete")
 					ibound = nil
 					continue
 				}
-				DEBUG.Println(NET, "startIncommingComms: got msg on ibound")
+				logs.DEBUG.Println(NET, "startIncommingComms: got msg on ibound")
 				// If the inbound comms routine encounters any issues it will send us an error.
 				if ibMsg.err != nil {
 					output <- incommingComms{err: ibMsg.err}
@@ -178,7 +208,7 @@ func startIncommingComms(conn net.Conn,
 					continue
 				}
 
-				DEBUG.Printf("[%s] received packet from ibound: %d -> %s", NET, msg.Details().MessageID, reflect.TypeOf(msg).String())
+				logs.DEBUG.Printf("[%s] received packet from ibound: %d -> %s", NET, msg.Details().MessageID, reflect.TypeOf(msg).String())
 
 				c.persistInbound(msg)
 				c.UpdateLastReceived() // Notify keepalive logic that we recently received a packet
@@ -186,61 +216,126 @@ func startIncommingComms(conn net.Conn,
 
 			switch m := msg.(type) {
 			case *packets.PingrespPacket:
-				DEBUG.Println(NET, "received pingresp")
+				logs.DEBUG.Println(NET, "received pingresp")
 				c.pingRespReceived()
 			case *packets.SubackPacket:
-				DEBUG.Println(NET, "received suback, id:", m.MessageID)
+				logs.DEBUG.Println(NET, "received suback, id:", m.MessageID)
 				token := c.getToken(m.MessageID)
 				switch t := token.(type) {
 				case *SubscribeToken:
-					DEBUG.Println(NET, "granted qoss", m.ReturnCodes)
+					logs.DEBUG.Println(NET, "granted qoss", m.ReturnCodes)
 					for i, qos := range m.ReturnCodes {
 						t.subResult[t.subs[i]] = qos
 					}
+					if cc, ok := c.(*client); ok && cc.options.OnSubscribe != nil {
+						for i, qos := range m.ReturnCodes {
+							cc.options.OnSubscribe(t.subs[i], qos)
+						}
+					}
+					if cc, ok := c.(*client); ok {
+						for i, qos := range m.ReturnCodes {
+							cc.emitEvent(ClientEvent{Type: EventSubscribed, Topic: t.subs[i], QoS: qos})
+						}
+					}
+					if cc, ok := c.(*client); ok && cc.options.QoSDowngradePolicy == QoSDowngradeFail {
+						if err := t.checkGrantedQoS(); err != nil {
+							logs.WARN.Println(NET, "subscribe failed due to QoS downgrade:", err)
+							cc.reportError(err)
+							t.setError(err)
+						}
+					}
 				}
 				token.flowComplete()
 				c.freeID(m.MessageID)
 			case *packets.UnsubackPacket:
-				DEBUG.Println(NET, "received unsuback, id:", m.MessageID)
-				c.getToken(m.MessageID).flowComplete()
+				logs.DEBUG.Println(NET, "received unsuback, id:", m.MessageID)
+				token := c.getToken(m.MessageID)
+				if t, ok := token.(*UnsubscribeToken); ok {
+					if cc, ok := c.(*client); ok && cc.options.OnUnsubscribe != nil {
+						for _, topic := range t.topics {
+							cc.options.OnUnsubscribe(topic)
+						}
+					}
+					if cc, ok := c.(*client); ok {
+						for _, topic := range t.topics {
+							cc.emitEvent(ClientEvent{Type: EventUnsubscribed, Topic: topic})
+						}
+					}
+				}
+				token.flowComplete()
 				c.freeID(m.MessageID)
 			case *packets.PublishPacket:
-				DEBUG.Println(NET, "received publish, msgId:", m.MessageID)
+				logs.DEBUG.Println(NET, "received publish, msgId:", m.MessageID)
 				output <- incommingComms{incommingPub: m}
 			case *packets.PubackPacket:
-				DEBUG.Println(NET, "received puback, id:", m.MessageID)
-				c.getToken(m.MessageID).flowComplete()
+				logs.DEBUG.Println(NET, "received puback, id:", m.MessageID)
+				token := c.getToken(m.MessageID)
+				if pt, ok := token.(*PublishToken); ok {
+					if cc, ok := c.(*client); ok {
+						cc.publishComplete(m.MessageID, pt)
+					}
+				}
+				token.flowComplete()
 				c.freeID(m.MessageID)
 			case *packets.PubrecPacket:
-				DEBUG.Println(NET, "received pubrec, id:", m.MessageID)
+				logs.DEBUG.Println(NET, "received pubrec, id:", m.MessageID)
 				prel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
 				prel.MessageID = m.MessageID
 				output <- incommingComms{outbound: &PacketAndToken{p: prel, t: nil}}
 			case *packets.PubrelPacket:
-				DEBUG.Println(NET, "received pubrel, id:", m.MessageID)
+				logs.DEBUG.Println(NET, "received pubrel, id:", m.MessageID)
 
 				// Check this later
-				DEBUG.Println(NET, "received pubrel, start running runHandlers id:", m.MessageID)
+				logs.DEBUG.Println(NET, "received pubrel, start running runHandlers id:", m.MessageID)
 				cc, ok := c.(*client)
 				if !ok {
-					DEBUG.Println(NET, "received pubrel, failed to cast to *client id:", m.MessageID)
+					logs.DEBUG.Println(NET, "received pubrel, failed to cast to *client id:", m.MessageID)
 				} else {
+					if id := m.MessageID; cc.msgRouter.gate.hold(func() { cc.releaseQoS2(id) }) {
+						logs.DEBUG.Println(NET, "received pubrel, dispatch stopped so holding id:", id)
+						continue
+					}
 					clientOpts := cc.OptionsReader()
-					DEBUG.Println(NET, "received pubrel, start running handlers for id:", m.MessageID)
-					cc.msgRouter.handleQoS2Packets(m.MessageID, clientOpts.Order(), cc)
-					DEBUG.Println(NET, "received pubrel, delete from store:", m.MessageID, pubKey(m.MessageID))
+					logs.DEBUG.Println(NET, "received pubrel, start running handlers for id:", m.MessageID)
+					found, ackPending := cc.msgRouter.handleQoS2Packets(m.MessageID, clientOpts.Order(), cc)
+					logs.DEBUG.Println(NET, "received pubrel, delete from store:", m.MessageID, pubKey(m.MessageID))
 					//cc.persist.Del(pubKey(m.MessageID))
+					if !found {
+						// A PUBCOMP is always sent; the PUBREL may legitimately be a resend (e.g. following
+						// a reconnect) so not completing the flow would just lead to it being sent again
+						if clientOpts.ReportOrphanPubrel() {
+							logs.WARN.Println(NET, "received pubrel for unknown message, sending pubcomp, id:", m.MessageID)
+							cc.reportError(fmt.Errorf("received pubrel for unknown message id %d", m.MessageID))
+						} else {
+							logs.DEBUG.Println(NET, "received pubrel for unknown message, sending pubcomp, id:", m.MessageID)
+						}
+					} else if ackPending {
+						logs.DEBUG.Println(NET, "received pubrel, pubcomp will be sent when the message is acknowledged, id:", m.MessageID)
+						continue
+					}
 				}
-				DEBUG.Println(NET, "received pubrel, end running runHandlers id:", m.MessageID)
+				logs.DEBUG.Println(NET, "received pubrel, end running runHandlers id:", m.MessageID)
 
 				pc := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
 				pc.MessageID = m.MessageID
 				c.persistOutbound(pc)
 				output <- incommingComms{outbound: &PacketAndToken{p: pc, t: nil}}
 			case *packets.PubcompPacket:
-				DEBUG.Println(NET, "received pubcomp, id:", m.MessageID)
-				c.getToken(m.MessageID).flowComplete()
+				logs.DEBUG.Println(NET, "received pubcomp, id:", m.MessageID)
+				token := c.getToken(m.MessageID)
+				if pt, ok := token.(*PublishToken); ok {
+					if cc, ok := c.(*client); ok {
+						cc.publishComplete(m.MessageID, pt)
+					}
+				}
+				token.flowComplete()
 				c.freeID(m.MessageID)
+			case *packets.DisconnectPacket:
+				logs.DEBUG.Println(NET, "received disconnect, reason code:", m.ReasonCode)
+				if cc, ok := c.(*client); ok && cc.options.ServerDisconnectHandler != nil {
+					go cc.options.ServerDisconnectHandler(cc, m.ReasonCode)
+				}
+				output <- incommingComms{err: &ServerDisconnectError{ReasonCode: m.ReasonCode}}
 			}
 		}
 	}()
@@ -258,40 +353,152 @@ func startOutgoingComms(conn net.Conn,
 	obound <-chan *PacketAndToken,
 	oboundFromIncomming <-chan *PacketAndToken,
 ) <-chan error {
+	logs := commsLoggers(c)
 	errChan := make(chan error)
-	DEBUG.Println(NET, "outgoing started")
+	logs.DEBUG.Println(NET, "outgoing started")
+
+	// Packets may be written to a buffer (see ClientOptions.SetWriteBuffer) which is flushed when no
+	// further packets are waiting to be sent, when it is full or at the flush interval
+	var (
+		w             io.Writer = conn
+		bw            *bufio.Writer
+		flushInterval time.Duration
+		confirmWrite  bool // QoS 0 tokens complete only once the buffer is flushed (see ClientOptions.SetQoS0ConfirmWrite)
+	)
+	if cc, ok := c.(*client); ok && cc.options.WriteRetries > 0 {
+		w = &retryWriter{w: conn, retries: cc.options.WriteRetries, delay: cc.options.WriteRetryDelay, logs: logs}
+	}
+	if cc, ok := c.(*client); ok && cc.options.WriteBufferSize > 0 {
+		bw = bufio.NewWriterSize(w, cc.options.WriteBufferSize)
+		w = bw
+		flushInterval = cc.options.WriteFlushInterval
+		confirmWrite = cc.options.QoS0ConfirmWrite
+	}
 
 	go func() {
+		var flush <-chan time.Time // flush interval (nil if none)
+		if bw != nil && flushInterval > 0 {
+			ticker := time.NewTicker(flushInterval)
+			defer ticker.Stop()
+			flush = ticker.C
+		}
+		const (
+			fromNone = iota // no packet available (or the flush interval has elapsed)
+			fromObound
+			fromOboundP
+			fromIncomming
+		)
+		// receive returns the next packet to send and where it came from. If wait is false and no packet
+		// is immediately available fromNone is returned.
+		receive := func(wait bool) (*PacketAndToken, int, bool) {
+			if !wait {
+				select {
+				case msg, ok := <-obound:
+					return msg, fromObound, ok
+				case msg, ok := <-oboundp:
+					return msg, fromOboundP, ok
+				case msg, ok := <-oboundFromIncomming:
+					return msg, fromIncomming, ok
+				default:
+					return nil, fromNone, true
+				}
+			}
+			select {
+			case msg, ok := <-obound:
+				return msg, fromObound, ok
+			case msg, ok := <-oboundp:
+				return msg, fromOboundP, ok
+			case msg, ok := <-oboundFromIncomming:
+				return msg, fromIncomming, ok
+			case <-flush:
+				return nil, fromNone, true
+			}
+		}
+		// unconfirmed holds the tokens of QoS 0 publishes that are in the buffer (when confirmWrite is set);
+		// these complete when the buffer is flushed (or fail with the error if that is unsuccessful)
+		var unconfirmed []tokenCompletor
+		confirm := func(err error) {
+			for _, t := range unconfirmed {
+				if err != nil {
+					t.setError(err)
+				} else {
+					t.flowComplete()
+				}
+			}
+			unconfirmed = nil
+		}
+		// flushBuffer writes any buffered packets to the connection (returns false if this fails). Errors are
+		// passed to errChan if report is true (it must be false once shutting down as nothing may be reading).
+		flushBuffer := func(report bool) bool {
+			if bw == nil || bw.Buffered() == 0 {
+				confirm(nil)
+				return true
+			}
+			writeTimeout := c.getWriteTimeOut()
+			if writeTimeout > 0 {
+				if err := conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+					logs.ERROR.Println(NET, err)
+				}
+			}
+			if err := bw.Flush(); err != nil {
+				logs.ERROR.Println(NET, "outgoing reporting error", err)
+				confirm(err)
+				if report && !strings.Contains(err.Error(), closedNetConnErrorText) {
+					errChan <- err
+				}
+				return false
+			}
+			if writeTimeout > 0 {
+				if err := conn.SetWriteDeadline(time.Time{}); err != nil {
+					logs.ERROR.Println(NET, err)
+				}
+			}
+			confirm(nil)
+			return true
+		}
+
 		for {
-			DEBUG.Println(NET, "outgoing waiting for an outbound message")
+			logs.DEBUG.Println(NET, "outgoing waiting for an outbound message")
 
 			// This goroutine will only exits when all of the input channels we receive on have been closed. This approach is taken to avoid any
 			// deadlocks (if the connection goes down there are limited options as to what we can do with anything waiting on us and
 			// throwing away the packets seems the best option)
 			if oboundp == nil && obound == nil && oboundFromIncomming == nil {
-				DEBUG.Println(NET, "outgoing comms stopping")
+				flushBuffer(false)
+				logs.DEBUG.Println(NET, "outgoing comms stopping")
 				close(errChan)
 				return
 			}
 
-			select {
-			case pub, ok := <-obound:
+			msg, from, ok := receive(bw == nil || bw.Buffered() == 0)
+			switch from {
+			case fromNone: // nothing waiting to be sent (or the flush interval has elapsed)
+				flushBuffer(true)
+				continue
+			case fromObound:
 				if !ok {
 					obound = nil
 					continue
 				}
-				msg := pub.p.(*packets.PublishPacket)
+				pub := msg.p.(*packets.PublishPacket)
+				if t, isPub := msg.t.(*PublishToken); isPub && pub.Qos > 0 && !t.markSent() {
+					// abandoned whilst queued (see PublishWithContext) so the ID can now be reused
+					logs.DEBUG.Println(NET, "obound dropped cancelled publish, id:", pub.MessageID)
+					c.releaseID(pub.MessageID, t)
+					continue
+				}
 
 				writeTimeout := c.getWriteTimeOut()
 				if writeTimeout > 0 {
 					if err := conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
-						ERROR.Println(NET, err)
+						logs.ERROR.Println(NET, err)
 					}
 				}
 
-				if err := msg.Write(conn); err != nil {
-					ERROR.Println(NET, "outgoing reporting error", err)
-					pub.t.setError(err)
+				if err := pub.Write(w); err != nil {
+					logs.ERROR.Println(NET, "outgoing reporting error", err)
+					msg.t.setError(err)
+					confirm(err) // buffered publishes can no longer be confirmed
 					// report error if it's not due to the connection being closed elsewhere
 					if !strings.Contains(err.Error(), closedNetConnErrorText) {
 						errChan <- err
@@ -303,47 +510,54 @@ func startOutgoingComms(conn net.Conn,
 					// If we successfully wrote, we don't want the timeout to happen during an idle period
 					// so we reset it to infinite.
 					if err := conn.SetWriteDeadline(time.Time{}); err != nil {
-						ERROR.Println(NET, err)
+						logs.ERROR.Println(NET, err)
 					}
 				}
 
-				if msg.Qos == 0 {
-					pub.t.flowComplete()
+				if pub.Qos == 0 {
+					if confirmWrite {
+						unconfirmed = append(unconfirmed, msg.t)
+					} else {
+						msg.t.flowComplete()
+					}
 				}
-				DEBUG.Println(NET, "obound wrote msg, id:", msg.MessageID)
-			case msg, ok := <-oboundp:
+				logs.DEBUG.Println(NET, "obound wrote msg, id:", pub.MessageID)
+			case fromOboundP:
 				if !ok {
 					oboundp = nil
 					continue
 				}
-				DEBUG.Println(NET, "obound priority msg to write, type", reflect.TypeOf(msg.p))
-				if err := msg.p.Write(conn); err != nil {
-					ERROR.Println(NET, "outgoing reporting error", err)
+				logs.DEBUG.Println(NET, "obound priority msg to write, type", reflect.TypeOf(msg.p))
+				if err := msg.p.Write(w); err != nil {
+					logs.ERROR.Println(NET, "outgoing reporting error", err)
 					if msg.t != nil {
 						msg.t.setError(err)
 					}
+					confirm(err) // buffered publishes can no longer be confirmed
 					errChan <- err
 					continue
 				}
 				switch msg.p.(type) {
 				case *packets.DisconnectPacket:
+					flushBuffer(true)
 					msg.t.(*DisconnectToken).flowComplete()
-					DEBUG.Println(NET, "outbound wrote disconnect, closing connection")
+					logs.DEBUG.Println(NET, "outbound wrote disconnect, closing connection")
 					// As per the MQTT spec "After sending a DISCONNECT Packet the Client MUST close the Network Connection"
 					// Closing the connection will cause the goroutines to end in sequence (starting with incomming comms)
 					conn.Close()
 				}
-			case msg, ok := <-oboundFromIncomming: // message triggered by an inbound message (PubrecPacket or PubrelPacket)
+			case fromIncomming: // message triggered by an inbound message (PubrecPacket or PubrelPacket)
 				if !ok {
 					oboundFromIncomming = nil
 					continue
 				}
-				DEBUG.Println(NET, "obound from incomming msg to write, type", reflect.TypeOf(msg.p))
-				if err := msg.p.Write(conn); err != nil {
-					ERROR.Println(NET, "outgoing reporting error", err)
+				logs.DEBUG.Println(NET, "obound from incomming msg to write, type", reflect.TypeOf(msg.p))
+				if err := msg.p.Write(w); err != nil {
+					logs.ERROR.Println(NET, "outgoing reporting error", err)
 					if msg.t != nil {
 						msg.t.setError(err)
 					}
+					confirm(err) // buffered publishes can no longer be confirmed
 					errChan <- err
 					continue
 				}
@@ -354,16 +568,61 @@ func startOutgoingComms(conn net.Conn,
 	return errChan
 }
 
+// retryWriter retries writes that fail with a transient error (see ClientOptions.SetWriteRetries).
+// Following a partial write only the remaining bytes are retried.
+type retryWriter struct {
+	w       io.Writer
+	retries int
+	delay   time.Duration
+	logs    *loggers
+}
+
+func (r *retryWriter) Write(p []byte) (int, error) {
+	written := 0
+	for attempt := 0; ; attempt++ {
+		n, err := r.w.Write(p[written:])
+		written += n
+		if err == nil && written < len(p) {
+			err = io.ErrShortWrite
+		}
+		if err == nil || attempt >= r.retries || !transientWriteError(err) {
+			return written, err
+		}
+		r.logs.WARN.Println(NET, "retrying write after transient error", err, "written:", written, "of", len(p))
+		time.Sleep(r.delay)
+	}
+}
+
+// transientWriteError returns true if a write that failed with err may succeed if retried. Timeouts are
+// not retried as the write deadline will still have passed.
+func transientWriteError(err error) bool {
+	if err == io.ErrShortWrite || errors.Is(err, syscall.EAGAIN) {
+		return true
+	}
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return ne.Temporary() && !ne.Timeout()
+	}
+	return false
+}
+
 // commsFns provide access to the client state (messageids, requesting disconnection and updating timing)
 type commsFns interface {
-	getToken(id uint16) tokenCompletor       // Retrieve the token for the specified messageid (if none then a dummy token must be returned)
-	freeID(id uint16)                        // Release the specified messageid (clearing out of any persistant store)
-	UpdateLastReceived()                     // Must be called whenever a packet is received
-	UpdateLastSent()                         // Must be called whenever a packet is successfully sent
-	getWriteTimeOut() time.Duration          // Return the writetimeout (or 0 if none)
-	persistOutbound(m packets.ControlPacket) // add the packet to the outbound store
-	persistInbound(m packets.ControlPacket)  // add the packet to the inbound store
-	pingRespReceived()                       // Called when a ping response is received
+	getToken(id uint16) tokenCompletor          // Retrieve the token for the specified messageid (if none then a dummy token must be returned)
+	freeID(id uint16)                           // Release the specified messageid (clearing out of any persistant store)
+	releaseID(id uint16, t tokenCompletor) bool // Release the specified messageid if it is still held by t
+	UpdateLastReceived()                        // Must be called whenever a packet is received
+	UpdateLastSent()                            // Must be called whenever a packet is successfully sent
+	getWriteTimeOut() time.Duration             // Return the writetimeout (or 0 if none)
+	persistOutbound(m packets.ControlPacket)    // add the packet to the outbound store
+	persistInbound(m packets.ControlPacket)     // add the packet to the inbound store
+	pingRespReceived()                          // Called when a ping response is received
+}
+
+// commsLoggers returns the loggers of the client behind c (or the package level loggers if c is not a client)
+func commsLoggers(c commsFns) *loggers {
+	cc, _ := c.(*client)
+	return clientLoggers(cc)
 }
 
 // startComms initiates goroutines that handles communications over the network connection
@@ -383,12 +642,13 @@ func startComms(conn net.Conn, // Network connection (must be active)
 	<-chan *packets.PublishPacket, // Publishpackages received over the network
 	<-chan error, // Any errors (should generally trigger a disconnect)
 ) {
+	logs := commsLoggers(c)
 	// Start inbound comms handler; this needs to be able to transmit messages so we start a go routine to add these to the priority outbound channel
 	ibound := startIncommingComms(conn, c, inboundFromStore)
 	outboundFromIncomming := make(chan *PacketAndToken) // Will accept outgoing messages triggered by startIncommingComms (e.g. acknowledgements)
 
 	oboundErr := startOutgoingComms(conn, c, oboundp, obound, outboundFromIncomming)
-	DEBUG.Println(NET, "startComms started")
+	logs.DEBUG.Println(NET, "startComms started")
 
 	// Now we just need to pass on any errors and close the error channel when out inbound channels have been closed
 	outPublish := make(chan *packets.PublishPacket)
@@ -397,7 +657,7 @@ func startComms(conn net.Conn, // Network connection (must be active)
 		for {
 			if ibound == nil && oboundErr == nil {
 				close(outError)
-				DEBUG.Println(NET, "startComms gorouting exiting")
+				logs.DEBUG.Println(NET, "startComms gorouting exiting")
 				return
 			}
 			select {
@@ -421,7 +681,7 @@ func startComms(conn net.Conn, // Network connection (must be active)
 					outPublish <- ic.incommingPub
 					break
 				}
-				ERROR.Println(STR, "startComms received empty incommingComms msg")
+				logs.ERROR.Println(STR, "startComms received empty incommingComms msg")
 			case err, ok := <-oboundErr:
 				if !ok {
 					oboundErr = nil
@@ -434,26 +694,72 @@ func startComms(conn net.Conn, // Network connection (must be active)
 	return outPublish, outError
 }
 
+// publishComplete is called when a QoS 1/2 publish has been fully acknowledged by the broker
+func (c *client) publishComplete(id uint16, t *PublishToken) {
+	if c.options.OnPublishComplete != nil {
+		c.options.OnPublishComplete(id, t.topic) // called in order, so must return quickly
+	}
+	c.emitEvent(ClientEvent{Type: EventPublishAcked, MessageID: id, Topic: t.topic})
+}
+
+// manualAckFunc returns the function used to acknowledge a message when AutoAckDisabled is set (the
+// message is counted as pending until this is called). For QoS 2 messages the PUBREC has already been
+// sent so a PUBCOMP is sent.
+func (c *client) manualAckFunc(packet *packets.PublishPacket) func() {
+	atomic.AddInt64(&c.pendingAcks, 1)
+	return func() {
+		atomic.AddInt64(&c.pendingAcks, -1)
+		if packet.Qos != 2 {
+			ackFunc(c.oboundP, c.persist, packet, c.logs)()
+			return
+		}
+		pc := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+		pc.MessageID = packet.MessageID
+		c.logs.DEBUG.Println(NET, "putting pubcomp msg on obound")
+		persistOutbound(c.persist, pc)
+		c.oboundP <- &PacketAndToken{p: pc, t: nil}
+		c.logs.DEBUG.Println(NET, "done putting pubcomp msg on obound")
+	}
+}
+
+// releaseQoS2 handles a QoS 2 message whose PUBREL was received whilst dispatch was stopped (see
+// client.StopDispatch); the handlers are run and the PUBCOMP sent (unless AutoAckDisabled is set, in
+// which case it is sent when the message is acknowledged)
+func (c *client) releaseQoS2(id uint16) {
+	if _, ackPending := c.msgRouter.handleQoS2Packets(id, c.options.Order, c); ackPending {
+		return
+	}
+	c.sendPubcomp(id)
+}
+
+// sendPubcomp completes the QoS 2 flow for the message with the specified id (blocking until the comms are running)
+func (c *client) sendPubcomp(id uint16) {
+	pc := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+	pc.MessageID = id
+	persistOutbound(c.persist, pc)
+	c.oboundP <- &PacketAndToken{p: pc, t: nil}
+}
+
 // ackFunc acknowledges a packet
 // WARNING the function returned must not be called if the comms routine is shutting down or not running
 // (it needs outgoing comms in order to send the acknowledgement). Currently this is only called from
 // matchAndDispatch which will be shutdown before the comms are
-func ackFunc(oboundP chan *PacketAndToken, persist Store, packet *packets.PublishPacket) func() {
+func ackFunc(oboundP chan *PacketAndToken, persist Store, packet *packets.PublishPacket, logs *loggers) func() {
 	return func() {
 		switch packet.Qos {
 		case 2:
 			pr := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
 			pr.MessageID = packet.MessageID
-			DEBUG.Println(NET, "putting pubrec msg on obound")
+			logs.DEBUG.Println(NET, "putting pubrec msg on obound")
 			oboundP <- &PacketAndToken{p: pr, t: nil}
-			DEBUG.Println(NET, "done putting pubrec msg on obound")
+			logs.DEBUG.Println(NET, "done putting pubrec msg on obound")
 		case 1:
 			pa := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
 			pa.MessageID = packet.MessageID
-			DEBUG.Println(NET, "putting puback msg on obound")
+			logs.DEBUG.Println(NET, "putting puback msg on obound")
 			persistOutbound(persist, pa)
 			oboundP <- &PacketAndToken{p: pa, t: nil}
-			DEBUG.Println(NET, "done putting puback msg on obound")
+			logs.DEBUG.Println(NET, "done putting puback msg on obound")
 		case 0:
 			// do nothing, since there is no need to send an ack packet back
 		}
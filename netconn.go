@@ -15,12 +15,21 @@
 package mqtt
 
 import (
+	"bufio"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"golang.org/x/net/proxy"
@@ -31,18 +40,35 @@ import (
 //
 
 // openConnection opens a network connection using the protocol indicated in the URL. Does not carry out any MQTT specific handshakes
-func openConnection(uri *url.URL, tlsc *tls.Config, timeout time.Duration, headers http.Header, websocketOptions *WebsocketOptions) (net.Conn, error) {
+// httpProxy is the HTTP proxy to connect through (if nil then the HTTP_PROXY/HTTPS_PROXY environment variables are used)
+// nd controls how broker host names are resolved when connecting directly (nil for the system defaults)
+// timings (which must not be nil) is updated with the time taken by each phase of establishing the connection
+// progress (which may be nil) is called as each phase is started
+func openConnection(uri *url.URL, tlsc *tls.Config, timeout time.Duration, headers http.Header, websocketOptions *WebsocketOptions, httpProxy *url.URL, nd *netDialer, timings *ConnectTimings, progress ConnectProgressHandler) (net.Conn, error) {
+	progress.report(ConnectPhaseDialing)
+	start := time.Now()
 	switch uri.Scheme {
 	case "ws":
-		conn, err := NewWebsocket(uri.String(), nil, timeout, headers, websocketOptions)
+		conn, err := NewWebsocket(uri.String(), nil, timeout, headers, websocketOptionsWithProxy(websocketOptions, httpProxy))
+		timings.Dial = time.Since(start)
 		return conn, err
 	case "wss":
-		conn, err := NewWebsocket(uri.String(), tlsc, timeout, headers, websocketOptions)
+		conn, err := NewWebsocket(uri.String(), tlsc, timeout, headers, websocketOptionsWithProxy(websocketOptions, httpProxy))
+		timings.Dial = time.Since(start)
 		return conn, err
 	case "mqtt", "tcp":
 		allProxy := os.Getenv("all_proxy")
 		if len(allProxy) == 0 {
-			conn, err := net.DialTimeout("tcp", uri.Host, timeout)
+			proxyURL, err := httpProxyForBroker(uri, httpProxy)
+			if err != nil {
+				return nil, err
+			}
+			if proxyURL != nil {
+				conn, err := dialHTTPProxy(proxyURL, uri.Host, timeout)
+				timings.Dial = time.Since(start)
+				return conn, err
+			}
+			conn, err := dialTimed("tcp", uri.Host, timeout, nd, timings)
 			if err != nil {
 				return nil, err
 			}
@@ -51,12 +77,13 @@ func openConnection(uri *url.URL, tlsc *tls.Config, timeout time.Duration, heade
 		proxyDialer := proxy.FromEnvironment()
 
 		conn, err := proxyDialer.Dial("tcp", uri.Host)
+		timings.Dial = time.Since(start)
 		if err != nil {
 			return nil, err
 		}
 		return conn, nil
 	case "unix":
-		conn, err := net.DialTimeout("unix", uri.Host, timeout)
+		conn, err := dialTimed("unix", uri.Host, timeout, nd, timings)
 		if err != nil {
 			return nil, err
 		}
@@ -64,28 +91,263 @@ func openConnection(uri *url.URL, tlsc *tls.Config, timeout time.Duration, heade
 	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps":
 		allProxy := os.Getenv("all_proxy")
 		if len(allProxy) == 0 {
-			conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", uri.Host, tlsc)
+			proxyURL, err := httpProxyForBroker(uri, httpProxy)
 			if err != nil {
 				return nil, err
 			}
-			return conn, nil
+			if proxyURL != nil {
+				conn, err := dialHTTPProxy(proxyURL, uri.Host, timeout)
+				timings.Dial = time.Since(start)
+				if err != nil {
+					return nil, err
+				}
+				return tlsHandshake(conn, uri, tlsc, timeout, timings, progress)
+			}
+			conn, err := dialTimed("tcp", uri.Host, timeout, nd, timings)
+			if err != nil {
+				return nil, err
+			}
+			return tlsHandshake(conn, uri, tlsc, timeout, timings, progress)
 		}
 		proxyDialer := proxy.FromEnvironment()
 
 		conn, err := proxyDialer.Dial("tcp", uri.Host)
+		timings.Dial = time.Since(start)
 		if err != nil {
 			return nil, err
 		}
 
-		tlsConn := tls.Client(conn, tlsc)
+		return tlsHandshake(conn, uri, tlsc, timeout, timings, progress)
+	}
+	return nil, errors.New("Unknown protocol")
+}
+
+// dialTimed connects to addr recording the time spent resolving the address (this ends when the
+// dialer first attempts to connect to one of the resolved addresses) and establishing the connection
+func dialTimed(network, addr string, timeout time.Duration, nd *netDialer, timings *ConnectTimings) (net.Conn, error) {
+	if nd != nil && nd.cache != nil && network == "tcp" {
+		return nd.dial(addr, timeout, timings)
+	}
+	var (
+		resolvedOnce sync.Once
+		resolved     time.Time
+	)
+	start := time.Now()
+	d := &net.Dialer{
+		Timeout: timeout,
+		Control: func(string, string, syscall.RawConn) error {
+			resolvedOnce.Do(func() { resolved = time.Now() })
+			return nil
+		},
+	}
+	if nd != nil {
+		d.Resolver = nd.resolver
+		d.FallbackDelay = nd.fallbackDelay
+	}
+	conn, err := d.Dial(network, addr)
+	end := time.Now()
+	resolvedOnce.Do(func() { resolved = end }) // never got as far as connecting (e.g. lookup failed)
+	timings.DNS = resolved.Sub(start)
+	timings.Dial = end.Sub(resolved)
+	return conn, err
+}
 
-		err = tlsConn.Handshake()
-		if err != nil {
+// tlsHandshake performs a TLS client handshake over an already established connection (e.g. one that
+// has been opened through a proxy). The connection is closed if the handshake fails.
+func tlsHandshake(conn net.Conn, uri *url.URL, tlsc *tls.Config, timeout time.Duration, timings *ConnectTimings, progress ConnectProgressHandler) (net.Conn, error) {
+	progress.report(ConnectPhaseTLSHandshake)
+	start := time.Now()
+	defer func() { timings.TLSHandshake = time.Since(start) }()
+	if tlsc == nil {
+		tlsc = &tls.Config{}
+	}
+	if tlsc.ServerName == "" {
+		// tls.Client, unlike tls.Dial, does not infer the server name from the address. As with tls.Dial
+		// it is set even if InsecureSkipVerify is set (e.g. by SetTLSPinningOnly) so that SNI is sent.
+		tlsc = tlsc.Clone()
+		tlsc.ServerName = uri.Hostname()
+	}
+
+	tlsConn := tls.Client(conn, tlsc)
+
+	if timeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	err := tlsConn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if timeout > 0 {
+		if err := conn.SetDeadline(time.Time{}); err != nil {
 			conn.Close()
 			return nil, err
 		}
+	}
+
+	return tlsConn, nil
+}
 
-		return tlsConn, nil
+// tlsConfigFromOptions returns the TLS configuration to use for the connection (TLSConfig with the
+// TLSServerName, client certificate provider and certificate pinning options applied)
+func tlsConfigFromOptions(o *ClientOptions) *tls.Config {
+	tlsc := tlsConfigWithServerName(o.TLSConfig, o.TLSServerName)
+	if o.ClientCertificateProvider == nil && len(o.TLSPinnedFingerprints) == 0 {
+		return tlsc
 	}
-	return nil, errors.New("Unknown protocol")
+	if tlsc == nil {
+		tlsc = &tls.Config{}
+	} else if tlsc == o.TLSConfig {
+		tlsc = tlsc.Clone()
+	}
+	if o.ClientCertificateProvider != nil {
+		tlsc.GetClientCertificate = o.ClientCertificateProvider // takes precedence over Certificates
+	}
+	if len(o.TLSPinnedFingerprints) == 0 {
+		return tlsc
+	}
+	verify := pinnedFingerprintVerifier(o.TLSPinnedFingerprints)
+	if existing := tlsc.VerifyPeerCertificate; existing != nil {
+		pinned := verify
+		verify = func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+			if err := pinned(rawCerts, chains); err != nil {
+				return err
+			}
+			return existing(rawCerts, chains)
+		}
+	}
+	tlsc.VerifyPeerCertificate = verify
+	if o.TLSPinningOnly {
+		tlsc.InsecureSkipVerify = true // VerifyPeerCertificate is still called
+	}
+	return tlsc
+}
+
+// pinnedFingerprintVerifier returns a function (for use as tls.Config.VerifyPeerCertificate) that fails
+// unless the SHA-256 fingerprint of the leaf certificate is one of fingerprints
+func pinnedFingerprintVerifier(fingerprints []string) func([][]byte, [][]*x509.Certificate) error {
+	pinned := make(map[string]bool, len(fingerprints))
+	for _, f := range fingerprints {
+		pinned[strings.ToLower(strings.Replace(f, ":", "", -1))] = true
+	}
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("no certificate presented by broker")
+		}
+		sum := sha256.Sum256(rawCerts[0])
+		if !pinned[hex.EncodeToString(sum[:])] {
+			return fmt.Errorf("broker certificate fingerprint %x does not match any pinned fingerprint", sum)
+		}
+		return nil
+	}
+}
+
+// tlsConfigWithServerName returns tlsc with ServerName set to serverName (unless serverName is empty in
+// which case tlsc is returned unchanged); the original configuration is not modified.
+func tlsConfigWithServerName(tlsc *tls.Config, serverName string) *tls.Config {
+	if serverName == "" {
+		return tlsc
+	}
+	if tlsc == nil {
+		return &tls.Config{ServerName: serverName}
+	}
+	tlsc = tlsc.Clone()
+	tlsc.ServerName = serverName
+	return tlsc
+}
+
+// httpProxyForBroker returns the HTTP proxy that should be used to connect to the broker (nil if the
+// connection should be direct). If httpProxy is nil then HTTP_PROXY, HTTPS_PROXY and NO_PROXY are checked
+func httpProxyForBroker(uri *url.URL, httpProxy *url.URL) (*url.URL, error) {
+	if httpProxy != nil {
+		return httpProxy, nil
+	}
+	scheme := "http"
+	switch uri.Scheme {
+	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps":
+		scheme = "https"
+	}
+	return http.ProxyFromEnvironment(&http.Request{URL: &url.URL{Scheme: scheme, Host: uri.Host}})
+}
+
+// dialHTTPProxy opens a connection to the HTTP proxy and issues a CONNECT request to establish
+// a tunnel to addr. Basic authentication is used if the proxy URL contains user information.
+func dialHTTPProxy(proxyURL *url.URL, addr string, timeout time.Duration) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		if proxyURL.Scheme == "https" {
+			proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "443")
+		} else {
+			proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "80")
+		}
+	}
+
+	var conn net.Conn
+	var err error
+	if proxyURL.Scheme == "https" {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", proxyAddr, nil)
+	} else {
+		conn, err = net.DialTimeout("tcp", proxyAddr, timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if timeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The broker will not send anything until we do so the reader cannot buffer data beyond the response
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy CONNECT to %s failed: %s", addr, resp.Status)
+	}
+	if timeout > 0 {
+		if err := conn.SetDeadline(time.Time{}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// websocketOptionsWithProxy returns the websocket options with the HTTP proxy applied (unless
+// a Proxy function has already been provided)
+func websocketOptionsWithProxy(options *WebsocketOptions, httpProxy *url.URL) *WebsocketOptions {
+	if httpProxy == nil || (options != nil && options.Proxy != nil) {
+		return options
+	}
+	o := WebsocketOptions{}
+	if options != nil {
+		o = *options
+	}
+	o.Proxy = http.ProxyURL(httpProxy)
+	return &o
 }
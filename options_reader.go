@@ -44,12 +44,78 @@ func (r *ClientOptionsReader) ResumeSubs() bool {
 	return s
 }
 
+//ReportOrphanPubrel returns true if a PUBREL for an unknown message is reported as an error
+func (r *ClientOptionsReader) ReportOrphanPubrel() bool {
+	s := r.options.ReportOrphanPubrel
+	return s
+}
+
+//QoSDowngradePolicy returns how a subscription granted a lower QoS than requested is handled
+func (r *ClientOptionsReader) QoSDowngradePolicy() QoSDowngradePolicy {
+	s := r.options.QoSDowngradePolicy
+	return s
+}
+
+//AutoAckDisabled returns true if messages must be acknowledged by calling Message.Ack()
+func (r *ClientOptionsReader) AutoAckDisabled() bool {
+	s := r.options.AutoAckDisabled
+	return s
+}
+
+//StrictOrderAcrossReconnect returns true if stored messages are processed before any live messages
+func (r *ClientOptionsReader) StrictOrderAcrossReconnect() bool {
+	s := r.options.StrictOrderAcrossReconnect
+	return s
+}
+
+//TLSServerName returns the server name used in the TLS handshake (if overridden)
+func (r *ClientOptionsReader) TLSServerName() string {
+	s := r.options.TLSServerName
+	return s
+}
+
+//DeferredSubscribe returns true if subscribing before the connection is up is enabled
+func (r *ClientOptionsReader) DeferredSubscribe() bool {
+	s := r.options.DeferredSubscribe
+	return s
+}
+
+//AlwaysResubscribeOnSessionAbsent returns true if subscriptions are resent when the session is lost
+func (r *ClientOptionsReader) AlwaysResubscribeOnSessionAbsent() bool {
+	s := r.options.AlwaysResubscribeOnSessionAbsent
+	return s
+}
+
+//PersistSubscriptions returns true if subscriptions are written to the store
+func (r *ClientOptionsReader) PersistSubscriptions() bool {
+	s := r.options.PersistSubscriptions
+	return s
+}
+
+//KeepOriginalTopic returns true if messages retain their original topic when rewritten
+func (r *ClientOptionsReader) KeepOriginalTopic() bool {
+	s := r.options.KeepOriginalTopic
+	return s
+}
+
+//ConnectionID returns the identifier used to prefix log lines
+func (r *ClientOptionsReader) ConnectionID() string {
+	s := r.options.ConnectionID
+	return s
+}
+
 //ClientID returns the set client id
 func (r *ClientOptionsReader) ClientID() string {
 	s := r.options.ClientID
 	return s
 }
 
+//TopicPrefix returns the prefix applied to all topics
+func (r *ClientOptionsReader) TopicPrefix() string {
+	s := r.options.TopicPrefix
+	return s
+}
+
 //Username returns the set username
 func (r *ClientOptionsReader) Username() string {
 	s := r.options.Username
@@ -68,11 +134,59 @@ func (r *ClientOptionsReader) CleanSession() bool {
 	return s
 }
 
+//SessionExpiryInterval returns the configured session expiry interval
+func (r *ClientOptionsReader) SessionExpiryInterval() time.Duration {
+	s := r.options.SessionExpiryInterval
+	return s
+}
+
 func (r *ClientOptionsReader) Order() bool {
 	s := r.options.Order
 	return s
 }
 
+//DrainOnDisconnect returns true if Disconnect waits for received messages to be handled
+func (r *ClientOptionsReader) DrainOnDisconnect() bool {
+	s := r.options.DrainOnDisconnect
+	return s
+}
+
+//MaxPacketSize returns the largest packet that will be accepted from the broker (0 if unlimited)
+func (r *ClientOptionsReader) MaxPacketSize() int {
+	s := r.options.MaxPacketSize
+	return s
+}
+
+//ReceiveMaximum returns the maximum number of QoS 1/2 messages handled concurrently (0 if unlimited)
+func (r *ClientOptionsReader) ReceiveMaximum() uint16 {
+	s := r.options.ReceiveMaximum
+	return s
+}
+
+//AppHeartbeatTopic returns the topic to which application heartbeats are published ("" if disabled)
+func (r *ClientOptionsReader) AppHeartbeatTopic() string {
+	s := r.options.AppHeartbeatTopic
+	return s
+}
+
+//AppHeartbeatInterval returns the interval between application heartbeats
+func (r *ClientOptionsReader) AppHeartbeatInterval() time.Duration {
+	s := r.options.AppHeartbeatInterval
+	return s
+}
+
+//MaxInflight returns the maximum number of QoS 1/2 publishes awaiting acknowledgement (0 if unlimited)
+func (r *ClientOptionsReader) MaxInflight() int {
+	s := r.options.MaxInflight
+	return s
+}
+
+//MaxSubscribeBatch returns the maximum number of topic filters per SUBSCRIBE packet (0 if unlimited)
+func (r *ClientOptionsReader) MaxSubscribeBatch() int {
+	s := r.options.MaxSubscribeBatch
+	return s
+}
+
 func (r *ClientOptionsReader) WillEnabled() bool {
 	s := r.options.WillEnabled
 	return s
@@ -98,6 +212,24 @@ func (r *ClientOptionsReader) WillRetained() bool {
 	return s
 }
 
+//WillDelayInterval returns the MQTT 5 will delay interval (not sent with MQTT 3.1/3.1.1)
+func (r *ClientOptionsReader) WillDelayInterval() time.Duration {
+	s := r.options.WillDelayInterval
+	return s
+}
+
+//WillPayloadUTF8 returns the MQTT 5 will payload format indicator (not sent with MQTT 3.1/3.1.1)
+func (r *ClientOptionsReader) WillPayloadUTF8() bool {
+	s := r.options.WillPayloadUTF8
+	return s
+}
+
+//WillContentType returns the MQTT 5 will content type (not sent with MQTT 3.1/3.1.1)
+func (r *ClientOptionsReader) WillContentType() string {
+	s := r.options.WillContentType
+	return s
+}
+
 func (r *ClientOptionsReader) ProtocolVersion() uint {
 	s := r.options.ProtocolVersion
 	return s
@@ -145,6 +277,24 @@ func (r *ClientOptionsReader) ConnectRetry() bool {
 	return s
 }
 
+//MaxInitialConnectAttempts returns the maximum number of initial connection attempts (0 if unlimited)
+func (r *ClientOptionsReader) MaxInitialConnectAttempts() int {
+	s := r.options.MaxInitialConnectAttempts
+	return s
+}
+
+//FailFastOnDNSError returns true if the initial connection is not retried when broker host names do not exist
+func (r *ClientOptionsReader) FailFastOnDNSError() bool {
+	s := r.options.FailFastOnDNSError
+	return s
+}
+
+//MaxReconnectAttempts returns the maximum number of consecutive reconnection attempts (0 if unlimited)
+func (r *ClientOptionsReader) MaxReconnectAttempts() int {
+	s := r.options.MaxReconnectAttempts
+	return s
+}
+
 func (r *ClientOptionsReader) WriteTimeout() time.Duration {
 	s := r.options.WriteTimeout
 	return s
@@ -165,3 +315,55 @@ func (r *ClientOptionsReader) WebsocketOptions() *WebsocketOptions {
 	s := r.options.WebsocketOptions
 	return s
 }
+
+// HTTPProxy returns the configured HTTP proxy (nil if none has been set)
+func (r *ClientOptionsReader) HTTPProxy() *url.URL {
+	if r.options.HTTPProxy == nil {
+		return nil
+	}
+	u := *r.options.HTTPProxy
+	return &u
+}
+
+// CoalesceTopics returns the topic filters for which QoS 0 publishes are coalesced
+func (r *ClientOptionsReader) CoalesceTopics() []string {
+	s := make([]string, len(r.options.CoalesceTopics))
+	copy(s, r.options.CoalesceTopics)
+	return s
+}
+
+//SubscriptionStats returns whether per subscription statistics are collected
+func (r *ClientOptionsReader) SubscriptionStats() bool {
+	s := r.options.SubscriptionStats
+	return s
+}
+
+//DNSCacheTTL returns how long resolved broker addresses are cached (0 if caching is disabled)
+func (r *ClientOptionsReader) DNSCacheTTL() time.Duration {
+	s := r.options.DNSCacheTTL
+	return s
+}
+
+//DialFallbackDelay returns the delay before the other address family is tried when dialing a broker
+func (r *ClientOptionsReader) DialFallbackDelay() time.Duration {
+	s := r.options.DialFallbackDelay
+	return s
+}
+
+//QoS0ConfirmWrite returns true if QoS 0 publish tokens complete only once the packet has been written
+func (r *ClientOptionsReader) QoS0ConfirmWrite() bool {
+	s := r.options.QoS0ConfirmWrite
+	return s
+}
+
+//WriteRetries returns the number of times a transient write error will be retried (0 if disabled)
+func (r *ClientOptionsReader) WriteRetries() int {
+	s := r.options.WriteRetries
+	return s
+}
+
+//WriteBufferSize returns the size of the buffer used for outgoing packets (0 if not buffered)
+func (r *ClientOptionsReader) WriteBufferSize() int {
+	s := r.options.WriteBufferSize
+	return s
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright (c) 2013 IBM Corp.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ *
+ * Contributors:
+ *    Seth Hoenig
+ *    Allan Stockdill-Mander
+ *    Mike Robertson
+ */
+
+package mqtt
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// ownRetainedWindow is how long after publishing a retained message that a matching inbound message
+// (same topic and payload) will be treated as our own message coming back from the broker
+const ownRetainedWindow = 5 * time.Second
+
+// ownRetained keeps track of retained messages recently published by the client so that, when
+// SuppressOwnRetained is set, they are not passed to our own handlers. MQTT 3.1.1 has no NoLocal
+// subscription option so this is a best-effort, client side, workaround.
+type ownRetained struct {
+	sync.Mutex
+	recent map[string]time.Time // key (see ownRetainedKey) -> time published
+}
+
+func newOwnRetained() *ownRetained {
+	return &ownRetained{recent: make(map[string]time.Time)}
+}
+
+// ownRetainedKey returns the key used to correlate messages (the topic and a hash of the payload)
+func ownRetainedKey(topic string, payload []byte) string {
+	h := fnv.New64a()
+	h.Write(payload)
+	return topic + "\x00" + string(h.Sum(nil))
+}
+
+// record notes that a retained message has been published (discarding any expired records)
+func (o *ownRetained) record(topic string, payload []byte) {
+	now := time.Now()
+	o.Lock()
+	defer o.Unlock()
+	for k, t := range o.recent {
+		if now.Sub(t) > ownRetainedWindow {
+			delete(o.recent, k)
+		}
+	}
+	o.recent[ownRetainedKey(topic, payload)] = now
+}
+
+// match returns true (and forgets the record) if the message matches a retained message that we
+// published within ownRetainedWindow
+func (o *ownRetained) match(topic string, payload []byte) bool {
+	key := ownRetainedKey(topic, payload)
+	o.Lock()
+	defer o.Unlock()
+	t, ok := o.recent[key]
+	if !ok {
+		return false
+	}
+	delete(o.recent, key)
+	return time.Since(t) <= ownRetainedWindow
+}
@@ -4,10 +4,47 @@ import (
 	"io"
 )
 
+//DisconnectReasonCodes is a map of the MQTT 5 DISCONNECT reason codes to a
+//string representation of the reason (MQTT 3.1.1 servers never send DISCONNECT
+//but MQTT 5 servers may do so before closing the connection)
+var DisconnectReasonCodes = map[byte]string{
+	0x00: "Normal disconnection",
+	0x80: "Unspecified error",
+	0x81: "Malformed Packet",
+	0x82: "Protocol Error",
+	0x83: "Implementation specific error",
+	0x87: "Not authorized",
+	0x89: "Server busy",
+	0x8B: "Server shutting down",
+	0x8D: "Keep Alive timeout",
+	0x8E: "Session taken over",
+	0x8F: "Topic Filter invalid",
+	0x90: "Topic Name invalid",
+	0x93: "Receive Maximum exceeded",
+	0x94: "Topic Alias invalid",
+	0x95: "Packet too large",
+	0x96: "Message rate too high",
+	0x97: "Quota exceeded",
+	0x98: "Administrative action",
+	0x99: "Payload format invalid",
+	0x9A: "Retain not supported",
+	0x9B: "QoS not supported",
+	0x9C: "Use another server",
+	0x9D: "Server moved",
+	0x9E: "Shared Subscriptions not supported",
+	0x9F: "Connection rate exceeded",
+	0xA0: "Maximum connect time",
+	0xA1: "Subscription Identifiers not supported",
+	0xA2: "Wildcard Subscriptions not supported",
+}
+
 //DisconnectPacket is an internal representation of the fields of the
-//Disconnect MQTT packet
+//Disconnect MQTT packet. ReasonCode is only set when the packet is received
+//from an MQTT 5 server (it is not written as MQTT 3.1.1 has no reason code);
+//any properties that follow it are ignored.
 type DisconnectPacket struct {
 	FixedHeader
+	ReasonCode byte
 }
 
 func (d *DisconnectPacket) String() string {
@@ -24,7 +61,12 @@ func (d *DisconnectPacket) Write(w io.Writer) error {
 //Unpack decodes the details of a ControlPacket after the fixed
 //header has been read
 func (d *DisconnectPacket) Unpack(b io.Reader) error {
-	return nil
+	if d.RemainingLength == 0 {
+		return nil // no reason code means a normal disconnection
+	}
+	var err error
+	d.ReasonCode, err = decodeByte(b)
+	return err
 }
 
 //Details returns a Details struct containing the Qos and
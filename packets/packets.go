@@ -99,6 +99,21 @@ var ConnErrors = map[byte]error{
 //representing the decoded MQTT packet and an error. One of these returns will
 //always be nil, a nil ControlPacket indicating an error occurred.
 func ReadPacket(r io.Reader) (ControlPacket, error) {
+	return readPacket(r, 0)
+}
+
+//ReadPacketWithLimit reads a packet as per ReadPacket but, if the remaining
+//length in the fixed header exceeds max (and max is not 0), returns a
+//*PacketTooLargeError before allocating a buffer for (or reading) the rest of
+//the packet. This prevents a corrupt or malicious length header causing an
+//allocation of up to 256MB.
+func ReadPacketWithLimit(r io.Reader, max int) (ControlPacket, error) {
+	return readPacket(r, max)
+}
+
+//readPacket implements ReadPacket, rejecting packets with a remaining length
+//greater than max (if it is not 0)
+func readPacket(r io.Reader, max int) (ControlPacket, error) {
 	var fh FixedHeader
 	b := make([]byte, 1)
 
@@ -111,6 +126,9 @@ func ReadPacket(r io.Reader) (ControlPacket, error) {
 	if err != nil {
 		return nil, err
 	}
+	if max > 0 && fh.RemainingLength > max {
+		return nil, &PacketTooLargeError{Size: fh.RemainingLength, Max: max}
+	}
 
 	cp, err := NewControlPacketWithHeader(fh)
 	if err != nil {
@@ -130,6 +148,28 @@ func ReadPacket(r io.Reader) (ControlPacket, error) {
 	return cp, err
 }
 
+//Decode reads a single MQTT packet from r and returns it decoded. It is
+//equivalent to ReadPacket and is provided, along with Encode, for tools that
+//use this package standalone (e.g. to inspect captured traffic). On error the
+//returned ControlPacket is nil unless the fixed header was read but the body
+//could not be decoded, in which case the partially decoded packet is returned.
+func Decode(r io.Reader) (ControlPacket, error) {
+	return ReadPacket(r)
+}
+
+//Encode returns the MQTT wire format of the packet p (the fixed header,
+//including the remaining length, followed by the variable header and payload).
+func Encode(p ControlPacket) ([]byte, error) {
+	if p == nil {
+		return nil, errors.New("nil packet")
+	}
+	var b bytes.Buffer
+	if err := p.Write(&b); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
 //NewControlPacket is used to create a new ControlPacket of the type specified
 //by packetType, this is usually done by reference to the packet type constants
 //defined in packets.go. The newly created ControlPacket is empty and a pointer
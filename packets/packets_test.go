@@ -2,6 +2,9 @@ package packets
 
 import (
 	"bytes"
+	"errors"
+	"io"
+	"reflect"
 	"testing"
 )
 
@@ -235,3 +238,233 @@ func TestEncoding(t *testing.T) {
 		}
 	}
 }
+
+func TestDisconnectReasonCode(t *testing.T) {
+	// MQTT 5 DISCONNECT with reason code 0x8E (session taken over) and an empty property set
+	read, err := ReadPacket(bytes.NewBuffer([]byte{0xE0, 0x02, 0x8E, 0x00}))
+	if err != nil {
+		t.Fatalf("Read of disconnect returned error: %s", err)
+	}
+	d, ok := read.(*DisconnectPacket)
+	if !ok {
+		t.Fatalf("expected *DisconnectPacket, got %T", read)
+	}
+	if d.ReasonCode != 0x8E {
+		t.Errorf("ReasonCode is %#x, should be 0x8E", d.ReasonCode)
+	}
+	if DisconnectReasonCodes[d.ReasonCode] != "Session taken over" {
+		t.Errorf("unexpected reason %q", DisconnectReasonCodes[d.ReasonCode])
+	}
+}
+
+func TestPublishPayloadReader(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), 1000)
+	p := NewControlPacket(Publish).(*PublishPacket)
+	p.TopicName = "a/b"
+	p.Qos = 1
+	p.MessageID = 7
+	p.PayloadReader = bytes.NewReader(payload)
+	p.PayloadSize = int64(len(payload))
+
+	buf := new(bytes.Buffer)
+	if err := p.Write(buf); err != nil {
+		t.Fatalf("Write returned error: %s", err)
+	}
+	read, err := ReadPacket(buf)
+	if err != nil {
+		t.Fatalf("Read returned error: %s", err)
+	}
+	rp := read.(*PublishPacket)
+	if rp.TopicName != "a/b" || rp.MessageID != 7 || !bytes.Equal(rp.Payload, payload) {
+		t.Errorf("Read of streamed publish did not match, got %v", rp)
+	}
+
+	// A reader that is too short must be reported
+	p.PayloadReader = bytes.NewReader(payload[:10])
+	if err := p.Write(new(bytes.Buffer)); err == nil {
+		t.Errorf("expected an error when the reader is short")
+	}
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	connect := NewControlPacket(Connect).(*ConnectPacket)
+	connect.ProtocolName = "MQTT"
+	connect.ProtocolVersion = 4
+	connect.CleanSession = true
+	connect.WillFlag = true
+	connect.WillQos = 1
+	connect.WillTopic = "will/topic"
+	connect.WillMessage = []byte("gone")
+	connect.UsernameFlag = true
+	connect.Username = "user"
+	connect.PasswordFlag = true
+	connect.Password = []byte("pass")
+	connect.Keepalive = 30
+	connect.ClientIdentifier = "client"
+
+	connack := NewControlPacket(Connack).(*ConnackPacket)
+	connack.SessionPresent = true
+
+	publish := NewControlPacket(Publish).(*PublishPacket)
+	publish.Qos = 1
+	publish.Retain = true
+	publish.TopicName = "a/b"
+	publish.MessageID = 7
+	publish.Payload = []byte("payload")
+
+	puback := NewControlPacket(Puback).(*PubackPacket)
+	puback.MessageID = 7
+	pubrec := NewControlPacket(Pubrec).(*PubrecPacket)
+	pubrec.MessageID = 8
+	pubrel := NewControlPacket(Pubrel).(*PubrelPacket)
+	pubrel.MessageID = 8
+	pubcomp := NewControlPacket(Pubcomp).(*PubcompPacket)
+	pubcomp.MessageID = 8
+
+	subscribe := NewControlPacket(Subscribe).(*SubscribePacket)
+	subscribe.MessageID = 9
+	subscribe.Topics = []string{"a/#", "b/+"}
+	subscribe.Qoss = []byte{1, 2}
+	suback := NewControlPacket(Suback).(*SubackPacket)
+	suback.MessageID = 9
+	suback.ReturnCodes = []byte{1, 0x80}
+
+	unsubscribe := NewControlPacket(Unsubscribe).(*UnsubscribePacket)
+	unsubscribe.MessageID = 10
+	unsubscribe.Topics = []string{"a/#"}
+	unsuback := NewControlPacket(Unsuback).(*UnsubackPacket)
+	unsuback.MessageID = 10
+
+	for _, packet := range []ControlPacket{
+		connect, connack, publish, puback, pubrec, pubrel, pubcomp, subscribe, suback, unsubscribe, unsuback,
+		NewControlPacket(Pingreq), NewControlPacket(Pingresp), NewControlPacket(Disconnect),
+	} {
+		encoded, err := Encode(packet)
+		if err != nil {
+			t.Fatalf("Encode of %T returned error: %s", packet, err)
+		}
+		decoded, err := Decode(bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatalf("Decode of %T returned error: %s", packet, err)
+		}
+		if reflect.TypeOf(decoded) != reflect.TypeOf(packet) {
+			t.Fatalf("Decode of %T returned %T", packet, decoded)
+		}
+		if decoded.String() != packet.String() || decoded.Details() != packet.Details() {
+			t.Errorf("Decode of %T did not equal original.\nExpected: %v\n     Got: %v", packet, packet, decoded)
+		}
+		reencoded, err := Encode(decoded)
+		if err != nil {
+			t.Fatalf("Encode of decoded %T returned error: %s", packet, err)
+		}
+		if !bytes.Equal(reencoded, encoded) {
+			t.Errorf("%T did not round trip.\nExpected: %X\n     Got: %X", packet, encoded, reencoded)
+		}
+	}
+
+	if _, err := Encode(nil); err == nil {
+		t.Errorf("Encode(nil) should return an error")
+	}
+	if _, err := Decode(bytes.NewReader([]byte{0x30, 0x05, 0x00})); err == nil {
+		t.Errorf("Decode of a truncated packet should return an error")
+	}
+}
+
+// countingReader counts the calls to Read
+type countingReader struct {
+	r     io.Reader
+	reads int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	c.reads++
+	return c.r.Read(p)
+}
+
+// publishStream returns n encoded QoS 1 publish packets
+func publishStream(n int) []byte {
+	var buf bytes.Buffer
+	for i := 0; i < n; i++ {
+		p := NewControlPacket(Publish).(*PublishPacket)
+		p.Qos = 1
+		p.TopicName = "a/b"
+		p.MessageID = uint16(i + 1)
+		p.Payload = []byte("payload")
+		p.Write(&buf)
+	}
+	return buf.Bytes()
+}
+
+func TestPacketReader(t *testing.T) {
+	const n = 100
+	stream := publishStream(n)
+
+	direct := &countingReader{r: bytes.NewReader(stream)}
+	for i := 0; i < n; i++ {
+		if _, err := ReadPacket(direct); err != nil {
+			t.Fatalf("ReadPacket returned error: %s", err)
+		}
+	}
+
+	buffered := &countingReader{r: bytes.NewReader(stream)}
+	pr := NewReader(buffered)
+	for i := 0; i < n; i++ {
+		cp, err := pr.ReadPacket()
+		if err != nil {
+			t.Fatalf("PacketReader.ReadPacket returned error: %s", err)
+		}
+		if id := cp.Details().MessageID; id != uint16(i+1) {
+			t.Fatalf("expected message ID %d, got %d", i+1, id)
+		}
+	}
+	if _, err := pr.ReadPacket(); err != io.EOF {
+		t.Fatalf("expected io.EOF at the end of the stream, got %v", err)
+	}
+	if buffered.reads >= direct.reads/10 {
+		t.Errorf("expected far fewer reads when buffered: %d buffered, %d direct", buffered.reads, direct.reads)
+	}
+}
+
+func TestPacketReaderMaxPacketSize(t *testing.T) {
+	// a fixed header claiming a remaining length of 268435455 bytes
+	pr := NewReader(bytes.NewReader([]byte{0x30, 0xFF, 0xFF, 0xFF, 0x7F})).SetMaxPacketSize(1024)
+	_, err := pr.ReadPacket()
+	var tooLarge *PacketTooLargeError
+	if !errors.As(err, &tooLarge) || tooLarge.Size != 268435455 || tooLarge.Max != 1024 {
+		t.Fatalf("expected a PacketTooLargeError, got %v", err)
+	}
+
+	if _, err := ReadPacketWithLimit(bytes.NewReader([]byte{0x30, 0xFF, 0xFF, 0xFF, 0x7F}), 1024); !errors.As(err, &tooLarge) {
+		t.Fatalf("expected a PacketTooLargeError from ReadPacketWithLimit, got %v", err)
+	}
+
+	pr = NewReader(bytes.NewReader(publishStream(1))).SetMaxPacketSize(1024)
+	if _, err := pr.ReadPacket(); err != nil {
+		t.Fatalf("packet within the limit returned error: %s", err)
+	}
+}
+
+func BenchmarkReadPacket(b *testing.B) {
+	stream := publishStream(b.N)
+	r := &countingReader{r: bytes.NewReader(stream)}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ReadPacket(r); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(r.reads)/float64(b.N), "reads/op")
+}
+
+func BenchmarkPacketReader(b *testing.B) {
+	stream := publishStream(b.N)
+	r := &countingReader{r: bytes.NewReader(stream)}
+	pr := NewReader(r)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := pr.ReadPacket(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(r.reads)/float64(b.N), "reads/op")
+}
@@ -13,6 +13,12 @@ type PublishPacket struct {
 	TopicName string
 	MessageID uint16
 	Payload   []byte
+
+	// PayloadReader, if set, is read (PayloadSize bytes) when the packet is written
+	// instead of using Payload; this avoids holding large payloads in memory. The
+	// packet can only be written once.
+	PayloadReader io.Reader
+	PayloadSize   int64
 }
 
 func (p *PublishPacket) String() string {
@@ -27,6 +33,9 @@ func (p *PublishPacket) Write(w io.Writer) error {
 	if p.Qos > 0 {
 		body.Write(encodeUint16(p.MessageID))
 	}
+	if p.PayloadReader != nil {
+		return p.writeStreamed(w, body.Bytes())
+	}
 	p.FixedHeader.RemainingLength = body.Len() + len(p.Payload)
 	packet := p.FixedHeader.pack()
 	packet.Write(body.Bytes())
@@ -36,6 +45,22 @@ func (p *PublishPacket) Write(w io.Writer) error {
 	return err
 }
 
+//writeStreamed writes the headers followed by the payload copied directly
+//from PayloadReader
+func (p *PublishPacket) writeStreamed(w io.Writer, variableHeader []byte) error {
+	p.FixedHeader.RemainingLength = len(variableHeader) + int(p.PayloadSize)
+	packet := p.FixedHeader.pack()
+	packet.Write(variableHeader)
+	if _, err := w.Write(packet.Bytes()); err != nil {
+		return err
+	}
+	n, err := io.CopyN(w, p.PayloadReader, p.PayloadSize)
+	if err != nil && n < p.PayloadSize {
+		return fmt.Errorf("error writing publish, payload reader returned %d of %d bytes: %w", n, p.PayloadSize, err)
+	}
+	return nil
+}
+
 //Unpack decodes the details of a ControlPacket after the fixed
 //header has been read
 func (p *PublishPacket) Unpack(b io.Reader) error {
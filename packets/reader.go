@@ -0,0 +1,53 @@
+package packets
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// PacketTooLargeError is returned by PacketReader.ReadPacket when the
+// remaining length in a packet's fixed header exceeds the maximum packet size
+type PacketTooLargeError struct {
+	Size int //the remaining length from the fixed header
+	Max  int //the maximum permitted
+}
+
+func (e *PacketTooLargeError) Error() string {
+	return fmt.Sprintf("packet too large: remaining length %d exceeds maximum %d", e.Size, e.Max)
+}
+
+// PacketReader reads MQTT packets from a buffered stream, avoiding the many
+// small reads made when ReadPacket is called on an unbuffered io.Reader (such
+// as a net.Conn). It is not safe for concurrent use.
+type PacketReader struct {
+	r   *bufio.Reader
+	max int
+}
+
+// NewReader returns a PacketReader that reads packets from r via a
+// bufio.Reader (if r is already a *bufio.Reader it is used directly).
+func NewReader(r io.Reader) *PacketReader {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &PacketReader{r: br}
+}
+
+// SetMaxPacketSize sets the maximum remaining length (the size of the packet
+// excluding the fixed header) that will be accepted; 0, the default, means no
+// limit other than that imposed by the protocol. Setting a limit protects
+// against a malicious length header causing a large allocation.
+func (pr *PacketReader) SetMaxPacketSize(max int) *PacketReader {
+	pr.max = max
+	return pr
+}
+
+// ReadPacket reads and decodes the next packet from the stream (see
+// ReadPacket). If the packet exceeds the maximum size a *PacketTooLargeError
+// is returned without the packet's body being read, so the stream is no longer
+// positioned at the start of a packet and should be closed.
+func (pr *PacketReader) ReadPacket() (ControlPacket, error) {
+	return readPacket(pr.r, pr.max)
+}
@@ -16,7 +16,6 @@ package mqtt
 
 import (
 	"errors"
-	"io"
 	"sync/atomic"
 	"time"
 
@@ -24,17 +23,28 @@ import (
 )
 
 // keepalive - Send ping when connection unused for set period
-// connection passed in to avoid race condition on shutdown
-func keepalive(c *client, conn io.Writer) {
+// The PINGREQ is sent via c.oboundP so that it is written by the outgoing comms routine (writing
+// directly to the connection could interleave it with a packet that is part way through being sent)
+// A KeepAlive of 0 (or less) disables the keepalive so no PINGREQ is ever sent
+func keepalive(c *client) {
 	defer c.workers.Done()
-	DEBUG.Println(PNG, "keepalive starting")
+	keepAlive := int64(connectKeepAlive(&c.options)) // as sent to the broker
+	if keepAlive == 0 {
+		c.logs.DEBUG.Println(PNG, "keepalive disabled")
+		return
+	}
+	c.logs.DEBUG.Println(PNG, "keepalive starting")
 	var checkInterval int64
 	var pingSent time.Time
+	var missed int // keepalive checks made whilst the PINGRESP is outstanding
 
-	if c.options.KeepAlive > 10 {
+	if keepAlive > 10 {
 		checkInterval = 5
 	} else {
-		checkInterval = c.options.KeepAlive / 2
+		checkInterval = keepAlive / 2
+	}
+	if checkInterval < 1 {
+		checkInterval = 1 // a keepalive of 1 second would otherwise result in an invalid ticker interval
 	}
 
 	intervalTicker := time.NewTicker(time.Duration(checkInterval * int64(time.Second)))
@@ -43,31 +53,66 @@ func keepalive(c *client, conn io.Writer) {
 	for {
 		select {
 		case <-c.stop:
-			DEBUG.Println(PNG, "keepalive stopped")
+			c.logs.DEBUG.Println(PNG, "keepalive stopped")
 			return
 		case <-intervalTicker.C:
 			lastSent := c.lastSent.Load().(time.Time)
 			lastReceived := c.lastReceived.Load().(time.Time)
 
-			DEBUG.Println(PNG, "ping check", time.Since(lastSent).Seconds())
-			if time.Since(lastSent) >= time.Duration(c.options.KeepAlive*int64(time.Second)) || time.Since(lastReceived) >= time.Duration(c.options.KeepAlive*int64(time.Second)) {
+			c.logs.DEBUG.Println(PNG, "ping check", time.Since(lastSent).Seconds())
+			if time.Since(lastSent) >= time.Duration(keepAlive*int64(time.Second)) || time.Since(lastReceived) >= time.Duration(keepAlive*int64(time.Second)) {
 				if atomic.LoadInt32(&c.pingOutstanding) == 0 {
-					DEBUG.Println(PNG, "keepalive sending ping")
+					c.logs.DEBUG.Println(PNG, "keepalive sending ping")
 					ping := packets.NewControlPacket(packets.Pingreq).(*packets.PingreqPacket)
-					//We don't want to wait behind large messages being sent, the Write call
-					//will block until it it able to send the packet.
+					c.pingSentAt.Store(time.Now())
 					atomic.StoreInt32(&c.pingOutstanding, 1)
-					if err := ping.Write(conn); err != nil {
-						ERROR.Println(PNG, err)
+					select {
+					case c.oboundP <- &PacketAndToken{p: ping, t: nil}:
+					case <-c.stop:
+						c.logs.DEBUG.Println(PNG, "keepalive stopped")
+						return
 					}
-					c.lastSent.Store(time.Now())
 					pingSent = time.Now()
+					missed = -1 // this check does not count
+				}
+			}
+			if atomic.LoadInt32(&c.pingOutstanding) > 0 {
+				if time.Since(pingSent) >= c.options.PingTimeout {
+					c.logs.CRITICAL.Println(PNG, "pingresp not received, disconnecting")
+					go c.internalConnLost(errors.New("pingresp not received, disconnecting")) // no harm in calling this if the connection is already down (better than stopping!)
+					return
 				}
+				if missed++; missed > 0 {
+					c.logs.WARN.Println(PNG, "pingresp not yet received, checks missed:", missed)
+					if c.options.PingMissedHandler != nil {
+						go c.options.PingMissedHandler(missed)
+					}
+				}
+			}
+		}
+	}
+}
+
+// appHeartbeat publishes the application heartbeat (see SetAppHeartbeat) every interval until
+// c.stop is closed. TryPublish is used as publishing must not block (this is a worker so stopping
+// the comms waits for it to exit)
+func appHeartbeat(c *client) {
+	defer c.workers.Done()
+	c.logs.DEBUG.Println(PNG, "application heartbeat starting")
+	ticker := time.NewTicker(c.options.AppHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			c.logs.DEBUG.Println(PNG, "application heartbeat stopped")
+			return
+		case <-ticker.C:
+			var payload []byte
+			if c.options.AppHeartbeatPayload != nil {
+				payload = c.options.AppHeartbeatPayload()
 			}
-			if atomic.LoadInt32(&c.pingOutstanding) > 0 && time.Since(pingSent) >= c.options.PingTimeout {
-				CRITICAL.Println(PNG, "pingresp not received, disconnecting")
-				go c.internalConnLost(errors.New("pingresp not received, disconnecting")) // no harm in calling this if the connection is already down (better than stopping!)
-				return
+			if token, ok := c.TryPublish(c.options.AppHeartbeatTopic, c.options.AppHeartbeatQos, false, payload); !ok {
+				c.logs.WARN.Println(PNG, "application heartbeat not published:", token.Error())
 			}
 		}
 	}
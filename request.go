@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) 2013 IBM Corp.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ *
+ * Contributors:
+ *    Seth Hoenig
+ *    Allan Stockdill-Mander
+ *    Mike Robertson
+ */
+
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNotRequest is returned by DecodeRequest when the payload was not encoded by Request
+var ErrNotRequest = errors.New("payload is not a request")
+
+// ErrInvalidResponseTopic is returned by Request when the response topic contains a newline
+var ErrInvalidResponseTopic = errors.New("invalid response topic; must not contain a newline")
+
+// MQTT 3.1.1 has no Response Topic or Correlation Data properties, so Request uses the following
+// convention: a correlation ID is appended to the response topic (i.e. responseTopic/<ID>) and the
+// request payload is prefixed by this topic followed by a newline. The responder (see DecodeRequest)
+// publishes its response to that topic, so the correlation ID identifies the response.
+
+// newCorrelationID returns an ID, unique to a request, made up of 128 random bits followed by the
+// client's request sequence number (so IDs from one client cannot collide even if the source of
+// random bytes is poor)
+func (c *client) newCorrelationID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(randReader, b); err != nil {
+		return "", fmt.Errorf("generating request correlation ID: %w", err)
+	}
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(b), atomic.AddUint64(&c.requestSeq, 1)), nil
+}
+
+// encodeRequest prefixes payload with the topic to which the response should be published
+func encodeRequest(replyTopic string, payload []byte) []byte {
+	b := make([]byte, 0, len(replyTopic)+1+len(payload))
+	b = append(b, replyTopic...)
+	b = append(b, '\n')
+	return append(b, payload...)
+}
+
+// DecodeRequest splits the payload of a message published by Request into the topic to which the
+// response should be published and the payload of the request
+func DecodeRequest(payload []byte) (replyTopic string, body []byte, err error) {
+	i := bytes.IndexByte(payload, '\n')
+	if i <= 0 {
+		return "", nil, ErrNotRequest
+	}
+	return string(payload[:i]), payload[i+1:], nil
+}
+
+// Request publishes payload to requestTopic and waits for the response, which is returned. The
+// response is received on a subscription (made for the duration of the request) to a topic
+// beneath responseTopic that is unique to this request; see DecodeRequest for how the responder
+// finds this topic. An error is returned if ctx is done, or timeout (if non-zero) passes, before
+// the response is received (or if no random bytes are available for the correlation ID).
+// responseTopic must not contain wildcards or newlines.
+func (c *client) Request(ctx context.Context, requestTopic string, qos byte, payload []byte, responseTopic string, timeout time.Duration) (Message, error) {
+	if strings.Contains(responseTopic, "\n") {
+		return nil, ErrInvalidResponseTopic
+	}
+	id, err := c.newCorrelationID()
+	if err != nil {
+		return nil, err
+	}
+	replyTopic := responseTopic + "/" + id
+	if err := validatePublishTopic(replyTopic); err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	responses := make(chan Message, 1)
+	token := c.Subscribe(replyTopic, qos, func(_ Client, m Message) {
+		select {
+		case responses <- m:
+		default: // only the first response is of interest
+		}
+	})
+	defer c.Unsubscribe(replyTopic)
+	if err := token.WaitContext(ctx); err != nil {
+		return nil, err
+	}
+	if err := c.PublishWithContext(ctx, requestTopic, qos, false, encodeRequest(replyTopic, payload)).WaitContext(ctx); err != nil {
+		return nil, err
+	}
+	select {
+	case m := <-responses:
+		return m, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
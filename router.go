@@ -16,9 +16,12 @@ package mqtt
 
 import (
 	"container/list"
+	"fmt"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/90poe/paho.mqtt.golang/packets"
 )
@@ -55,8 +58,14 @@ func match(route []string, topic []string) bool {
 	return false
 }
 
+// routeIncludesTopic returns true if route matches topic. As per the spec, topics beginning with
+// $ (e.g. $SYS/...) are not matched by a route that begins with a wildcard
 func routeIncludesTopic(route, topic string) bool {
-	return match(routeSplit(route), strings.Split(topic, "/"))
+	levels := routeSplit(route)
+	if strings.HasPrefix(topic, "$") && len(levels) > 0 && (levels[0] == "#" || levels[0] == "+") {
+		return false
+	}
+	return match(levels, strings.Split(topic, "/"))
 }
 
 // removes $share and sharename when splitting the route to allow
@@ -71,6 +80,18 @@ func routeSplit(route string) []string {
 	return result
 }
 
+// routeTopic returns the topic that a route for the subscription filter should match (the
+// broker will not include the $share/group/ or $queue/ prefixes in the topic of messages)
+func routeTopic(filter string) string {
+	if strings.HasPrefix(filter, "$share/") {
+		filter = strings.Join(strings.Split(filter, "/")[2:], "/")
+	}
+	if strings.HasPrefix(filter, "$queue/") {
+		filter = strings.TrimPrefix(filter, "$queue/")
+	}
+	return filter
+}
+
 // match takes the topic string of the published message and does a basic compare to the
 // string of the current Route, if they match it returns true
 func (r *route) match(topic string) bool {
@@ -82,15 +103,101 @@ type router struct {
 	routes         *list.List
 	defaultHandler MessageHandler
 	messages       chan *packets.PublishPacket
+	inflight       chan struct{}    // limits concurrent handling of messages (nil if unlimited)
+	qos2Waiting    map[uint16]bool  // QoS 2 messages whose handlers are waiting for an inflight slot (see deferQoS2)
+	observers      []MessageHandler // called for every message (in the order added)
+	handlers       sync.WaitGroup   // handler goroutines started by runHandlers (when order does not matter)
+	active         int32            // number of handler goroutines currently running (accessed atomically)
+	gate           dispatchGate     // allows dispatch to be stopped (see client.StopDispatch)
+}
+
+// dispatchGate holds back the dispatch of messages to handlers whilst stopped
+type dispatchGate struct {
+	mu       sync.Mutex
+	stopped  bool
+	resuming bool     // start is dispatching the held messages
+	held     []func() // dispatches deferred whilst stopped (in the order received)
+}
+
+// hold defers fn until start is called (returning true) if dispatch is stopped; otherwise it returns false
+func (g *dispatchGate) hold(fn func()) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.stopped && !g.resuming {
+		return false
+	}
+	g.held = append(g.held, fn)
+	return true
+}
+
+// run calls fn unless dispatch is stopped, in which case it is held until start is called
+func (g *dispatchGate) run(fn func()) {
+	if !g.hold(fn) {
+		fn()
+	}
+}
+
+func (g *dispatchGate) stop() {
+	g.mu.Lock()
+	g.stopped = true
+	g.mu.Unlock()
+}
+
+// start calls the held functions, in order, before allowing dispatch to continue. Anything arriving
+// whilst this is in progress is held (and so is dispatched in order); if stop is called in the meantime
+// the remaining functions stay held.
+func (g *dispatchGate) start() {
+	g.mu.Lock()
+	if !g.stopped || g.resuming {
+		g.mu.Unlock()
+		return
+	}
+	g.stopped = false
+	g.resuming = true
+	for len(g.held) > 0 && !g.stopped {
+		fn := g.held[0]
+		g.held = g.held[1:]
+		g.mu.Unlock()
+		fn()
+		g.mu.Lock()
+	}
+	g.resuming = false
+	g.mu.Unlock()
+}
+
+// discard throws away the held functions (used when the connection is lost as they would acknowledge
+// messages received on that connection)
+func (g *dispatchGate) discard() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	n := len(g.held)
+	g.held = nil
+	return n
 }
 
 // newRouter returns a new instance of a Router and channel which can be used to tell the Router
 // to stop
 func newRouter() *router {
-	router := &router{routes: list.New(), messages: make(chan *packets.PublishPacket)}
+	router := &router{routes: list.New(), messages: make(chan *packets.PublishPacket), qos2Waiting: make(map[uint16]bool)}
 	return router
 }
 
+// setReceiveMaximum limits the number of messages that may be processed by handlers concurrently
+// when order does not matter (0 means no limit), so bounding the handler goroutines. Once the limit
+// is reached the router blocks, deferring the acknowledgement of further messages and so throttling
+// the broker.
+// QoS 2 messages are handled when the PUBREL is read by the network reader, which must not block,
+// so their handlers (and the PUBCOMP) are deferred instead (see deferQoS2).
+func (r *router) setReceiveMaximum(max uint16) {
+	r.Lock()
+	defer r.Unlock()
+	if max == 0 {
+		r.inflight = nil
+		return
+	}
+	r.inflight = make(chan struct{}, max)
+}
+
 // addRoute takes a topic string and MessageHandler callback. It looks in the current list of
 // routes to see if there is already a matching Route. If there is it replaces the current
 // callback with the new one. If not it add a new entry to the list of Routes.
@@ -107,6 +214,22 @@ func (r *router) addRoute(topic string, callback MessageHandler) {
 	r.routes.PushBack(&route{topic: topic, callback: callback})
 }
 
+// addRouteIfAbsent adds a route (as per addRoute) unless one for topic already exists, in which
+// case false is returned. If callback is nil no route is added (but the check is still made).
+func (r *router) addRouteIfAbsent(topic string, callback MessageHandler) bool {
+	r.Lock()
+	defer r.Unlock()
+	for e := r.routes.Front(); e != nil; e = e.Next() {
+		if e.Value.(*route).topic == topic {
+			return false
+		}
+	}
+	if callback != nil {
+		r.routes.PushBack(&route{topic: topic, callback: callback})
+	}
+	return true
+}
+
 // deleteRoute takes a route string, looks for a matching Route in the list of Routes. If
 // found it removes the Route from the list.
 func (r *router) deleteRoute(topic string) {
@@ -120,6 +243,14 @@ func (r *router) deleteRoute(topic string) {
 	}
 }
 
+// addObserver adds a callback that will be called for every incoming Publish (in addition to
+// any matching route or the default handler)
+func (r *router) addObserver(observer MessageHandler) {
+	r.Lock()
+	defer r.Unlock()
+	r.observers = append(r.observers, observer)
+}
+
 // setDefaultHandler assigns a default callback that will be called if no matching Route
 // is found for an incoming Publish.
 func (r *router) setDefaultHandler(handler MessageHandler) {
@@ -128,9 +259,11 @@ func (r *router) setDefaultHandler(handler MessageHandler) {
 	r.defaultHandler = handler
 }
 
+// pubPrefix is the prefix of the store keys used for QoS 2 messages awaiting PUBREL
+const pubPrefix = "p."
+
 func pubKey(id uint16) string {
-	const prefix = "p."
-	return prefix + strconv.Itoa(int(id))
+	return pubPrefix + strconv.Itoa(int(id))
 }
 
 // matchAndDispatch takes a channel of Message pointers as input and starts a go routine that
@@ -138,86 +271,280 @@ func pubKey(id uint16) string {
 // associated callback (or the defaultHandler, if one exists and no other route matched). If
 // anything is sent down the stop channel the function will end.
 func (r *router) matchAndDispatch(messages <-chan *packets.PublishPacket, order bool, client *client) {
+	logs := clientLoggers(client)
 	store := client.persist
+	// skip acknowledges a message that is not to be passed to the handlers. For QoS 2 a marker is
+	// stored in place of the message so that the PUBREL completes the flow (see handleQoS2Packets).
+	skip := func(message *packets.PublishPacket, m Message) {
+		if message.Qos == 2 {
+			marker := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+			marker.MessageID = message.MessageID
+			store.Put(pubKey(message.MessageID), marker)
+		}
+		m.Ack()
+	}
 	for message := range messages {
 		id := message.MessageID
-		m := messageFromPublish(message, ackFunc(client.oboundP, client.persist, message))
+		m := messageFromPublish(message, ackFunc(client.oboundP, client.persist, message, clientLoggers(client)))
 		if message.Qos == 2 {
-			DEBUG.Println(ROU, "matchAndDispatch get pkt from the store: ", id)
+			// A redelivery of a message awaiting PUBREL is only acknowledged; this must be checked before
+			// the message could be skipped as skip would replace the stored message with a marker.
+			logs.DEBUG.Println(ROU, "matchAndDispatch get pkt from the store: ", id)
 			pkt := store.Get(pubKey(id))
-			DEBUG.Println(ROU, "matchAndDispatch got pkt from the store: ", pkt)
+			logs.DEBUG.Println(ROU, "matchAndDispatch got pkt from the store: ", pkt)
 			if pkt != nil {
 				m.Ack()
 				continue
 			}
-			DEBUG.Println(ROU, "matchAndDispatch put pkt to the store: ", id, message)
+		}
+		if filter := client.options.InboundFilter; filter != nil && !filter(message.TopicName, message.Payload, message.Qos) {
+			logs.DEBUG.Println(ROU, "matchAndDispatch message dropped by inbound filter: ", id)
+			skip(message, m)
+			continue
+		}
+		if client.ownRetained != nil && client.ownRetained.match(message.TopicName, message.Payload) {
+			logs.DEBUG.Println(ROU, "matchAndDispatch suppressed our own retained message: ", id)
+			skip(message, m)
+			continue
+		}
+		if client.dedup != nil && client.dedup.duplicate(m) {
+			logs.DEBUG.Println(ROU, "matchAndDispatch dropped duplicate message: ", id)
+			skip(message, m)
+			continue
+		}
+		if message.Qos == 2 {
+			logs.DEBUG.Println(ROU, "matchAndDispatch put pkt to the store: ", id, message)
 			store.Put(pubKey(id), message)
 			m.Ack()
 		} else {
-			r.runHandlers(message, order, client)
-			m.Ack()
+			message, m := message, m
+			r.gate.run(func() {
+				r.runHandlers(message, order, client)
+				if !client.options.AutoAckDisabled {
+					m.Ack()
+				}
+			})
 		}
 	}
-	DEBUG.Println(ROU, "matchAndDispatch exiting")
+	if n := r.gate.discard(); n > 0 {
+		logs.WARN.Println(ROU, "matchAndDispatch discarded messages held whilst dispatch was stopped: ", n)
+	}
+	logs.DEBUG.Println(ROU, "matchAndDispatch exiting")
 }
 
-func (r *router) handleQoS2Packets(mID uint16, order bool, client *client) {
-	DEBUG.Println(ROU, "handleQoS2Packets start handling message: ", mID)
+// handleQoS2Packets runs the handlers for the QoS 2 message (previously stored by matchAndDispatch)
+// with the specified id. found is false if there was no such message in the store; ackPending is true
+// if the PUBCOMP must not be sent now because the handlers were run with AutoAckDisabled set (it is
+// sent when the message is acknowledged) or are waiting for an inflight slot (see deferQoS2).
+func (r *router) handleQoS2Packets(mID uint16, order bool, client *client) (found bool, ackPending bool) {
+	logs := clientLoggers(client)
+	logs.DEBUG.Println(ROU, "handleQoS2Packets start handling message: ", mID)
 	pkt := client.persist.Get(pubKey(mID))
 	if pkt == nil {
-		DEBUG.Println(ROU, "handleQoS2Packets pkt from store is nil: ", mID)
-		return
+		logs.DEBUG.Println(ROU, "handleQoS2Packets pkt from store is nil: ", mID)
+		return false, false
 	}
-	message, ok := pkt.(*packets.PublishPacket)
-	if !ok {
-		CRITICAL.Println(ROU, "handleQoS2Packets failed to cast pkt from store to *packets.PublishPacket message: ", mID)
+	switch pkt.(type) {
+	case *packets.PublishPacket:
+	case *packets.PubrecPacket: // marker stored by matchAndDispatch for a message not passed to the handlers
+		logs.DEBUG.Println(ROU, "handleQoS2Packets message was skipped, completing flow: ", mID)
 		client.persist.Del(pubKey(mID))
-		return
+		return true, false
+	default:
+		logs.CRITICAL.Println(ROU, "handleQoS2Packets failed to cast pkt from store to *packets.PublishPacket message: ", mID)
+		client.persist.Del(pubKey(mID))
+		return true, false
 	}
-	r.runHandlers(message, order, client)
-	DEBUG.Println(ROU, "handleQoS2Packets -> start delete from store: ", mID)
+	r.RLock()
+	inflight, waiting := r.inflight, r.qos2Waiting[mID]
+	r.RUnlock()
+	switch {
+	case waiting: // the PUBREL has been resent (e.g. following a reconnect)
+		logs.DEBUG.Println(ROU, "handleQoS2Packets message already waiting for an inflight slot: ", mID)
+		return true, true
+	case inflight != nil && !order:
+		select {
+		case inflight <- struct{}{}:
+			r.runHandlersInSlot(pkt.(*packets.PublishPacket), order, client, true)
+		default:
+			r.deferQoS2(pkt.(*packets.PublishPacket), inflight, client)
+			return true, true
+		}
+	default:
+		r.runHandlers(pkt.(*packets.PublishPacket), order, client)
+	}
+	logs.DEBUG.Println(ROU, "handleQoS2Packets -> start delete from store: ", mID)
 	client.persist.Del(pubKey(mID))
-	DEBUG.Println(ROU, "handleQoS2Packets -> finish delete from store: ", mID)
-	DEBUG.Println(ROU, "handleQoS2Packets finish handling message: ", mID)
+	logs.DEBUG.Println(ROU, "handleQoS2Packets -> finish delete from store: ", mID)
+	logs.DEBUG.Println(ROU, "handleQoS2Packets finish handling message: ", mID)
+	return true, client.options.AutoAckDisabled
 }
 
+// deferQoS2 runs the handlers for a QoS 2 message, removes it from the store and sends the PUBCOMP
+// once an inflight slot is available. handleQoS2Packets is called by the network reader which must
+// not wait for a slot itself (slots may only be freed once further packets have been read); the
+// delayed PUBCOMP throttles the broker instead.
+func (r *router) deferQoS2(message *packets.PublishPacket, inflight chan struct{}, client *client) {
+	mID := message.MessageID
+	clientLoggers(client).DEBUG.Println(ROU, "handleQoS2Packets no inflight slot, deferring message: ", mID)
+	r.Lock()
+	r.qos2Waiting[mID] = true
+	r.Unlock()
+	go func() {
+		inflight <- struct{}{}
+		r.runHandlersInSlot(message, false, client, true)
+		client.persist.Del(pubKey(mID))
+		r.Lock()
+		delete(r.qos2Waiting, mID)
+		r.Unlock()
+		if !client.options.AutoAckDisabled {
+			client.sendPubcomp(mID)
+		}
+	}()
+}
+
+// runHandlers passes the message to the handlers of the matching routes (or the default handler).
+// When order does not matter, and a receive maximum is set, the handling of messages waits for an
+// inflight slot.
 func (r *router) runHandlers(message *packets.PublishPacket, order bool, client *client) {
+	r.runHandlersInSlot(message, order, client, false)
+}
+
+// runHandlersInSlot is runHandlers where slotHeld is true if the caller has already taken an
+// inflight slot for the message (the slot is released once the handlers have returned)
+func (r *router) runHandlersInSlot(message *packets.PublishPacket, order bool, client *client, slotHeld bool) {
+	logs := clientLoggers(client)
 	m := messageFromPublish(message, func() {})
+	manualAck := client != nil && client.options.AutoAckDisabled && message.Qos > 0
+	if manualAck {
+		m = messageFromPublish(message, client.manualAckFunc(message))
+	}
+	if client != nil && client.options.ServerTimestampExtractor != nil {
+		t, ok := client.options.ServerTimestampExtractor(message.TopicName, message.Payload)
+		m = setServerTimestamp(m, t, ok)
+	}
+	topic := message.TopicName
+	if client != nil && client.options.InboundTopicRewriter != nil {
+		topic = client.options.InboundTopicRewriter(topic)
+		if !client.options.KeepOriginalTopic {
+			m = setTopic(m, topic)
+		}
+	}
+	if client != nil && client.options.TopicPrefix != "" {
+		m = stripTopicPrefix(m, client.options.TopicPrefix)
+	}
 	sent := false
 	r.RLock()
 	var handlers []MessageHandler
+	var matched []string
 	for e := r.routes.Front(); e != nil; e = e.Next() {
-		if e.Value.(*route).match(message.TopicName) {
-			if order {
-				handlers = append(handlers, e.Value.(*route).callback)
-			} else {
-				hd := e.Value.(*route).callback
-				go func() {
-					hd(client, m)
-					//m.Ack()
-				}()
-			}
+		if e.Value.(*route).match(topic) {
+			handlers = append(handlers, e.Value.(*route).callback)
+			matched = append(matched, e.Value.(*route).topic)
 			sent = true
 		}
 	}
 	if !sent {
 		if r.defaultHandler != nil {
-			if order {
-				handlers = append(handlers, r.defaultHandler)
-			} else {
-				go func() {
-					r.defaultHandler(client, m)
-					//m.Ack()
-				}()
-			}
+			handlers = append(handlers, r.defaultHandler)
 		} else {
-			DEBUG.Println(ROU, "runHandlers received message and no handler was available. Message will NOT be acknowledged.")
+			logs.DEBUG.Println(ROU, "runHandlers received message and no handler was available. Message will NOT be acknowledged.")
 		}
 	}
+	if manualAck && len(handlers) == 0 {
+		m.Ack() // nothing else can acknowledge it
+	}
+	inflight := r.inflight
+	observers := r.observers
 	r.RUnlock()
-	for _, handler := range handlers {
-		handler(client, m)
-		//m.Ack()
+	if client != nil && client.subStats != nil && len(matched) > 0 {
+		client.subStats.record(matched, time.Now())
 	}
-	DEBUG.Println(ROU, "runHandlers handled message")
+	for _, observer := range observers {
+		callObserver(observer, client, m)
+	}
+	if order {
+		for _, handler := range handlers {
+			callHandler(handler, client, m)
+		}
+	} else if inflight != nil && len(handlers) > 0 {
+		if !slotHeld {
+			inflight <- struct{}{} // blocks (so delaying the ack) until a slot is available
+		}
+		var wg sync.WaitGroup
+		for _, handler := range handlers {
+			wg.Add(1)
+			r.goHandler(handler, client, m, wg.Done)
+		}
+		go func() {
+			wg.Wait()
+			<-inflight
+		}()
+	} else {
+		if slotHeld && inflight != nil {
+			<-inflight // no handlers to wait for
+		}
+		for _, handler := range handlers {
+			r.goHandler(handler, client, m, nil)
+		}
+	}
+	logs.DEBUG.Println(ROU, "runHandlers handled message")
+}
+
+// goHandler calls handler in a new goroutine (which is tracked by r.handlers and counted in r.active),
+// calling done (if not nil) once the handler returns
+func (r *router) goHandler(handler MessageHandler, client *client, m Message, done func()) {
+	r.handlers.Add(1)
+	atomic.AddInt32(&r.active, 1)
+	go func() {
+		defer r.handlers.Done()
+		defer atomic.AddInt32(&r.active, -1)
+		if done != nil {
+			defer done()
+		}
+		callHandler(handler, client, m)
+	}()
+}
+
+// activeHandlers returns the number of handler goroutines currently running
+func (r *router) activeHandlers() int {
+	return int(atomic.LoadInt32(&r.active))
+}
+
+// callHandler calls the handler recovering from any panic (so that the remaining handlers are still
+// called and the router keeps running). The panic is logged and passed to the HandlerPanicHandler
+// if one is set; if AutoAckDisabled is set the message is acknowledged as the handler cannot do so.
+func callHandler(handler MessageHandler, client *client, m Message) {
+	logs := clientLoggers(client)
+	defer func() {
+		if p := recover(); p != nil {
+			logs.ERROR.Println(ROU, "message handler panicked, topic:", m.Topic(), "panic:", p)
+			if client == nil {
+				return
+			}
+			client.reportError(fmt.Errorf("message handler panicked, topic %s: %v", m.Topic(), p))
+			if client.options.AutoAckDisabled {
+				m.Ack()
+			}
+			if client.options.HandlerPanicHandler != nil {
+				client.options.HandlerPanicHandler(m, p)
+			}
+		}
+	}()
+	handler(client, m)
+}
+
+// callObserver calls the observer, recovering from (and logging) any panic so that it cannot
+// prevent the message being passed to the handlers and acknowledged
+func callObserver(observer MessageHandler, client *client, m Message) {
+	logs := clientLoggers(client)
+	defer func() {
+		if p := recover(); p != nil {
+			logs.ERROR.Println(ROU, "message observer panicked, topic:", m.Topic(), "panic:", p)
+			if client != nil {
+				client.reportError(fmt.Errorf("message observer panicked, topic %s: %v", m.Topic(), p))
+			}
+		}
+	}()
+	observer(client, m)
 }
@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) 2013 IBM Corp.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ *
+ * Contributors:
+ *    Seth Hoenig
+ *    Allan Stockdill-Mander
+ *    Mike Robertson
+ */
+
+package mqtt
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// ClientState is a snapshot of the internal state of a client (see Client.Dump) intended to help diagnose
+// problems; it can be serialised (e.g. with encoding/json) for inclusion in support requests.
+type ClientState struct {
+	Status             string          // "disconnected", "connecting", "reconnecting" or "connected"
+	Broker             string          // URL of the connected broker ("" if not connected)
+	Subscriptions      map[string]byte // active subscriptions (filter -> requested QoS)
+	InflightMessageIDs []uint16        // message IDs in use (awaiting acknowledgement)
+	Store              StoreStats      // messages held in the persistence store
+	PendingAcks        int             // messages awaiting Ack() (when AutoAckDisabled is set)
+	LastPingRTT        time.Duration   // round trip time of the most recent PINGREQ (0 if none)
+	PingOutstanding    bool            // a PINGREQ has been sent and the response not yet received
+	ReconnectAttempts  int             // number of automatic reconnection attempts made
+	LastSent           time.Time       // time a packet was last sent (zero if none)
+	LastReceived       time.Time       // time a packet was last received (zero if none)
+}
+
+// statusName returns the name of the connection status
+func statusName(status uint32) string {
+	switch status {
+	case connecting:
+		return "connecting"
+	case reconnecting:
+		return "reconnecting"
+	case connected:
+		return "connected"
+	}
+	return "disconnected"
+}
+
+// Dump returns a snapshot of the state of the client; it is safe to call at any time
+func (c *client) Dump() ClientState {
+	s := ClientState{
+		Status:            statusName(c.connectionStatus()),
+		Subscriptions:     make(map[string]byte),
+		Store:             c.StoreStats(),
+		PendingAcks:       c.PendingAcks(),
+		LastPingRTT:       time.Duration(atomic.LoadInt64(&c.lastPingRTT)),
+		PingOutstanding:   atomic.LoadInt32(&c.pingOutstanding) != 0,
+		ReconnectAttempts: int(atomic.LoadUint32(&c.reconnectAttempts)),
+	}
+	if b := c.ConnectedBroker(); b != nil {
+		s.Broker = b.String()
+	}
+	c.subscriptionsMu.Lock()
+	for filter, qos := range c.subscriptions {
+		s.Subscriptions[filter] = qos
+	}
+	c.subscriptionsMu.Unlock()
+	c.messageIds.RLock()
+	for id := range c.messageIds.index {
+		s.InflightMessageIDs = append(s.InflightMessageIDs, id)
+	}
+	c.messageIds.RUnlock()
+	sort.Slice(s.InflightMessageIDs, func(i, j int) bool { return s.InflightMessageIDs[i] < s.InflightMessageIDs[j] })
+	if t, ok := c.lastSent.Load().(time.Time); ok {
+		s.LastSent = t
+	}
+	if t, ok := c.lastReceived.Load().(time.Time); ok {
+		s.LastReceived = t
+	}
+	return s
+}
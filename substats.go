@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2013 IBM Corp.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ *
+ * Contributors:
+ *    Seth Hoenig
+ *    Allan Stockdill-Mander
+ *    Mike Robertson
+ */
+
+package mqtt
+
+import (
+	"sync"
+	"time"
+)
+
+// subStatsWeight is the weight given to the latest interval between messages when updating the
+// moving average used to calculate SubStat.Rate
+const subStatsWeight = 0.2
+
+// SubStat holds statistics for the messages delivered to a subscription (see
+// ClientOptions.SetSubscriptionStats)
+type SubStat struct {
+	Messages     uint64    // number of messages received
+	LastReceived time.Time // time the most recent message was received (zero if none)
+	Rate         float64   // exponential moving average of the arrival rate (messages per second)
+}
+
+// subStats tracks SubStat for each route (keyed by the route's filter)
+type subStats struct {
+	sync.Mutex
+	stats       map[string]*SubStat
+	avgInterval map[string]time.Duration // moving average of the interval between messages
+}
+
+func newSubStats() *subStats {
+	return &subStats{stats: make(map[string]*SubStat), avgInterval: make(map[string]time.Duration)}
+}
+
+// record notes that a message matching the routes with the filters provided was received at now
+func (s *subStats) record(filters []string, now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	for _, f := range filters {
+		st, ok := s.stats[f]
+		if !ok {
+			st = &SubStat{}
+			s.stats[f] = st
+		}
+		if !st.LastReceived.IsZero() {
+			interval := now.Sub(st.LastReceived)
+			avg, ok := s.avgInterval[f]
+			if !ok {
+				avg = interval
+			} else {
+				avg = time.Duration(subStatsWeight*float64(interval) + (1-subStatsWeight)*float64(avg))
+			}
+			s.avgInterval[f] = avg
+			if avg > 0 {
+				st.Rate = float64(time.Second) / float64(avg)
+			}
+		}
+		st.Messages++
+		st.LastReceived = now
+	}
+}
+
+// get returns the statistics for the filter (zero if no messages have been received)
+func (s *subStats) get(filter string) SubStat {
+	s.Lock()
+	defer s.Unlock()
+	st, ok := s.stats[filter]
+	if !ok {
+		st, ok = s.stats[routeTopic(filter)]
+	}
+	if !ok {
+		return SubStat{}
+	}
+	return *st
+}
+
+// remove discards the statistics for the filter
+func (s *subStats) remove(filter string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.stats, filter)
+	delete(s.avgInterval, filter)
+}
@@ -0,0 +1,396 @@
+/*
+ * Copyright (c) 2013 IBM Corp.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ *
+ * Contributors:
+ *    Seth Hoenig
+ *    Allan Stockdill-Mander
+ *    Mike Robertson
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/90poe/paho.mqtt.golang/packets"
+)
+
+// sharedWorkerQueueDepth is the number of messages that may be queued for each shared subscription worker
+// before the dispatching handler blocks
+const sharedWorkerQueueDepth = 100
+
+// MessageKeyFunc returns the key used to partition messages between workers; messages with the
+// same key are always handled by the same worker (and so in the order they were received)
+type MessageKeyFunc func(Message) string
+
+// subscriptionWorker is implemented by the goroutines started to handle the messages for a
+// subscription; stop is called when the subscription is removed. stop must not wait for the
+// goroutines to exit because it may be called from within the handler (e.g. if the handler
+// unsubscribes); done is closed once they have.
+type subscriptionWorker interface {
+	stop()
+	done() <-chan struct{}
+}
+
+// sharedWorkers distributes messages between a set of goroutines based upon a key
+type sharedWorkers struct {
+	c        *client
+	queues   []chan Message
+	quit     chan struct{} // closed by stop
+	stopOnce sync.Once
+	exited   chan struct{} // closed once all workers have exited
+}
+
+// newSharedWorkers starts the requested number of worker goroutines each of which will call handler
+// for the messages it is passed
+func newSharedWorkers(c *client, workers int, handler MessageHandler) *sharedWorkers {
+	if workers < 1 {
+		workers = 1
+	}
+	w := &sharedWorkers{c: c, queues: make([]chan Message, workers), quit: make(chan struct{}), exited: make(chan struct{})}
+	var wg sync.WaitGroup
+	for i := range w.queues {
+		q := make(chan Message, sharedWorkerQueueDepth)
+		w.queues[i] = q
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case m := <-q:
+					callHandler(handler, c, m)
+				case <-w.quit:
+					for { // handle anything already queued
+						select {
+						case m := <-q:
+							callHandler(handler, c, m)
+						default:
+							return
+						}
+					}
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(w.exited)
+	}()
+	return w
+}
+
+// dispatch returns a MessageHandler that passes each message to the worker selected by keyFunc
+func (w *sharedWorkers) dispatch(keyFunc MessageKeyFunc) MessageHandler {
+	return func(_ Client, m Message) {
+		h := fnv.New32a()
+		h.Write([]byte(keyFunc(m)))
+		q := w.queues[h.Sum32()%uint32(len(w.queues))]
+		select {
+		case <-w.quit:
+		default:
+			select {
+			case q <- m:
+				return
+			case <-w.quit:
+			}
+		}
+		// the route may have been copied by the router before the subscription was removed
+		clientLoggers(w.c).DEBUG.Println(ROU, "shared subscription workers stopped, message dropped:", m.Topic())
+	}
+}
+
+// stop signals the workers to exit once any queued messages have been handled
+func (w *sharedWorkers) stop() {
+	w.stopOnce.Do(func() { close(w.quit) })
+}
+
+// done is closed once the workers have exited
+func (w *sharedWorkers) done() <-chan struct{} {
+	return w.exited
+}
+
+// SubscribeShared subscribes to filter as a member of the shared subscription group (i.e.
+// $share/group/filter) and distributes the messages received between the specified number of
+// worker goroutines. Messages are partitioned using keyFunc so messages with the same key are
+// handled, in order, by the same worker while messages with different keys are handled in
+// parallel. The workers are stopped when the filter is unsubscribed from, if the subscribe fails or
+// when Disconnect is called (or SubscribeShared is called again for the same group and filter).
+func (c *client) SubscribeShared(group, filter string, qos byte, workers int, keyFunc MessageKeyFunc, handler MessageHandler) Token {
+	topic := "$share/" + group + "/" + filter
+	w := newSharedWorkers(c, workers, handler)
+	token := c.Subscribe(topic, qos, w.dispatch(keyFunc))
+	c.trackSubscriptionWorkers(filter, w, token)
+	return token
+}
+
+// ErrRouteExists is the error set on the token returned by SubscribeWithOptions, when FailIfExists
+// is set, if a route for the filter already exists
+var ErrRouteExists = errors.New("route already exists for filter")
+
+// SubOptions are the options that can be passed to SubscribeWithOptions
+type SubOptions struct {
+	// DedicatedWorker causes messages for the subscription to be passed to the handler by a
+	// goroutine dedicated to the subscription (so a slow handler does not delay messages
+	// for other subscriptions, but messages for this subscription are handled in order)
+	DedicatedWorker bool
+	// FailIfExists causes the subscription to fail with ErrRouteExists if a route for the exact
+	// filter already exists (by default the existing route's handler is replaced)
+	FailIfExists bool
+}
+
+// SubscribeWithOptions starts a new subscription (as per Subscribe) with the specified options.
+// When DedicatedWorker is set messages are queued for the subscription's own goroutine rather
+// than being passed to the handler by the router. Messages for the subscription are handled
+// in the order received as long as SetOrderMatters(true), the default, is in place (if order
+// does not matter the router may queue concurrently received messages in any order). The
+// worker is stopped when the topic is unsubscribed from, if the subscribe fails or when Disconnect
+// is called.
+// When FailIfExists is set the check for, and installation of, the route is atomic so, of
+// several concurrent calls for the same filter, only one will succeed.
+func (c *client) SubscribeWithOptions(topic string, qos byte, callback MessageHandler, opts SubOptions) Token {
+	handler := callback
+	var w *sharedWorkers
+	if opts.DedicatedWorker && callback != nil {
+		w = newSharedWorkers(c, 1, callback)
+		handler = w.dispatch(func(Message) string { return "" })
+	}
+	stop := func() {
+		if w != nil {
+			w.stop()
+		}
+	}
+
+	route := routeTopic(c.prefixTopic(topic))
+	if opts.FailIfExists {
+		if err := validateTopicAndQos(topic, qos); err != nil {
+			stop()
+			token := newToken(packets.Subscribe).(*SubscribeToken)
+			token.setError(err)
+			return token
+		}
+		if !c.msgRouter.addRouteIfAbsent(route, handler) {
+			stop()
+			token := newToken(packets.Subscribe).(*SubscribeToken)
+			token.setError(ErrRouteExists)
+			return token
+		}
+	}
+
+	token := c.Subscribe(topic, qos, handler)
+	if token.Error() != nil {
+		if opts.FailIfExists {
+			c.msgRouter.deleteRoute(route)
+		}
+		stop()
+		return token
+	}
+	if w != nil {
+		c.trackSubscriptionWorkers(routeTopic(topic), w, token)
+	}
+	return token
+}
+
+// BatchMessageHandler is passed the messages received on a subscription made with SubscribeBatch
+// (in the order in which they were received)
+type BatchMessageHandler func(Client, []Message)
+
+// messageBatcher accumulates messages and passes them, in batches, to a handler
+type messageBatcher struct {
+	c        *client
+	queue    chan Message
+	quit     chan struct{} // closed by stop
+	stopOnce sync.Once
+	exited   chan struct{} // closed once the batching goroutine has exited
+}
+
+// newMessageBatcher starts a goroutine that calls handler with up to maxBatch messages at a time;
+// a partial batch is passed to the handler once maxWait has passed since its first message was
+// received (if maxWait is 0 the batch is only passed on when full). Each message is acknowledged
+// once the handler returns.
+func newMessageBatcher(c *client, maxBatch int, maxWait time.Duration, handler BatchMessageHandler) *messageBatcher {
+	if maxBatch < 1 {
+		maxBatch = 1
+	}
+	b := &messageBatcher{c: c, queue: make(chan Message, sharedWorkerQueueDepth), quit: make(chan struct{}), exited: make(chan struct{})}
+	go func() {
+		defer close(b.exited)
+		var (
+			batch   []Message
+			timer   *time.Timer
+			timeout <-chan time.Time
+		)
+		flush := func() {
+			if timer != nil {
+				timer.Stop()
+				timer, timeout = nil, nil
+			}
+			if len(batch) == 0 {
+				return
+			}
+			callBatchHandler(handler, c, batch)
+			for _, m := range batch {
+				m.Ack() // does nothing unless AutoAckDisabled is set (or if the handler acknowledged the message)
+			}
+			batch = nil
+		}
+		for {
+			select {
+			case m := <-b.queue:
+				batch = append(batch, m)
+				if len(batch) >= maxBatch {
+					flush()
+				} else if timer == nil && maxWait > 0 {
+					timer = time.NewTimer(maxWait)
+					timeout = timer.C
+				}
+			case <-timeout:
+				timer, timeout = nil, nil
+				flush()
+			case <-b.quit:
+				for { // batch anything already queued
+					select {
+					case m := <-b.queue:
+						batch = append(batch, m)
+						if len(batch) >= maxBatch {
+							flush()
+						}
+					default:
+						flush()
+						return
+					}
+				}
+			}
+		}
+	}()
+	return b
+}
+
+// dispatch is a MessageHandler that adds the message to the current batch
+func (b *messageBatcher) dispatch(_ Client, m Message) {
+	select {
+	case <-b.quit:
+	default:
+		select {
+		case b.queue <- m:
+			return
+		case <-b.quit:
+		}
+	}
+	// the route may have been copied by the router before the subscription was removed
+	clientLoggers(b.c).DEBUG.Println(ROU, "batch subscription stopped, message dropped:", m.Topic())
+}
+
+// stop signals the batcher to exit once any queued messages have been passed to the handler
+func (b *messageBatcher) stop() {
+	b.stopOnce.Do(func() { close(b.quit) })
+}
+
+// done is closed once the batcher has exited
+func (b *messageBatcher) done() <-chan struct{} {
+	return b.exited
+}
+
+// callBatchHandler calls the handler, recovering from any panic in the same way as callHandler
+// (HandlerPanicHandler is called for each message in the batch)
+func callBatchHandler(handler BatchMessageHandler, client *client, batch []Message) {
+	logs := clientLoggers(client)
+	defer func() {
+		if p := recover(); p != nil {
+			logs.ERROR.Println(ROU, "batch message handler panicked, topic:", batch[0].Topic(), "panic:", p)
+			if client == nil {
+				return
+			}
+			client.reportError(fmt.Errorf("batch message handler panicked, topic %s: %v", batch[0].Topic(), p))
+			if client.options.HandlerPanicHandler != nil {
+				for _, m := range batch {
+					client.options.HandlerPanicHandler(m, p)
+				}
+			}
+		}
+	}()
+	handler(client, batch)
+}
+
+// SubscribeBatch starts a new subscription (as per Subscribe) and passes the messages received to
+// handler in batches of up to maxBatch messages. A partial batch is passed on once maxWait has
+// passed since its first message arrived (0 means only full batches are passed on). Messages are
+// in the order received as long as SetOrderMatters(true), the default, is in place. When
+// AutoAckDisabled is set each message in the batch is acknowledged once handler returns (otherwise
+// messages are acknowledged when received). Any partial batch is passed to the handler when the
+// filter is unsubscribed from or Disconnect is called.
+func (c *client) SubscribeBatch(filter string, qos byte, maxBatch int, maxWait time.Duration, handler BatchMessageHandler) Token {
+	b := newMessageBatcher(c, maxBatch, maxWait, handler)
+	token := c.Subscribe(filter, qos, b.dispatch)
+	c.trackSubscriptionWorkers(routeTopic(filter), b, token)
+	return token
+}
+
+// setSubscriptionWorkers records the workers handling messages for the route (stopping any
+// previous workers for the same route)
+func (c *client) setSubscriptionWorkers(route string, w subscriptionWorker) {
+	c.subscriptionWorkersMu.Lock()
+	old := c.subscriptionWorkers[route]
+	c.subscriptionWorkers[route] = w
+	c.subscriptionWorkersMu.Unlock()
+	if old != nil {
+		old.stop()
+	}
+}
+
+// trackSubscriptionWorkers records the workers handling messages for the route once the
+// subscribe has been requested; the workers are stopped if the subscribe fails (which may only
+// be known once the SUBACK is received)
+func (c *client) trackSubscriptionWorkers(route string, w subscriptionWorker, token Token) {
+	if token.Error() != nil {
+		w.stop()
+		return
+	}
+	c.setSubscriptionWorkers(route, w)
+	go func() {
+		<-token.Done()
+		if token.Error() == nil {
+			return
+		}
+		c.subscriptionWorkersMu.Lock()
+		if c.subscriptionWorkers[route] == w {
+			delete(c.subscriptionWorkers, route)
+		}
+		c.subscriptionWorkersMu.Unlock()
+		w.stop()
+	}()
+}
+
+// stopSubscriptionWorkers stops any workers started by SubscribeShared, SubscribeWithOptions or
+// SubscribeBatch for the route
+func (c *client) stopSubscriptionWorkers(route string) {
+	c.subscriptionWorkersMu.Lock()
+	w := c.subscriptionWorkers[route]
+	delete(c.subscriptionWorkers, route)
+	c.subscriptionWorkersMu.Unlock()
+	if w != nil {
+		w.stop()
+	}
+}
+
+// stopAllSubscriptionWorkers stops all workers started by SubscribeShared, SubscribeWithOptions
+// or SubscribeBatch and removes their routes (the subscriptions must be made again if the client
+// reconnects)
+func (c *client) stopAllSubscriptionWorkers() {
+	c.subscriptionWorkersMu.Lock()
+	workers := c.subscriptionWorkers
+	c.subscriptionWorkers = make(map[string]subscriptionWorker)
+	c.subscriptionWorkersMu.Unlock()
+	for route, w := range workers {
+		w.stop()
+		c.msgRouter.deleteRoute(c.prefixTopic(route))
+	}
+}
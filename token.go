@@ -13,7 +13,10 @@
 package mqtt
 
 import (
+	"context"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/90poe/paho.mqtt.golang/packets"
@@ -33,6 +36,12 @@ type PacketAndToken struct {
 type Token interface {
 	Wait() bool
 	WaitTimeout(time.Duration) bool
+	// WaitContext waits for the Token to complete returning its error (nil on success) or,
+	// if ctx is done first, ctx.Err() (e.g. context.DeadlineExceeded)
+	WaitContext(ctx context.Context) error
+	// Done returns a channel that is closed when the Token completes, allowing completion to be
+	// combined with other channels in a select statement (check Error() once it is closed)
+	Done() <-chan struct{}
 	Error() error
 }
 
@@ -49,7 +58,9 @@ type tokenCompletor interface {
 type baseToken struct {
 	m        sync.RWMutex
 	complete chan struct{}
+	once     sync.Once // ensures complete is closed exactly once
 	err      error
+	onDone   func() // if set (before the token is returned to the user), called once the token completes
 }
 
 // Wait will wait indefinitely for the Token to complete, ie the Publish
@@ -62,7 +73,9 @@ func (b *baseToken) Wait() bool {
 // WaitTimeout takes a time.Duration to wait for the flow associated with the
 // Token to complete, returns true if it returned before the timeout or
 // returns false if the timeout occurred. In the case of a timeout the Token
-// does not have an error set in case the caller wishes to wait again
+// does not have an error set in case the caller wishes to wait again.
+// Note that true does not mean success; Error() must be checked (WaitContext
+// returns the outcome directly).
 func (b *baseToken) WaitTimeout(d time.Duration) bool {
 	timer := time.NewTimer(d)
 	select {
@@ -77,14 +90,33 @@ func (b *baseToken) WaitTimeout(d time.Duration) bool {
 	return false
 }
 
-func (b *baseToken) flowComplete() {
+// WaitContext waits for the flow associated with the Token to complete or for ctx to be done.
+// Unlike WaitTimeout the result is unambiguous: the Token's error (nil on success) is returned if
+// it completed, otherwise ctx.Err() (context.DeadlineExceeded or context.Canceled) is returned. As
+// with WaitTimeout the Token is unaffected by ctx so the caller may wait again.
+func (b *baseToken) WaitContext(ctx context.Context) error {
 	select {
 	case <-b.complete:
-	default:
-		close(b.complete)
+		return b.Error()
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
+// Done returns a channel that is closed when the flow associated with the Token completes
+func (b *baseToken) Done() <-chan struct{} {
+	return b.complete
+}
+
+func (b *baseToken) flowComplete() {
+	b.once.Do(func() {
+		close(b.complete)
+		if b.onDone != nil {
+			b.onDone()
+		}
+	})
+}
+
 func (b *baseToken) Error() error {
 	b.m.RLock()
 	defer b.m.RUnlock()
@@ -120,6 +152,43 @@ type ConnectToken struct {
 	baseToken
 	returnCode     byte
 	sessionPresent bool
+	timings        ConnectTimings
+}
+
+// ConnectTimings details how long each phase of the connection attempt took. Only the phases
+// that were reached are populated so, on failure, the last non-zero phase is the one that failed.
+// If there are multiple servers (or the connection is retried) the timings are for the last attempt.
+type ConnectTimings struct {
+	DNS           time.Duration // resolving the broker address
+	Dial          time.Duration // establishing the network connection (for websocket and proxied connections this includes any HTTP exchange and, for wss, the TLS handshake)
+	TLSHandshake  time.Duration // the TLS handshake (for ssl/tls/mqtts/tcps connections)
+	MQTTHandshake time.Duration // sending the CONNECT and receiving the CONNACK
+}
+
+// ConnectPhase identifies the phase that a connection attempt has reached (see
+// ClientOptions.SetConnectProgressHandler); the phases correspond to those in ConnectTimings
+type ConnectPhase int
+
+// The phases of a connection attempt (in the order in which they occur)
+const (
+	ConnectPhaseDialing        ConnectPhase = iota // resolving the broker address and establishing the network connection
+	ConnectPhaseTLSHandshake                       // the TLS handshake (for ssl/tls/mqtts/tcps connections)
+	ConnectPhaseSendingConnect                     // sending the CONNECT packet
+	ConnectPhaseWaitingConnack                     // waiting for the broker to respond with a CONNACK
+)
+
+func (p ConnectPhase) String() string {
+	switch p {
+	case ConnectPhaseDialing:
+		return "dialing"
+	case ConnectPhaseTLSHandshake:
+		return "TLS handshake"
+	case ConnectPhaseSendingConnect:
+		return "sending CONNECT"
+	case ConnectPhaseWaitingConnack:
+		return "waiting for CONNACK"
+	}
+	return fmt.Sprintf("ConnectPhase(%d)", int(p))
 }
 
 // ReturnCode returns the acknowledgement code in the connack sent
@@ -138,11 +207,43 @@ func (c *ConnectToken) SessionPresent() bool {
 	return c.sessionPresent
 }
 
+// Timings returns the time taken by each phase of the connection attempt
+func (c *ConnectToken) Timings() ConnectTimings {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return c.timings
+}
+
+// ReasonCodeUnspecified is returned by ReasonCode accessors when the broker did not
+// supply a reason code. Reason codes were introduced in MQTT 5 so this is always the
+// case for MQTT 3.1/3.1.1 connections.
+const ReasonCodeUnspecified byte = 0xFF
+
 // PublishToken is an extension of Token containing the extra fields
 // required to provide information about calls to Publish()
 type PublishToken struct {
 	baseToken
 	messageID uint16
+	topic     string // as passed to Publish (used for OnPublishComplete)
+	sendState int32  // publishQueued, publishSent or publishCancelled (accessed atomically)
+}
+
+// The states a QoS 1/2 publish passes through (see PublishWithContext)
+const (
+	publishQueued    = iota // not yet written to the connection
+	publishSent             // written (or being written) to the connection
+	publishCancelled        // abandoned before being written; the outgoing goroutine will drop it
+)
+
+// markSent records that the publish is about to be written, returning false if it was cancelled
+func (p *PublishToken) markSent() bool {
+	return atomic.CompareAndSwapInt32(&p.sendState, publishQueued, publishSent) ||
+		atomic.LoadInt32(&p.sendState) == publishSent
+}
+
+// cancel marks a publish that has not been written as cancelled, returning false if it was sent
+func (p *PublishToken) cancel() bool {
+	return atomic.CompareAndSwapInt32(&p.sendState, publishQueued, publishCancelled)
 }
 
 // MessageID returns the MQTT message ID that was assigned to the
@@ -151,11 +252,18 @@ func (p *PublishToken) MessageID() uint16 {
 	return p.messageID
 }
 
+// ReasonCode returns the reason code in the acknowledgement (PUBACK/PUBREC) sent
+// in response to a Publish(), or ReasonCodeUnspecified if there was none
+func (p *PublishToken) ReasonCode() byte {
+	return ReasonCodeUnspecified
+}
+
 // SubscribeToken is an extension of Token containing the extra fields
 // required to provide information about calls to Subscribe()
 type SubscribeToken struct {
 	baseToken
 	subs      []string
+	qoss      []byte // requested QoS (matching subs)
 	subResult map[string]byte
 	messageID uint16
 }
@@ -163,16 +271,35 @@ type SubscribeToken struct {
 // Result returns a map of topics that were subscribed to along with
 // the matching return code from the broker. This is either the Qos
 // value of the subscription or an error code.
+// A failure return code (0x80) for some, or all, topics does not
+// cause the token to return an error so this should be checked.
 func (s *SubscribeToken) Result() map[string]byte {
 	s.m.RLock()
 	defer s.m.RUnlock()
 	return s.subResult
 }
 
+// checkGrantedQoS returns an error if the broker granted any subscription a lower QoS than was
+// requested (a failure return code is not treated as a downgrade)
+func (s *SubscribeToken) checkGrantedQoS() error {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	for i, topic := range s.subs {
+		if i >= len(s.qoss) {
+			break
+		}
+		if granted, ok := s.subResult[topic]; ok && granted != 0x80 && granted < s.qoss[i] {
+			return fmt.Errorf("broker granted QoS %d for %q but QoS %d was requested", granted, topic, s.qoss[i])
+		}
+	}
+	return nil
+}
+
 // UnsubscribeToken is an extension of Token containing the extra fields
 // required to provide information about calls to Unsubscribe()
 type UnsubscribeToken struct {
 	baseToken
+	topics    []string
 	messageID uint16
 }
 
@@ -1,9 +1,12 @@
 package mqtt
 
 import (
+	"context"
 	"errors"
 	"testing"
 	"time"
+
+	"github.com/90poe/paho.mqtt.golang/packets"
 )
 
 func TestWaitTimeout(t *testing.T) {
@@ -24,3 +27,77 @@ func TestWaitTimeout(t *testing.T) {
 		t.Fatal("Should have succeeded")
 	}
 }
+
+func TestWaitContext(t *testing.T) {
+	b := baseToken{complete: make(chan struct{})}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := b.WaitContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	testErr := errors.New("test error")
+	go b.setError(testErr)
+	if err := b.WaitContext(context.Background()); err != testErr {
+		t.Fatalf("expected the token's error, got %v", err)
+	}
+
+	b = baseToken{complete: make(chan struct{})}
+	b.flowComplete()
+	if err := b.WaitContext(context.Background()); err != nil {
+		t.Fatalf("expected nil on success, got %v", err)
+	}
+}
+
+func TestTokenDone(t *testing.T) {
+	token := newToken(packets.Publish)
+
+	select {
+	case <-token.Done():
+		t.Fatal("Done should not be closed before completion")
+	default:
+	}
+
+	token.flowComplete()
+	token.setError(errors.New("test error")) // a second completion must not panic
+	select {
+	case <-token.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Done should be closed on completion")
+	}
+	if token.Error() == nil {
+		t.Fatal("expected the error to be available once Done is closed")
+	}
+
+	select {
+	case <-(&DummyToken{}).Done():
+	default:
+		t.Fatal("DummyToken should always be done")
+	}
+}
+
+func TestPublishTokenReasonCode(t *testing.T) {
+	token := newToken(packets.Publish).(*PublishToken)
+
+	if rc := token.ReasonCode(); rc != ReasonCodeUnspecified {
+		t.Fatalf("expected ReasonCodeUnspecified, got %d", rc)
+	}
+}
+
+func TestSubscribeTokenCheckGrantedQoS(t *testing.T) {
+	token := newToken(packets.Subscribe).(*SubscribeToken)
+	token.subs = []string{"a", "b"}
+	token.qoss = []byte{2, 1}
+
+	token.subResult["a"] = 2
+	token.subResult["b"] = 0x80 // a failure is not a downgrade
+	if err := token.checkGrantedQoS(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	token.subResult["a"] = 1
+	if err := token.checkGrantedQoS(); err == nil {
+		t.Fatalf("expected an error when QoS is downgraded")
+	}
+}
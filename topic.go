@@ -17,6 +17,7 @@ package mqtt
 import (
 	"errors"
 	"strings"
+	"unicode/utf8"
 )
 
 //ErrInvalidQos is the error returned when an packet is to be sent
@@ -32,6 +33,22 @@ var ErrInvalidTopicEmptyString = errors.New("invalid Topic; empty string")
 //the last
 var ErrInvalidTopicMultilevel = errors.New("invalid Topic; multi-level wildcard must be last level")
 
+//ErrInvalidTopicWildcard is the error returned when a topic name that
+//contains a wildcard is passed to publish
+var ErrInvalidTopicWildcard = errors.New("invalid Topic; topic name must not contain wildcards")
+
+//ErrInvalidTopicNull is the error returned when a topic string contains
+//the null character
+var ErrInvalidTopicNull = errors.New("invalid Topic; must not contain null character")
+
+//ErrInvalidTopicUTF8 is the error returned when a topic string is not
+//valid UTF-8
+var ErrInvalidTopicUTF8 = errors.New("invalid Topic; must be valid UTF-8")
+
+//ErrInvalidTopicLength is the error returned when a topic string is
+//longer than 65535 bytes
+var ErrInvalidTopicLength = errors.New("invalid Topic; must not exceed 65535 bytes")
+
 // Topic Names and Topic Filters
 // The MQTT v3.1.1 spec clarifies a number of ambiguities with regard
 // to the validity of Topic strings.
@@ -67,6 +84,24 @@ func validateSubscribeMap(subs map[string]byte) ([]string, []byte, error) {
 	return topics, qoss, nil
 }
 
+// validatePublishTopic checks that topic is a valid topic name (as used in a PUBLISH); sending an invalid
+// topic name would result in the broker closing the connection
+func validatePublishTopic(topic string) error {
+	switch {
+	case len(topic) == 0:
+		return ErrInvalidTopicEmptyString
+	case len(topic) > 65535:
+		return ErrInvalidTopicLength
+	case strings.ContainsAny(topic, "+#"):
+		return ErrInvalidTopicWildcard
+	case strings.ContainsRune(topic, 0):
+		return ErrInvalidTopicNull
+	case !utf8.ValidString(topic):
+		return ErrInvalidTopicUTF8
+	}
+	return nil
+}
+
 func validateTopicAndQos(topic string, qos byte) error {
 	if len(topic) == 0 {
 		return ErrInvalidTopicEmptyString
@@ -79,8 +114,43 @@ func validateTopicAndQos(topic string, qos byte) error {
 		}
 	}
 
+	return validateQos(qos)
+}
+
+// validateQos checks that qos is 0, 1 or 2
+func validateQos(qos byte) error {
 	if qos > 2 {
 		return ErrInvalidQos
 	}
 	return nil
 }
+
+// filtersOverlap returns true if there could be a topic that matches both of the subscription filters
+// (e.g. "a/+" and "a/b", or "a/#" and "+/c"); shared subscription prefixes are ignored.
+func filtersOverlap(a, b string) bool {
+	la, lb := routeSplit(routeTopic(a)), routeSplit(routeTopic(b))
+	if sysWildcard(la, lb) || sysWildcard(lb, la) {
+		return false
+	}
+	return levelsOverlap(la, lb)
+}
+
+// sysWildcard returns true if a begins with a wildcard and b with a $ level (which the wildcard
+// cannot match)
+func sysWildcard(a, b []string) bool {
+	return len(a) > 0 && len(b) > 0 && (a[0] == "#" || a[0] == "+") && strings.HasPrefix(b[0], "$")
+}
+
+func levelsOverlap(a, b []string) bool {
+	if len(a) == 0 || len(b) == 0 {
+		// "a/#" matches "a" so a trailing multi-level wildcard can match nothing
+		return (len(a) == 0 && len(b) == 0) || (len(a) > 0 && a[0] == "#") || (len(b) > 0 && b[0] == "#")
+	}
+	if a[0] == "#" || b[0] == "#" {
+		return true
+	}
+	if a[0] == "+" || b[0] == "+" || a[0] == b[0] {
+		return levelsOverlap(a[1:], b[1:])
+	}
+	return false
+}
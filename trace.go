@@ -14,6 +14,14 @@
 
 package mqtt
 
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
 type (
 	// Logger interface allows implementations to provide to this package any
 	// object that implements the methods defined in it.
@@ -38,3 +46,91 @@ var (
 	WARN     Logger = NOOPLogger{}
 	DEBUG    Logger = NOOPLogger{}
 )
+
+// prefixLogger logs to the package level logger *l, prefixing each line with prefix. The logger is
+// looked up for every line so changes to the package level loggers take effect immediately.
+type prefixLogger struct {
+	l      *Logger
+	prefix string
+}
+
+func (p prefixLogger) Println(v ...interface{}) {
+	l := *p.l
+	if _, ok := l.(NOOPLogger); ok {
+		return
+	}
+	if p.prefix == "" {
+		l.Println(v...)
+		return
+	}
+	l.Println(append([]interface{}{p.prefix}, v...)...)
+}
+
+func (p prefixLogger) Printf(format string, v ...interface{}) {
+	l := *p.l
+	if _, ok := l.(NOOPLogger); ok {
+		return
+	}
+	if p.prefix == "" {
+		l.Printf(format, v...)
+		return
+	}
+	l.Printf(strings.ReplaceAll(p.prefix, "%", "%%")+" "+format, v...)
+}
+
+// loggers holds the loggers used by a client; these prefix each line with the ConnectionID so that
+// the output of multiple clients can be distinguished
+type loggers struct {
+	DEBUG    Logger
+	WARN     Logger
+	ERROR    Logger
+	CRITICAL Logger
+}
+
+// globalLoggers logs directly to the package level loggers (used where no client is available)
+var globalLoggers = &loggers{
+	DEBUG:    prefixLogger{l: &DEBUG, prefix: ""},
+	WARN:     prefixLogger{l: &WARN, prefix: ""},
+	ERROR:    prefixLogger{l: &ERROR, prefix: ""},
+	CRITICAL: prefixLogger{l: &CRITICAL, prefix: ""},
+}
+
+// newLoggers returns loggers that prefix each line with the connection ID
+func newLoggers(connectionID string) *loggers {
+	prefix := fmt.Sprintf("[%s]", connectionID)
+	return &loggers{
+		DEBUG:    prefixLogger{l: &DEBUG, prefix: prefix},
+		WARN:     prefixLogger{l: &WARN, prefix: prefix},
+		ERROR:    prefixLogger{l: &ERROR, prefix: prefix},
+		CRITICAL: prefixLogger{l: &CRITICAL, prefix: prefix},
+	}
+}
+
+// randReader is the source of the random bytes used to generate identifiers (see newConnectionID).
+// It may be replaced (e.g. in tests, so that generated values are deterministic).
+var randReader io.Reader = rand.Reader
+
+// newConnectionID returns a random identifier used as the default ConnectionID
+func newConnectionID() string {
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(randReader, b); err != nil {
+		return "client"
+	}
+	return hex.EncodeToString(b)
+}
+
+// orGlobalLoggers returns l or, if it is nil, the package level loggers
+func orGlobalLoggers(l *loggers) *loggers {
+	if l == nil {
+		return globalLoggers
+	}
+	return l
+}
+
+// clientLoggers returns the loggers of c (which may be nil)
+func clientLoggers(c *client) *loggers {
+	if c == nil || c.logs == nil {
+		return globalLoggers
+	}
+	return c.logs
+}
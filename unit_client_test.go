@@ -15,10 +15,22 @@
 package mqtt
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/90poe/paho.mqtt.golang/packets"
 
 	_ "net/http/pprof"
 )
@@ -105,3 +117,1363 @@ func Test_isConnectionOpenNegative(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func Test_isConnected(t *testing.T) {
+	ops := NewClientOptions().SetAutoReconnect(true).SetConnectRetry(true)
+	c := NewClient(ops)
+
+	c.(*client).setConnected(connected)
+	if !c.IsConnected() || c.IsReconnecting() {
+		t.Fatalf("connected client should report connected and not reconnecting")
+	}
+	c.(*client).setConnected(reconnecting)
+	if c.IsConnected() || !c.IsReconnecting() {
+		t.Fatalf("reconnecting client should report reconnecting and not connected")
+	}
+	c.(*client).setConnected(connecting)
+	if c.IsConnected() || c.IsReconnecting() {
+		t.Fatalf("connecting client should not report connected or reconnecting")
+	}
+	c.(*client).setConnected(disconnected)
+	if c.IsConnected() || c.IsReconnecting() {
+		t.Fatalf("disconnected client should not report connected or reconnecting")
+	}
+}
+
+func Test_isConnectedOrPending(t *testing.T) {
+	ops := NewClientOptions().SetAutoReconnect(true)
+	c := NewClient(ops).(*client)
+
+	c.setConnected(reconnecting)
+	if !c.isConnectedOrPending() {
+		t.Fatalf("reconnecting client with AutoReconnect should be pending")
+	}
+	c.setConnected(connecting)
+	if c.isConnectedOrPending() {
+		t.Fatalf("connecting client without ConnectRetry should not be pending")
+	}
+}
+
+func Test_DeferredSubscribe(t *testing.T) {
+	ops := NewClientOptions().SetDeferredSubscribe(true)
+	c := NewClient(ops).(*client)
+
+	token := c.Subscribe("a/b", 1, nil)
+	if token.WaitTimeout(10 * time.Millisecond) {
+		t.Fatalf("deferred subscribe should not complete before connecting: %v", token.Error())
+	}
+	c.SubscribeMultiple(map[string]byte{"c/d": 0, "e/#": 2}, nil)
+	if len(c.deferredSubs) != 2 {
+		t.Fatalf("expected 2 deferred subscribes, got %d", len(c.deferredSubs))
+	}
+	c.Disconnect(0)
+	if !token.WaitTimeout(time.Second) || token.Error() != ErrNotConnected {
+		t.Fatalf("expected Disconnect to fail the deferred subscribe, got %v", token.Error())
+	}
+
+	// the deferred subscribes also fail if Connect does
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close() // nothing is listening
+	c = NewClient(NewClientOptions().SetDeferredSubscribe(true).AddBroker("tcp://" + l.Addr().String())).(*client)
+	token = c.Subscribe("a/b", 1, nil)
+	c.Connect().Wait()
+	if !token.WaitTimeout(time.Second) || token.Error() != ErrNotConnected {
+		t.Fatalf("expected a failed Connect to fail the deferred subscribe, got %v", token.Error())
+	}
+
+	c = NewClient(NewClientOptions()).(*client)
+	if token := c.Subscribe("a/b", 1, nil); token.Wait() && token.Error() != ErrNotConnected {
+		t.Fatalf("expected ErrNotConnected, got %v", token.Error())
+	}
+}
+
+func Test_Reconnect_wakesRetryLoop(t *testing.T) {
+	c := NewClient(NewClientOptions()).(*client)
+
+	c.setConnected(reconnecting)
+	c.Reconnect()
+	c.Reconnect() // must not block when a request is already pending
+
+	select {
+	case <-c.reconnectNow:
+	default:
+		t.Fatalf("Reconnect() should signal the retry loop")
+	}
+}
+
+func Test_ConnAddrs(t *testing.T) {
+	c := NewClient(NewClientOptions()).(*client)
+
+	if c.LocalAddr() != nil || c.RemoteAddr() != nil {
+		t.Fatalf("addresses should be nil when not connected")
+	}
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	c.conn = local
+	if c.LocalAddr() == nil || c.RemoteAddr() == nil {
+		t.Fatalf("addresses should be available when connected")
+	}
+}
+
+func Test_LastConnectedAt(t *testing.T) {
+	c := NewClient(NewClientOptions()).(*client)
+	if !c.LastConnectedAt().IsZero() || !c.LastDisconnectedAt().IsZero() {
+		t.Fatalf("expected zero times before connecting")
+	}
+	before := time.Now()
+	c.setConnected(connecting)
+	c.setConnected(connected)
+	connectedAt := c.LastConnectedAt()
+	if connectedAt.Before(before) || !c.LastDisconnectedAt().IsZero() {
+		t.Fatalf("unexpected times after connecting: %v %v", connectedAt, c.LastDisconnectedAt())
+	}
+	c.setConnected(connected) // not a transition
+	if !c.LastConnectedAt().Equal(connectedAt) {
+		t.Errorf("LastConnectedAt changed without a transition")
+	}
+	c.setConnected(reconnecting)
+	if c.LastDisconnectedAt().Before(connectedAt) {
+		t.Errorf("LastDisconnectedAt not recorded when the connection was lost")
+	}
+}
+
+func Test_EffectiveKeepAlive(t *testing.T) {
+	c := NewClient(NewClientOptions().SetKeepAlive(90500 * time.Millisecond)).(*client)
+	if ka := c.EffectiveKeepAlive(); ka != 0 {
+		t.Fatalf("expected 0 when not connected, got %v", ka)
+	}
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	c.conn = local
+
+	for requested, want := range map[time.Duration]time.Duration{
+		90500 * time.Millisecond: 90 * time.Second,
+		100000 * time.Second:     65535 * time.Second,
+		0:                        0,
+	} {
+		c.options.SetKeepAlive(requested)
+		if ka := c.EffectiveKeepAlive(); ka != want {
+			t.Errorf("keepalive %v: expected %v, got %v", requested, want, ka)
+		}
+	}
+}
+
+func Test_MaxReconnectAttempts(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close() // the broker refuses connections
+
+	var attempts int32
+	exhausted := make(chan struct{})
+	opts := NewClientOptions().AddBroker("tcp://" + l.Addr().String()).SetMaxReconnectAttempts(1)
+	opts.SetReconnectingHandler(func(Client, *ClientOptions) { atomic.AddInt32(&attempts, 1) })
+	opts.SetOnReconnectExhausted(func() { close(exhausted) })
+	c := NewClient(opts).(*client)
+	c.persist.Open()
+	c.setConnected(reconnecting)
+
+	c.reconnect() // returns once it gives up
+	select {
+	case <-exhausted:
+	case <-time.After(time.Second):
+		t.Fatalf("OnReconnectExhausted not called")
+	}
+	if n := atomic.LoadInt32(&attempts); n != 1 {
+		t.Errorf("expected 1 reconnection attempt, got %d", n)
+	}
+	if c.connectionStatus() != disconnected {
+		t.Errorf("client should be disconnected, status %d", c.connectionStatus())
+	}
+}
+
+func Test_ConnectedBroker(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := packets.ReadPacket(conn); err != nil {
+			return
+		}
+		packets.NewControlPacket(packets.Connack).Write(conn)
+		packets.ReadPacket(conn) // wait for the client to close the connection
+	}()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close() // the first broker refuses connections
+
+	ops := NewClientOptions().AddBroker("tcp://" + closed.Addr().String()).AddBroker("tcp://" + l.Addr().String()).SetProtocolVersion(4)
+	c := NewClient(ops).(*client)
+	if c.ConnectedBroker() != nil {
+		t.Fatalf("broker should be nil when not connected")
+	}
+	conn, _, _, err := c.attemptConnection(&ConnectTimings{})
+	if err != nil {
+		t.Fatalf("connection failed: %v", err)
+	}
+	defer conn.Close()
+	c.conn = conn
+	if b := c.ConnectedBroker(); b == nil || b.Host != l.Addr().String() {
+		t.Fatalf("expected the second broker, got %v", b)
+	}
+}
+
+func Test_prefixTopic(t *testing.T) {
+	c := NewClient(NewClientOptions().SetTopicPrefix("tenant/")).(*client)
+
+	for topic, expected := range map[string]string{
+		"a/b":            "tenant/a/b",
+		"$share/grp/a/#": "$share/grp/tenant/a/#",
+		"$queue/a/+":     "$queue/tenant/a/+",
+		"$SYS/#":         "$SYS/#",
+	} {
+		if p := c.prefixTopic(topic); p != expected {
+			t.Errorf("prefixTopic(%q) = %q, expected %q", topic, p, expected)
+		}
+	}
+
+	c = NewClient(NewClientOptions()).(*client)
+	if p := c.prefixTopic("a/b"); p != "a/b" {
+		t.Errorf("topic should be unchanged without a prefix, got %q", p)
+	}
+}
+
+func Test_ConnackError(t *testing.T) {
+	var err error = &ConnackError{Code: packets.ErrRefusedNotAuthorised}
+
+	var ce *ConnackError
+	if !errors.As(err, &ce) || ce.Code != packets.ErrRefusedNotAuthorised {
+		t.Fatalf("errors.As should retrieve the CONNACK return code")
+	}
+	if !errors.Is(err, packets.ConnErrors[packets.ErrRefusedNotAuthorised]) {
+		t.Fatalf("errors.Is should match the packets.ConnErrors value")
+	}
+	if err.Error() != packets.ConnErrors[packets.ErrRefusedNotAuthorised].Error() {
+		t.Fatalf("unexpected error text %q", err.Error())
+	}
+}
+
+func Test_SubscribeFunc(t *testing.T) {
+	c := NewClient(NewClientOptions())
+
+	sub := c.SubscribeFunc("a/b", 1, func(Client, Message) {})
+	if sub.Wait() && sub.Error() != ErrNotConnected {
+		t.Fatalf("expected ErrNotConnected, got %v", sub.Error())
+	}
+	if token := sub.Unsubscribe(); token.Wait() && token.Error() != ErrNotConnected {
+		t.Fatalf("expected ErrNotConnected, got %v", token.Error())
+	}
+}
+
+type testValidator struct{}
+
+func (testValidator) Validate(payload []byte) error {
+	if string(payload) != "valid" {
+		return errors.New("invalid payload")
+	}
+	return nil
+}
+
+func Test_validatingHandler(t *testing.T) {
+	var handled, invalid []string
+	var invalidErr error
+	h := validatingHandler(testValidator{},
+		func(_ Client, m Message) { handled = append(handled, string(m.Payload())) },
+		func(_ Client, m Message, err error) { invalid = append(invalid, string(m.Payload())); invalidErr = err })
+
+	for _, payload := range []string{"valid", "junk"} {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.TopicName = "a/b"
+		pub.Payload = []byte(payload)
+		h(nil, messageFromPublish(pub, func() {}))
+	}
+	if len(handled) != 1 || handled[0] != "valid" {
+		t.Fatalf("expected only the valid message to be handled, got %v", handled)
+	}
+	if len(invalid) != 1 || invalid[0] != "junk" || invalidErr == nil {
+		t.Fatalf("expected the invalid message to be passed to the invalid handler, got %v (%v)", invalid, invalidErr)
+	}
+
+	// Without an invalid handler the message is just dropped
+	handled = nil
+	h = validatingHandler(testValidator{}, func(_ Client, m Message) { handled = append(handled, string(m.Payload())) }, nil)
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.Payload = []byte("junk")
+	h(nil, messageFromPublish(pub, func() {}))
+	if len(handled) != 0 {
+		t.Fatalf("invalid message should not be handled")
+	}
+}
+
+func Test_resubscribe(t *testing.T) {
+	c := NewClient(NewClientOptions().SetDeferredSubscribe(true).SetAlwaysResubscribeOnSessionAbsent(true)).(*client)
+
+	c.Subscribe("a/b", 1, nil)
+	c.SubscribeMultiple(map[string]byte{"c/d": 2, "e/f": 0}, nil)
+	c.untrackSubscriptions([]string{"e/f"})
+
+	go c.resubscribe()
+	select {
+	case pt := <-c.oboundP:
+		sub := pt.p.(*packets.SubscribePacket)
+		got := make(map[string]byte)
+		for i, topic := range sub.Topics {
+			got[topic] = sub.Qoss[i]
+		}
+		if len(got) != 2 || got["a/b"] != 1 || got["c/d"] != 2 {
+			t.Fatalf("unexpected resubscribe topics %v", got)
+		}
+		if sub.MessageID == 0 {
+			t.Fatalf("resubscribe should allocate a message id")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("resubscribe did not send a SUBSCRIBE")
+	}
+}
+
+func Test_ConnectProgressHandler(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() { // minimal broker: accept a single connection
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := packets.ReadPacket(conn); err != nil {
+			return
+		}
+		packets.NewControlPacket(packets.Connack).Write(conn)
+	}()
+
+	var phases []ConnectPhase // only appended to by the goroutine making the attempt
+	o := NewClientOptions().AddBroker("tcp://" + l.Addr().String())
+	o.SetConnectProgressHandler(func(phase ConnectPhase) { phases = append(phases, phase) })
+	c := NewClient(o).(*client)
+	conn, rc, _, err := c.attemptConnection(&ConnectTimings{})
+	if err != nil || rc != packets.Accepted {
+		t.Fatalf("connection failed: %d %v", rc, err)
+	}
+	conn.Close()
+	want := []ConnectPhase{ConnectPhaseDialing, ConnectPhaseSendingConnect, ConnectPhaseWaitingConnack}
+	if !reflect.DeepEqual(phases, want) {
+		t.Errorf("expected phases %v, got %v", want, phases)
+	}
+}
+
+func Test_ExistingConn(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	go func() { // minimal broker: accept the connection then discard everything else
+		cp, err := packets.ReadPacket(remote)
+		if err != nil {
+			return
+		}
+		if _, ok := cp.(*packets.ConnectPacket); !ok {
+			return
+		}
+		ca := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+		if ca.Write(remote) != nil {
+			return
+		}
+		for {
+			if _, err := packets.ReadPacket(remote); err != nil {
+				return
+			}
+		}
+	}()
+
+	c := NewClient(NewClientOptions().SetExistingConn(local).SetAutoReconnect(true)).(*client)
+	if c.options.AutoReconnect || c.options.ConnectRetry {
+		t.Fatalf("reconnecting should be disabled with an existing connection")
+	}
+	token := c.Connect()
+	token.(*ConnectToken).Timings() // may be read whilst connecting
+	if !token.WaitTimeout(time.Second) || token.Error() != nil {
+		t.Fatalf("connect over existing connection failed: %v", token.Error())
+	}
+	if !c.IsConnected() {
+		t.Fatalf("client should be connected")
+	}
+	if timings := token.(*ConnectToken).Timings(); timings.MQTTHandshake <= 0 || timings.Dial != 0 {
+		t.Fatalf("unexpected timings %+v", timings)
+	}
+	c.Disconnect(10)
+}
+
+func Test_DrainOnDisconnect(t *testing.T) {
+	const messages = 5
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	go func() { // minimal broker: accept the connection, send some messages then discard everything else
+		if _, err := packets.ReadPacket(remote); err != nil {
+			return
+		}
+		if packets.NewControlPacket(packets.Connack).Write(remote) != nil {
+			return
+		}
+		for i := 0; i < messages; i++ {
+			pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+			pub.TopicName = "a/b"
+			pub.Payload = []byte("payload")
+			if pub.Write(remote) != nil {
+				return
+			}
+		}
+		for {
+			if _, err := packets.ReadPacket(remote); err != nil {
+				return
+			}
+		}
+	}()
+
+	var started, handled int32
+	opts := NewClientOptions().SetExistingConn(local).SetOrderMatters(false).SetDrainOnDisconnect(true)
+	opts.SetDefaultPublishHandler(func(Client, Message) {
+		atomic.AddInt32(&started, 1)
+		time.Sleep(100 * time.Millisecond) // slow handler; still running when Disconnect is called
+		atomic.AddInt32(&handled, 1)
+	})
+	c := NewClient(opts).(*client)
+	if token := c.Connect(); !token.WaitTimeout(time.Second) || token.Error() != nil {
+		t.Fatalf("connect failed: %v", token.Error())
+	}
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&started) < messages; {
+		if time.Now().After(deadline) {
+			t.Fatalf("messages not received")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	c.Disconnect(2000)
+	if n := atomic.LoadInt32(&handled); n != messages {
+		t.Fatalf("expected %d messages to be handled before Disconnect returned, got %d", messages, n)
+	}
+}
+
+func Test_attemptConnection_CredentialsProvider(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close() // nothing listening so each attempt fails quickly
+
+	calls := 0
+	ops := NewClientOptions().AddBroker("tcp://" + addr).SetCredentialsProvider(func() (string, string) {
+		calls++
+		return "user", "token"
+	})
+	c := NewClient(ops).(*client)
+
+	for i := 1; i <= 2; i++ {
+		if _, _, _, err := c.attemptConnection(&ConnectTimings{}); err == nil {
+			t.Fatalf("connection should have failed")
+		}
+		if calls != i {
+			t.Fatalf("expected credentials to be requested for each attempt (%d), got %d", i, calls)
+		}
+	}
+}
+
+func Test_PublishReader(t *testing.T) {
+	c := NewClient(NewClientOptions())
+
+	if token := c.PublishReader("a/b", 0, false, strings.NewReader("abc"), -1); token.Error() != ErrPublishPayloadSize {
+		t.Fatalf("expected ErrPublishPayloadSize, got %v", token.Error())
+	}
+	if token := c.PublishReader("a/b", 1, false, strings.NewReader("abc"), 10); token.Error() == nil {
+		t.Fatalf("expected an error when the reader is short")
+	}
+	if token := c.PublishReader("a/b", 0, false, strings.NewReader("abc"), 3); token.Error() != ErrNotConnected {
+		t.Fatalf("expected ErrNotConnected, got %v", token.Error())
+	}
+}
+
+func Test_CoalesceTopics(t *testing.T) {
+	c := NewClient(NewClientOptions().SetCoalesceTopics([]string{"sensor/#"})).(*client)
+	c.setConnected(connected)
+
+	if c.coalescer.applies("sensor/a", 1) || c.coalescer.applies("other", 0) || !c.coalescer.applies("sensor/a", 0) {
+		t.Fatalf("coalescing applied to the wrong publishes")
+	}
+
+	first := make(chan Token)
+	go func() { first <- c.Publish("sensor/a", 0, false, "1") }()
+	for queued := false; !queued; {
+		c.coalescer.Lock()
+		queued = len(c.coalescer.pending) == 1
+		c.coalescer.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	second := c.Publish("sensor/a", 0, false, "2")
+	third := c.Publish("sensor/a", 0, false, "3")
+	if !second.WaitTimeout(time.Second) || second.Error() != nil {
+		t.Fatalf("expected replaced publish to complete without error")
+	}
+
+	pt := c.coalescer.take(<-c.obound)
+	if p := string(pt.p.(*packets.PublishPacket).Payload); p != "3" {
+		t.Fatalf("expected the most recent payload to be sent, got %q", p)
+	}
+	if pt.t != third.(tokenCompletor) {
+		t.Fatalf("expected the token of the most recent publish")
+	}
+	if token := <-first; !token.WaitTimeout(time.Second) {
+		t.Fatalf("expected first publish to complete")
+	}
+	if len(c.coalescer.pending) != 0 {
+		t.Fatalf("expected no pending publishes")
+	}
+}
+
+func Test_PendingInbound(t *testing.T) {
+	c := NewClient(NewClientOptions()).(*client)
+	c.persist.Open()
+	defer c.persist.Close()
+
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = "a/b"
+	pub.Qos = 1
+	pub.MessageID = 1
+	pub.Payload = []byte("one")
+	persistInbound(c.persist, pub)
+	pub2 := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub2.TopicName = "a/c"
+	pub2.Qos = 2
+	pub2.MessageID = 2
+	c.persist.Put(pubKey(2), pub2)
+	rel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+	rel.MessageID = 3
+	persistInbound(c.persist, rel)
+	out := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	out.Qos = 1
+	out.MessageID = 4
+	persistOutbound(c.persist, out)
+
+	msgs := c.PendingInbound()
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 pending messages, got %d", len(msgs))
+	}
+	for _, m := range msgs {
+		m.Ack()
+		if m.Topic() != "a/b" && m.Topic() != "a/c" {
+			t.Fatalf("unexpected message %s", m.Topic())
+		}
+	}
+	if len(c.persist.All()) != 4 {
+		t.Fatalf("messages should remain in the store")
+	}
+}
+
+func Test_MaxInitialConnectAttempts(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var accepted int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			conn.Close() // fail the attempt
+		}
+	}()
+
+	ops := NewClientOptions().AddBroker("tcp://" + l.Addr().String()).SetConnectRetry(true).
+		SetConnectRetryInterval(10 * time.Millisecond).SetMaxInitialConnectAttempts(3).SetProtocolVersion(4)
+	c := NewClient(ops)
+	token := c.Connect()
+	if !token.WaitTimeout(5 * time.Second) {
+		t.Fatalf("expected connect to give up")
+	}
+	if token.Error() == nil {
+		t.Fatalf("expected an error once the attempts are exhausted")
+	}
+	if n := atomic.LoadInt32(&accepted); n != 3 {
+		t.Fatalf("expected 3 connection attempts, got %d", n)
+	}
+	if c.IsConnected() {
+		t.Fatalf("client should not be connected")
+	}
+}
+
+// nxdomainResolver returns a resolver that answers every query with NXDOMAIN (name does not exist)
+func nxdomainResolver() *net.Resolver {
+	return &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+		local, remote := net.Pipe()
+		go func() {
+			defer remote.Close()
+			for {
+				var length [2]byte // not a PacketConn so queries are framed as per DNS over TCP
+				if _, err := io.ReadFull(remote, length[:]); err != nil {
+					return
+				}
+				query := make([]byte, int(length[0])<<8|int(length[1]))
+				if _, err := io.ReadFull(remote, query); err != nil || len(query) < 12 {
+					return
+				}
+				resp := append([]byte{}, query[:2]...)                  // ID
+				resp = append(resp, 0x81, 0x83, 0, 1, 0, 0, 0, 0, 0, 0) // response, NXDOMAIN, 1 question
+				resp = append(resp, query[12:]...)                      // the question (assumes no additional records)
+				if _, err := remote.Write(append([]byte{byte(len(resp) >> 8), byte(len(resp))}, resp...)); err != nil {
+					return
+				}
+			}
+		}()
+		return local, nil
+	}}
+}
+
+func Test_FailFastOnDNSError(t *testing.T) {
+	if !isHostNotFound(&net.DNSError{IsNotFound: true}) || isHostNotFound(&net.DNSError{IsTimeout: true}) {
+		t.Fatalf("DNS errors not classified correctly")
+	}
+
+	ops := NewClientOptions().AddBroker("tcp://broker.invalid:1883").SetResolver(nxdomainResolver()).
+		SetConnectRetry(true).SetConnectRetryInterval(time.Hour).SetFailFastOnDNSError(true)
+	token := NewClient(ops).Connect()
+	if !token.WaitTimeout(5 * time.Second) {
+		t.Fatalf("expected connect to fail without retrying")
+	}
+	var de *net.DNSError
+	if !errors.As(token.Error(), &de) || !de.IsNotFound {
+		t.Fatalf("expected the DNS error to be returned, got %v", token.Error())
+	}
+
+	// Without the option the connection is retried
+	c := NewClient(ops.SetFailFastOnDNSError(false))
+	token = c.Connect()
+	if token.WaitTimeout(100 * time.Millisecond) {
+		t.Fatalf("expected connect to be retried, got %v", token.Error())
+	}
+	c.Disconnect(0)
+}
+
+func Test_SubscribeWithRetry(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	var subscribes int32
+	go func() { // minimal broker: rejects the first subscription then grants the rest
+		if _, err := packets.ReadPacket(remote); err != nil {
+			return
+		}
+		if packets.NewControlPacket(packets.Connack).Write(remote) != nil {
+			return
+		}
+		for {
+			cp, err := packets.ReadPacket(remote)
+			if err != nil {
+				return
+			}
+			if sub, ok := cp.(*packets.SubscribePacket); ok {
+				sa := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+				sa.MessageID = sub.MessageID
+				sa.ReturnCodes = []byte{1}
+				if atomic.AddInt32(&subscribes, 1) == 1 {
+					sa.ReturnCodes = []byte{0x80}
+				}
+				go sa.Write(remote)
+			}
+		}
+	}()
+
+	c := NewClient(NewClientOptions().SetExistingConn(local)).(*client)
+	if token := c.Connect(); !token.WaitTimeout(time.Second) || token.Error() != nil {
+		t.Fatalf("connect failed: %v", token.Error())
+	}
+	defer c.Disconnect(10)
+
+	token := c.SubscribeWithRetry("a/b", 1, nil, RetryPolicy{InitialInterval: 10 * time.Millisecond, MaxAttempts: 3})
+	if !token.WaitTimeout(2*time.Second) || token.Error() != nil {
+		t.Fatalf("subscribe should succeed after retrying: %v", token.Error())
+	}
+	if n := atomic.LoadInt32(&subscribes); n != 2 {
+		t.Fatalf("expected 2 subscribe attempts, got %d", n)
+	}
+	if r := token.(*SubscribeToken).Result(); r["a/b"] != 1 {
+		t.Fatalf("unexpected result %v", r)
+	}
+}
+
+func Test_SubscribeWithRetry_Disconnect(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	var subscribes int32
+	go func() { // minimal broker: rejects every subscription
+		if _, err := packets.ReadPacket(remote); err != nil {
+			return
+		}
+		if packets.NewControlPacket(packets.Connack).Write(remote) != nil {
+			return
+		}
+		for {
+			cp, err := packets.ReadPacket(remote)
+			if err != nil {
+				return
+			}
+			if sub, ok := cp.(*packets.SubscribePacket); ok {
+				sa := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+				sa.MessageID = sub.MessageID
+				sa.ReturnCodes = []byte{0x80}
+				atomic.AddInt32(&subscribes, 1)
+				go sa.Write(remote)
+			}
+		}
+	}()
+
+	c := NewClient(NewClientOptions().SetExistingConn(local)).(*client)
+	if token := c.Connect(); !token.WaitTimeout(time.Second) || token.Error() != nil {
+		t.Fatalf("connect failed: %v", token.Error())
+	}
+
+	token := c.SubscribeWithRetry("a/b", 1, nil, RetryPolicy{InitialInterval: time.Hour})
+	for i := 0; atomic.LoadInt32(&subscribes) == 0; i++ {
+		if i > 100 {
+			t.Fatalf("subscribe not received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Disconnect(10)
+	if !token.WaitTimeout(time.Second) {
+		t.Fatalf("token should complete when the client is disconnected")
+	}
+	if token.Error() == nil {
+		t.Fatalf("expected an error")
+	}
+}
+
+func Test_RetryPolicy(t *testing.T) {
+	p := RetryPolicy{MaxInterval: 3 * time.Second, MaxAttempts: 2}
+	if d := p.initial(); d != time.Second {
+		t.Fatalf("expected default initial interval, got %v", d)
+	}
+	if d := p.next(time.Second); d != 2*time.Second {
+		t.Fatalf("expected delay to double, got %v", d)
+	}
+	if d := p.next(2 * time.Second); d != 3*time.Second {
+		t.Fatalf("expected delay to be limited, got %v", d)
+	}
+	if p.exhausted(1) || !p.exhausted(2) || (RetryPolicy{}).exhausted(100) {
+		t.Fatalf("unexpected exhaustion")
+	}
+
+	c := NewClient(NewClientOptions())
+	token := c.SubscribeWithRetry("a/b", 1, nil, RetryPolicy{})
+	if !token.WaitTimeout(time.Second) || token.Error() != ErrNotConnected {
+		t.Fatalf("expected ErrNotConnected when disconnected, got %v", token.Error())
+	}
+}
+
+func Test_ReplaceHandler(t *testing.T) {
+	c := NewClient(NewClientOptions().SetTopicPrefix("tenant/")).(*client)
+	received := make(chan string, 1)
+
+	if err := c.ReplaceHandler("a/+", func(Client, Message) {}); err != ErrNotSubscribed {
+		t.Fatalf("expected ErrNotSubscribed, got %v", err)
+	}
+
+	sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	sub.Topics = []string{c.prefixTopic("a/+")}
+	sub.Qoss = []byte{1}
+	c.trackSubscriptions(sub)
+	c.msgRouter.addRoute(c.prefixTopic("a/+"), func(Client, Message) { received <- "original" })
+
+	if err := c.ReplaceHandler("a/+", nil); err == nil {
+		t.Fatalf("expected an error for a nil handler")
+	}
+	if err := c.ReplaceHandler("a/+", func(Client, Message) { received <- "replacement" }); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = "tenant/a/b"
+	c.msgRouter.runHandlers(pub, true, c)
+	if h := <-received; h != "replacement" {
+		t.Fatalf("expected the replacement handler, got %q", h)
+	}
+	if c.msgRouter.routes.Len() != 1 {
+		t.Fatalf("expected the route to be replaced, have %d routes", c.msgRouter.routes.Len())
+	}
+}
+
+func Test_checkClientID(t *testing.T) {
+	if checkClientID(NewClientOptions()) != "" {
+		t.Fatalf("empty ClientID with CleanSession should be accepted")
+	}
+	if checkClientID(NewClientOptions().SetCleanSession(false)) == "" {
+		t.Fatalf("empty ClientID without CleanSession should be reported")
+	}
+	if checkClientID(NewClientOptions().SetClientID("id").SetCleanSession(false)) != "" {
+		t.Fatalf("ClientID without CleanSession should be accepted")
+	}
+}
+
+func Test_checkWillProperties(t *testing.T) {
+	o := NewClientOptions().SetWill("will/topic", "gone", 1, false)
+	if checkWillProperties(o) != "" {
+		t.Fatalf("a will without properties should be accepted")
+	}
+	o.SetWillDelayInterval(time.Minute).SetWillPayloadFormat(true).SetWillContentType("text/plain")
+	if checkWillProperties(o) == "" {
+		t.Fatalf("will properties should be reported as not sent")
+	}
+	r := ClientOptionsReader{options: o}
+	if r.WillDelayInterval() != time.Minute || !r.WillPayloadUTF8() || r.WillContentType() != "text/plain" {
+		t.Fatalf("will properties not recorded")
+	}
+	o.UnsetWill()
+	if o.WillDelayInterval != 0 || o.WillPayloadUTF8 || o.WillContentType != "" {
+		t.Fatalf("UnsetWill should clear the will properties")
+	}
+}
+
+func Test_Dump(t *testing.T) {
+	c := NewClient(NewClientOptions()).(*client)
+	s := c.Dump()
+	if s.Status != "disconnected" || s.Broker != "" || len(s.Subscriptions) != 0 || len(s.InflightMessageIDs) != 0 {
+		t.Fatalf("unexpected state for a new client: %+v", s)
+	}
+
+	c.subscriptions["a/b"] = 1
+	c.messageIds.claimID(newToken(packets.Publish), 7)
+	c.messageIds.claimID(newToken(packets.Publish), 3)
+	c.pingSentAt.Store(time.Now().Add(-50 * time.Millisecond))
+	atomic.StoreInt32(&c.pingOutstanding, 1)
+	c.pingRespReceived()
+	c.setConnected(connected)
+
+	s = c.Dump()
+	if s.Status != "connected" {
+		t.Fatalf("expected connected, got %s", s.Status)
+	}
+	if s.Subscriptions["a/b"] != 1 || len(s.Subscriptions) != 1 {
+		t.Fatalf("unexpected subscriptions %v", s.Subscriptions)
+	}
+	if len(s.InflightMessageIDs) != 2 || s.InflightMessageIDs[0] != 3 || s.InflightMessageIDs[1] != 7 {
+		t.Fatalf("unexpected inflight IDs %v", s.InflightMessageIDs)
+	}
+	if s.LastPingRTT < 50*time.Millisecond || s.PingOutstanding {
+		t.Fatalf("unexpected ping state: rtt %v, outstanding %v", s.LastPingRTT, s.PingOutstanding)
+	}
+	if _, err := json.Marshal(s); err != nil {
+		t.Fatalf("state should be serialisable: %v", err)
+	}
+}
+
+func Test_PublishWithContext(t *testing.T) {
+	c := NewClient(NewClientOptions()).(*client)
+	c.persist.Open()
+	c.setConnected(connected)
+	c.obound = make(chan *PacketAndToken, 1) // nothing will acknowledge the publish
+
+	ctx, cancel := context.WithCancel(context.Background())
+	token := c.PublishWithContext(ctx, "a/b", 2, false, "payload").(*PublishToken)
+	if token.messageID == 0 || c.getToken(token.messageID) != token {
+		t.Fatalf("expected a message ID to be reserved")
+	}
+	if len(c.persist.All()) != 1 {
+		t.Fatalf("expected the publish to be stored")
+	}
+
+	cancel()
+	if err := token.WaitContext(context.Background()); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if len(c.persist.All()) != 0 {
+		t.Fatalf("publish should have been removed from the store")
+	}
+	// the packet is still queued so the ID must not be reused until it has been dropped
+	if c.getToken(token.messageID) != token {
+		t.Fatalf("message ID released whilst the publish is queued")
+	}
+	local, remote := net.Pipe()
+	defer remote.Close()
+	conn := &countingConn{Conn: local}
+	oboundP, fromIncomming := make(chan *PacketAndToken), make(chan *PacketAndToken)
+	close(oboundP)
+	close(fromIncomming)
+	close(c.obound)
+	for range startOutgoingComms(conn, c, oboundP, c.obound, fromIncomming) {
+	}
+	if _, ok := c.getToken(token.messageID).(*DummyToken); !ok {
+		t.Fatalf("message ID should have been released")
+	}
+	if atomic.LoadInt32(&conn.writes) != 0 {
+		t.Fatalf("cancelled publish should not have been written")
+	}
+
+	token = c.PublishWithContext(ctx, "a/b", 1, false, "payload").(*PublishToken)
+	if token.Error() != context.Canceled || token.messageID != 0 {
+		t.Fatalf("publish with a done context should fail immediately, got %v", token.Error())
+	}
+}
+
+func Test_SubscribeSys(t *testing.T) {
+	c := NewClient(NewClientOptions()).(*client)
+	for _, filter := range []string{"a/#", "#", "$SYS", "$share/grp/$SYS/#"} {
+		if err := c.SubscribeSys(filter, func(Client, Message) {}).Error(); err != ErrNotSysTopic {
+			t.Errorf("SubscribeSys(%q) expected ErrNotSysTopic, got %v", filter, err)
+		}
+	}
+	if err := c.SubscribeSys("$SYS/#", func(Client, Message) {}).Error(); err != ErrNotConnected {
+		t.Errorf("expected the subscription to be attempted, got %v", err)
+	}
+}
+
+func Test_InvalidQos(t *testing.T) {
+	c := NewClient(NewClientOptions()).(*client)
+	for _, qos := range []byte{3, 255} {
+		if err := c.Subscribe("a/b", qos, nil).Error(); err != ErrInvalidQos {
+			t.Errorf("Subscribe with QoS %d: expected ErrInvalidQos, got %v", qos, err)
+		}
+		if err := c.SubscribeMultiple(map[string]byte{"a/b": 1, "c": qos}, nil).Error(); err != ErrInvalidQos {
+			t.Errorf("SubscribeMultiple with QoS %d: expected ErrInvalidQos, got %v", qos, err)
+		}
+		if err := c.Publish("a/b", qos, false, "payload").Error(); err != ErrInvalidQos {
+			t.Errorf("Publish with QoS %d: expected ErrInvalidQos, got %v", qos, err)
+		}
+		if err := c.PublishReader("a/b", qos, false, strings.NewReader("payload"), 7).Error(); err != ErrInvalidQos {
+			t.Errorf("PublishReader with QoS %d: expected ErrInvalidQos, got %v", qos, err)
+		}
+	}
+}
+
+func Test_SubscribeRouteInstalledBeforeSend(t *testing.T) {
+	c := NewClient(NewClientOptions()).(*client)
+	c.persist.Open()
+	c.setConnected(connected)
+	c.oboundP = make(chan *PacketAndToken)
+
+	hasRoute := func(topic string) bool {
+		c.msgRouter.RLock()
+		defer c.msgRouter.RUnlock()
+		for e := c.msgRouter.routes.Front(); e != nil; e = e.Next() {
+			if e.Value.(*route).topic == topic {
+				return true
+			}
+		}
+		return false
+	}
+
+	handler := func(Client, Message) {}
+	go c.Subscribe("a/b", 1, handler)
+	<-c.oboundP
+	if !hasRoute("a/b") {
+		t.Error("route not installed when SUBSCRIBE was sent")
+	}
+
+	go c.SubscribeMultiple(map[string]byte{"c/d": 0, "e/#": 1}, handler)
+	<-c.oboundP
+	for _, topic := range []string{"c/d", "e/#"} {
+		if !hasRoute(topic) {
+			t.Errorf("route for %s not installed when SUBSCRIBE was sent", topic)
+		}
+	}
+}
+
+func Test_PressureLevel(t *testing.T) {
+	c := NewClient(NewClientOptions().SetMaxInflight(4).SetMaxStoreBytes(1000)).(*client)
+	c.persist.Open()
+	if l := c.PressureLevel(); l != 0 {
+		t.Fatalf("expected 0 when idle, got %d", l)
+	}
+
+	c.publishInflight <- struct{}{}
+	if l := c.PressureLevel(); l != 25 {
+		t.Errorf("expected 25 with 1 of 4 publishes inflight, got %d", l)
+	}
+
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = "a"
+	pub.Payload = make([]byte, 893) // 900 bytes in the store
+	c.persist.Put(inboundKeyFromMID(1), pub)
+	if l := c.PressureLevel(); l != 90 {
+		t.Errorf("expected 90 with the store 90%% full, got %d", l)
+	}
+
+	for i := 0; i < 4000; i++ {
+		c.getID(newToken(packets.Publish).(*PublishToken))
+	}
+	if l := c.PressureLevel(); l != 90 {
+		t.Errorf("expected the highest utilisation (90) to be used, got %d", l)
+	}
+}
+
+func Test_MaxSubscribeBatch(t *testing.T) {
+	c := NewClient(NewClientOptions().SetMaxSubscribeBatch(2)).(*client)
+	c.persist.Open()
+	c.setConnected(connected)
+	c.oboundP = make(chan *PacketAndToken, 10)
+
+	filters := map[string]byte{"a": 0, "b": 1, "c": 2, "d": 1, "e": 0}
+	token := c.SubscribeMultiple(filters, nil).(*SubscribeToken)
+	if len(c.oboundP) != 3 {
+		t.Fatalf("expected 3 SUBSCRIBE packets, got %d", len(c.oboundP))
+	}
+	for i := 0; i < 3; i++ {
+		pt := <-c.oboundP
+		sub := pt.p.(*packets.SubscribePacket)
+		if len(sub.Topics) > 2 {
+			t.Fatalf("batch %d has %d topics", i, len(sub.Topics))
+		}
+		if token.WaitTimeout(10 * time.Millisecond) {
+			t.Fatal("token completed before all SUBACKs were received")
+		}
+		st := pt.t.(*SubscribeToken)
+		for j, topic := range st.subs {
+			st.subResult[topic] = st.qoss[j]
+		}
+		st.flowComplete()
+	}
+	if !token.WaitTimeout(time.Second) {
+		t.Fatal("token did not complete")
+	}
+	if err := token.Error(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := token.Result(); !reflect.DeepEqual(got, filters) {
+		t.Errorf("expected result %v, got %v", filters, got)
+	}
+
+	// an invalid filter means nothing is sent
+	token = c.SubscribeMultiple(map[string]byte{"a": 0, "b": 1, "c/#/d": 0}, nil).(*SubscribeToken)
+	if token.Error() == nil || len(c.oboundP) != 0 {
+		t.Errorf("expected an error and no packets, got %v and %d packets", token.Error(), len(c.oboundP))
+	}
+}
+
+func Test_PersistSubscriptions(t *testing.T) {
+	store := NewMemoryStore()
+	opts := NewClientOptions().SetCleanSession(false).SetStore(store).SetPersistSubscriptions(true)
+	c := NewClient(opts).(*client)
+	c.persist.Open()
+	c.setConnected(connected)
+	c.oboundP = make(chan *PacketAndToken, 10)
+	c.SubscribeMultiple(map[string]byte{"a/b": 1, "c/#": 2, "d": 0}, nil)
+	c.Unsubscribe("d")
+
+	// simulate a restart; the subscriptions should be loaded from the store and resent if the session is absent
+	c2 := NewClient(opts).(*client)
+	c2.persist.Open()
+	c2.loadPersistedSubscriptions()
+	want := map[string]byte{"a/b": 1, "c/#": 2}
+	if !reflect.DeepEqual(c2.subscriptions, want) {
+		t.Fatalf("expected subscriptions %v, got %v", want, c2.subscriptions)
+	}
+	c2.setConnected(connected)
+	c2.oboundP = make(chan *PacketAndToken, 1)
+	c2.resubscribe()
+	sub := (<-c2.oboundP).p.(*packets.SubscribePacket)
+	if len(sub.Topics) != 2 {
+		t.Errorf("expected resubscribe to 2 topics, got %v", sub.Topics)
+	}
+
+	// nothing is persisted with a clean session
+	opts.SetCleanSession(true)
+	store.Reset()
+	c3 := NewClient(opts).(*client)
+	c3.persist.Open()
+	c3.setConnected(connected)
+	c3.oboundP = make(chan *PacketAndToken, 10)
+	c3.Subscribe("a/b", 1, nil)
+	for _, key := range store.All() {
+		if key == subscriptionsKey {
+			t.Error("subscriptions persisted with CleanSession set")
+		}
+	}
+}
+
+func Test_Request(t *testing.T) {
+	c := NewClient(NewClientOptions()).(*client)
+	c.persist.Open()
+	c.setConnected(connected)
+	c.oboundP = make(chan *PacketAndToken, 10)
+	c.obound = make(chan *PacketAndToken, 10)
+
+	go func() { // act as the broker and the responder
+		pt := <-c.oboundP
+		st := pt.t.(*SubscribeToken)
+		st.subResult[st.subs[0]] = 0
+		st.flowComplete()
+
+		pt = <-c.obound
+		req := pt.p.(*packets.PublishPacket)
+		pt.t.flowComplete()
+		replyTopic, body, err := DecodeRequest(req.Payload)
+		if err != nil || req.TopicName != "service/echo" || !strings.HasPrefix(replyTopic, "replies/") {
+			t.Errorf("unexpected request %q on %q: %v", req.Payload, req.TopicName, err)
+			return
+		}
+		resp := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		resp.TopicName = replyTopic
+		resp.Payload = append([]byte("echo: "), body...)
+		c.msgRouter.runHandlers(resp, true, c)
+	}()
+
+	m, err := c.Request(context.Background(), "service/echo", 0, []byte("ping"), "replies", time.Second)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if string(m.Payload()) != "echo: ping" {
+		t.Errorf("unexpected response %q", m.Payload())
+	}
+
+	// no response
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.Request(ctx, "service/echo", 0, []byte("ping"), "replies", time.Second); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if _, err := c.Request(context.Background(), "service/echo", 0, nil, "bad\ntopic", time.Second); err != ErrInvalidResponseTopic {
+		t.Errorf("expected ErrInvalidResponseTopic, got %v", err)
+	}
+	if _, _, err := DecodeRequest([]byte("no header")); err != ErrNotRequest {
+		t.Errorf("expected ErrNotRequest, got %v", err)
+	}
+}
+
+func Test_Request_correlationID(t *testing.T) {
+	c := NewClient(NewClientOptions()).(*client)
+	a, err := c.newCorrelationID()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b, _ := c.newCorrelationID()
+	if len(a) != 34 || !strings.HasSuffix(a, "-1") || !strings.HasSuffix(b, "-2") {
+		t.Fatalf("unexpected IDs %q and %q", a, b)
+	}
+
+	defer setRandReader(strings.NewReader(""))()
+	if _, err := c.newCorrelationID(); err == nil {
+		t.Fatalf("expected an error when no random bytes are available")
+	}
+	if _, err := c.Request(context.Background(), "service/echo", 0, nil, "replies", time.Second); err == nil {
+		t.Fatalf("expected Request to fail when no correlation ID can be generated")
+	}
+}
+
+func Test_MaxInflight(t *testing.T) {
+	const limit = 2
+	c := NewClient(NewClientOptions().SetMaxInflight(limit)).(*client)
+	c.persist.Open()
+	c.setConnected(connected)
+	c.obound = make(chan *PacketAndToken, 10)
+
+	go func() {
+		for i := 0; i < 5; i++ {
+			c.Publish("a/b", 1, false, "payload")
+		}
+	}()
+
+	for acked := 0; acked < 5; acked++ {
+		var pt *PacketAndToken
+		select {
+		case pt = <-c.obound:
+		case <-time.After(time.Second):
+			t.Fatalf("publish %d not sent", acked)
+		}
+		time.Sleep(20 * time.Millisecond) // allow any further publishes to be sent
+		c.messageIds.RLock()
+		inflight := len(c.messageIds.index)
+		c.messageIds.RUnlock()
+		if inflight > limit {
+			t.Fatalf("%d publishes in flight, limit %d", inflight, limit)
+		}
+		// acknowledge the oldest publish
+		pt.t.flowComplete()
+		c.freeID(pt.p.Details().MessageID)
+	}
+}
+
+func Test_MaxInflight_timeout(t *testing.T) {
+	c := NewClient(NewClientOptions().SetMaxInflight(1).SetWriteTimeout(50 * time.Millisecond)).(*client)
+	c.persist.Open()
+	c.setConnected(connected)
+	c.obound = make(chan *PacketAndToken, 10)
+
+	first := c.Publish("a/b", 1, false, "payload").(*PublishToken)
+	second := c.Publish("a/b", 1, false, "payload")
+	if !second.WaitTimeout(time.Second) {
+		t.Fatalf("publish blocked waiting for an inflight slot")
+	}
+	if second.Error() != ErrPublishTimeout {
+		t.Fatalf("expected ErrPublishTimeout, got %v", second.Error())
+	}
+
+	first.setError(ErrNotConnected) // e.g. completed by Disconnect
+	if len(c.publishInflight) != 0 {
+		t.Fatalf("inflight slot not released when the publish completed")
+	}
+}
+
+func Test_TryPublish(t *testing.T) {
+	c := NewClient(NewClientOptions()).(*client)
+	c.persist.Open()
+
+	if token, ok := c.TryPublish("a/b", 1, false, "payload"); ok || token.Error() != ErrNotConnected {
+		t.Fatalf("expected ErrNotConnected, got %v", token.Error())
+	}
+
+	c.setConnected(connected)
+	c.obound = make(chan *PacketAndToken, 1)
+	if _, ok := c.TryPublish("a/b", 1, false, "payload"); !ok {
+		t.Fatalf("publish should have been queued")
+	}
+	token, ok := c.TryPublish("a/b", 1, false, "payload")
+	if ok || token.Error() != ErrPublishQueueFull {
+		t.Fatalf("expected ErrPublishQueueFull, got %v", token.Error())
+	}
+	if n := len(c.persist.All()); n != 1 {
+		t.Fatalf("only the queued publish should be stored, found %d", n)
+	}
+	c.messageIds.RLock()
+	inUse := len(c.messageIds.index)
+	c.messageIds.RUnlock()
+	if inUse != 1 {
+		t.Fatalf("only the queued publish should hold a message ID, found %d", inUse)
+	}
+	if _, ok := c.TryPublish("a/b", 0, false, "payload"); ok {
+		t.Fatalf("QoS 0 publish should not have been queued")
+	}
+}
+
+func Test_Connect_InvalidHTTPProxy(t *testing.T) {
+	ops := NewClientOptions().AddBroker("tcp://127.0.0.1:1").SetHTTPProxy("http://proxy:bad port")
+	if ops.HTTPProxy != nil {
+		t.Fatalf("expected no proxy to be set, got %v", ops.HTTPProxy)
+	}
+	c := NewClient(ops)
+	token := c.Connect()
+	if !token.WaitTimeout(time.Second) || token.Error() == nil || !strings.Contains(token.Error().Error(), "proxy") {
+		t.Fatalf("expected proxy parse error, got %v", token.Error())
+	}
+	if c.IsConnected() {
+		t.Fatalf("client should not be connected")
+	}
+}
+
+func Test_OutboundTopicRewriter(t *testing.T) {
+	c := NewClient(NewClientOptions().SetTopicPrefix("tenant/").SetOutboundTopicRewriter(func(topic string, payload []byte) string {
+		return topic + "/" + string(payload[:1])
+	})).(*client)
+	c.persist.Open()
+	c.setConnected(connected)
+	c.obound = make(chan *PacketAndToken, 1)
+
+	token := c.Publish("a/b", 1, false, "key1").(*PublishToken)
+	pt := <-c.obound
+	if topic := pt.p.(*packets.PublishPacket).TopicName; topic != "tenant/a/b/k" {
+		t.Fatalf("expected the rewritten, prefixed, topic; got %q", topic)
+	}
+	if token.topic != "a/b/k" {
+		t.Fatalf("expected the token to hold the rewritten topic, got %q", token.topic)
+	}
+
+	if err := c.Publish("a/b", 0, false, "#").Error(); err != ErrInvalidTopicWildcard {
+		t.Fatalf("rewritten topic should be validated, got %v", err)
+	}
+}
+
+// recordingLogger records the lines logged
+type recordingLogger struct {
+	lines []string
+}
+
+func (r *recordingLogger) Println(v ...interface{}) {
+	r.lines = append(r.lines, strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+
+func (r *recordingLogger) Printf(format string, v ...interface{}) {
+	r.lines = append(r.lines, fmt.Sprintf(format, v...))
+}
+
+func Test_ConnectionID(t *testing.T) {
+	rec := &recordingLogger{}
+	var l Logger = rec
+	p := prefixLogger{l: &l, prefix: "[conn%1]"}
+	p.Println(CLI, "hello")
+	p.Printf("%s value %d", CLI, 5)
+	if len(rec.lines) != 2 || rec.lines[0] != "[conn%1] "+string(CLI)+" hello" || rec.lines[1] != "[conn%1] "+string(CLI)+" value 5" {
+		t.Fatalf("unexpected log output %q", rec.lines)
+	}
+	l = NOOPLogger{}
+	p.Println("ignored")
+	if len(rec.lines) != 2 {
+		t.Fatalf("changes to the underlying logger should take effect immediately")
+	}
+
+	sink := make(chan ClientEvent, 1)
+	c := NewClient(NewClientOptions().SetConnectionID("conn1").SetEventSink(sink)).(*client)
+	r := c.OptionsReader()
+	if id := r.ConnectionID(); id != "conn1" {
+		t.Fatalf("expected conn1, got %q", id)
+	}
+	c.emitEvent(ClientEvent{Type: EventDisconnected})
+	if e := <-sink; e.ConnectionID != "conn1" {
+		t.Fatalf("expected the event to carry the connection ID, got %q", e.ConnectionID)
+	}
+
+	a := NewClient(NewClientOptions()).OptionsReader()
+	b := NewClient(NewClientOptions()).OptionsReader()
+	if a.ConnectionID() == "" || a.ConnectionID() == b.ConnectionID() {
+		t.Fatalf("expected distinct generated IDs, got %q and %q", a.ConnectionID(), b.ConnectionID())
+	}
+}
+
+// setRandReader replaces the source of random bytes until the returned function is called
+func setRandReader(r io.Reader) (restore func()) {
+	prev := randReader
+	randReader = r
+	return func() { randReader = prev }
+}
+
+func Test_ConnectionID_randReader(t *testing.T) {
+	defer setRandReader(strings.NewReader("\x01\x02\x03\x04"))()
+	r := NewClient(NewClientOptions()).OptionsReader()
+	if id := r.ConnectionID(); id != "01020304" {
+		t.Fatalf("expected ID from the injected source, got %q", id)
+	}
+	// the source is exhausted so the fallback is used
+	if id := newConnectionID(); id != "client" {
+		t.Fatalf("expected the fallback ID, got %q", id)
+	}
+}
+
+func Test_ConnectionID_internalLogging(t *testing.T) {
+	rec := &recordingLogger{}
+	old := DEBUG
+	DEBUG = rec
+	defer func() { DEBUG = old }()
+
+	c := NewClient(NewClientOptions().SetConnectionID("conn1")).(*client)
+	c.messageIds.cleanUp()
+	if len(rec.lines) != 1 || !strings.HasPrefix(rec.lines[0], "[conn1] ") {
+		t.Fatalf("expected a line with the connection ID prefix, got %q", rec.lines)
+	}
+}
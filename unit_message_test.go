@@ -13,8 +13,11 @@
 package mqtt
 
 import (
+	"bytes"
 	"net/url"
 	"testing"
+
+	"github.com/90poe/paho.mqtt.golang/packets"
 )
 
 func Test_UsernamePassword(t *testing.T) {
@@ -64,3 +67,29 @@ func Test_BrokerCredentials(t *testing.T) {
 		t.Fatalf("Password not set correctly")
 	}
 }
+
+func Test_newConnectMsgFromOptions_keepalive(t *testing.T) {
+	for keepalive, expected := range map[int64]uint16{-5: 0, 0: 0, 30: 30, 100000: 65535} {
+		options := NewClientOptions()
+		options.KeepAlive = keepalive
+		if m := newConnectMsgFromOptions(options, &url.URL{}); m.Keepalive != expected {
+			t.Errorf("keepalive %d: expected %d, got %d", keepalive, expected, m.Keepalive)
+		}
+	}
+}
+
+func Test_messageFromPublish_rawHeader(t *testing.T) {
+	for _, header := range []byte{0x30, 0x31, 0x3a, 0x3d, 0x36} {
+		raw := []byte{header, 5, 0, 3, 'a', '/', 'b'}
+		if header&0x06 != 0 {
+			raw = []byte{header, 7, 0, 3, 'a', '/', 'b', 0, 1}
+		}
+		cp, err := packets.ReadPacket(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatalf("header %#x: %v", header, err)
+		}
+		if m := messageFromPublish(cp.(*packets.PublishPacket), func() {}); m.RawHeader() != header {
+			t.Errorf("expected raw header %#x, got %#x", header, m.RawHeader())
+		}
+	}
+}
@@ -77,3 +77,42 @@ func Test_noFreeID(t *testing.T) {
 		t.Errorf("shouldn't be any mids left")
 	}
 }
+
+type testIDAllocator struct {
+	next  uint16
+	freed []uint16
+}
+
+func (a *testIDAllocator) Allocate(inUse func(id uint16) bool) uint16 {
+	for inUse(a.next) {
+		a.next++
+	}
+	return a.next
+}
+
+func (a *testIDAllocator) Free(id uint16) {
+	a.freed = append(a.freed, id)
+}
+
+func Test_getID_allocator(t *testing.T) {
+	a := &testIDAllocator{next: 1000}
+	mids := &messageIds{index: make(map[uint16]tokenCompletor), allocator: a}
+
+	if id := mids.getID(&DummyToken{}); id != 1000 {
+		t.Fatalf("expected id from allocator, got %v", id)
+	}
+	if id := mids.getID(&DummyToken{}); id != 1001 {
+		t.Fatalf("expected id from allocator, got %v", id)
+	}
+
+	mids.freeID(1000)
+	mids.freeID(1000) // not in use so should not be passed to the allocator
+	if len(a.freed) != 1 || a.freed[0] != 1000 {
+		t.Fatalf("allocator should have been told that 1000 was freed: %v", a.freed)
+	}
+
+	mids.cleanUp()
+	if len(a.freed) != 2 || a.freed[1] != 1001 {
+		t.Fatalf("allocator should have been told that 1001 was freed: %v", a.freed)
+	}
+}
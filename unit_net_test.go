@@ -0,0 +1,577 @@
+/*
+ * Copyright (c) 2013 IBM Corp.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ *
+ * Contributors:
+ *    Seth Hoenig
+ *    Allan Stockdill-Mander
+ *    Mike Robertson
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/90poe/paho.mqtt.golang/packets"
+)
+
+// orphanPubrel simulates the loss of the store part way through a QoS 2 flow by sending a
+// PUBREL for a message that the client has no record of. Returns the first output of the
+// incoming comms routine.
+func orphanPubrel(t *testing.T, report bool) (*client, incommingComms, bool) {
+	c := NewClient(NewClientOptions().SetReportOrphanPubrel(report)).(*client)
+	c.persist.Open()
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	inboundFromStore := make(chan packets.ControlPacket)
+	close(inboundFromStore)
+	output := startIncommingComms(local, c, inboundFromStore)
+
+	prel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+	prel.MessageID = 42
+	go prel.Write(remote)
+
+	select {
+	case ic := <-output:
+		return c, ic, true
+	case <-time.After(100 * time.Millisecond):
+		return c, incommingComms{}, false
+	}
+}
+
+// expectPubcomp checks that ic is a PUBCOMP for the message sent by orphanPubrel
+func expectPubcomp(t *testing.T, ic incommingComms, ok bool) {
+	if !ok || ic.outbound == nil {
+		t.Fatalf("expected pubcomp to be sent")
+	}
+	if pc, ok := ic.outbound.p.(*packets.PubcompPacket); !ok || pc.MessageID != 42 {
+		t.Fatalf("expected pubcomp for id 42, got %v", ic.outbound.p)
+	}
+}
+
+func Test_OrphanPubrel(t *testing.T) {
+	c, ic, ok := orphanPubrel(t, false)
+	expectPubcomp(t, ic, ok)
+	if len(c.errs) != 0 {
+		t.Fatalf("unexpected error reported")
+	}
+}
+
+func Test_OrphanPubrel_Report(t *testing.T) {
+	c, ic, ok := orphanPubrel(t, true)
+	expectPubcomp(t, ic, ok)
+	if len(c.errs) != 1 {
+		t.Fatalf("expected an error to be reported")
+	}
+}
+
+func Test_ServerDisconnect(t *testing.T) {
+	reasons := make(chan byte, 1)
+	c := NewClient(NewClientOptions().SetServerDisconnectHandler(func(_ Client, reason byte) {
+		reasons <- reason
+	})).(*client)
+	c.persist.Open()
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	inboundFromStore := make(chan packets.ControlPacket)
+	close(inboundFromStore)
+	output := startIncommingComms(local, c, inboundFromStore)
+
+	go remote.Write([]byte{0xE0, 0x01, 0x89}) // DISCONNECT, server busy
+
+	select {
+	case ic := <-output:
+		var sde *ServerDisconnectError
+		if !errors.As(ic.err, &sde) || sde.ReasonCode != 0x89 {
+			t.Fatalf("expected a ServerDisconnectError with reason 0x89, got %v", ic.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("disconnect not reported")
+	}
+	select {
+	case reason := <-reasons:
+		if reason != 0x89 {
+			t.Fatalf("unexpected reason code %#x", reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("server disconnect handler not called")
+	}
+}
+
+func Test_StrictOrderAcrossReconnect(t *testing.T) {
+	c := NewClient(NewClientOptions().SetStrictOrderAcrossReconnect(true)).(*client)
+	c.persist.Open()
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	inboundFromStore := make(chan packets.ControlPacket)
+	output := startIncommingComms(local, c, inboundFromStore)
+
+	live := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	live.TopicName = "live"
+	go live.Write(remote)
+
+	select {
+	case ic := <-output:
+		t.Fatalf("live message processed before the store was drained: %+v", ic)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	stored := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	stored.TopicName = "stored"
+	inboundFromStore <- stored
+	close(inboundFromStore)
+
+	for _, expected := range []string{"stored", "live"} {
+		select {
+		case ic := <-output:
+			if ic.incommingPub == nil || ic.incommingPub.TopicName != expected {
+				t.Fatalf("expected %q, got %+v", expected, ic)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%q message not processed", expected)
+		}
+	}
+}
+
+func Test_OnSubscribe_OnUnsubscribe(t *testing.T) {
+	type subResult struct {
+		filter string
+		qos    byte
+	}
+	subs := make(chan subResult, 2)
+	unsubs := make(chan string, 2)
+	c := NewClient(NewClientOptions().
+		SetOnSubscribe(func(filter string, qos byte) { subs <- subResult{filter, qos} }).
+		SetOnUnsubscribe(func(filter string) { unsubs <- filter })).(*client)
+	c.persist.Open()
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	inboundFromStore := make(chan packets.ControlPacket)
+	close(inboundFromStore)
+	startIncommingComms(local, c, inboundFromStore)
+
+	subToken := newToken(packets.Subscribe).(*SubscribeToken)
+	subToken.subs = []string{"a/b", "c/d"}
+	sa := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+	sa.MessageID = c.getID(subToken)
+	sa.ReturnCodes = []byte{1, 0x80}
+	go sa.Write(remote)
+
+	if !subToken.WaitTimeout(time.Second) {
+		t.Fatalf("subscribe token not completed")
+	}
+	for _, expected := range []subResult{{"a/b", 1}, {"c/d", 0x80}} {
+		if got := <-subs; got != expected {
+			t.Fatalf("expected %v, got %v", expected, got)
+		}
+	}
+
+	unsubToken := newToken(packets.Unsubscribe).(*UnsubscribeToken)
+	unsubToken.topics = []string{"a/b"}
+	ua := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+	ua.MessageID = c.getID(unsubToken)
+	go ua.Write(remote)
+
+	if !unsubToken.WaitTimeout(time.Second) {
+		t.Fatalf("unsubscribe token not completed")
+	}
+	if got := <-unsubs; got != "a/b" {
+		t.Fatalf("expected a/b to be unsubscribed, got %q", got)
+	}
+}
+
+func Test_SubackPartialFailure(t *testing.T) {
+	c := NewClient(NewClientOptions()).(*client)
+	c.persist.Open()
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	inboundFromStore := make(chan packets.ControlPacket)
+	close(inboundFromStore)
+	startIncommingComms(local, c, inboundFromStore)
+
+	token := newToken(packets.Subscribe).(*SubscribeToken)
+	token.subs = []string{"a/#", "restricted/#"}
+	token.qoss = []byte{1, 1}
+	sa := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+	sa.MessageID = c.getID(token)
+	sa.ReturnCodes = []byte{1, 0x80}
+	go sa.Write(remote)
+
+	if !token.WaitTimeout(time.Second) {
+		t.Fatalf("subscribe token not completed")
+	}
+	if token.Error() != nil {
+		t.Fatalf("a rejected filter should not fail the token, got %v", token.Error())
+	}
+	if r := token.Result(); r["a/#"] != 1 || r["restricted/#"] != 0x80 {
+		t.Fatalf("unexpected results %v", r)
+	}
+}
+
+func Test_EventSink(t *testing.T) {
+	events := make(chan ClientEvent, 3)
+	c := NewClient(NewClientOptions().SetEventSink(events)).(*client)
+	c.persist.Open()
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	inboundFromStore := make(chan packets.ControlPacket)
+	close(inboundFromStore)
+	startIncommingComms(local, c, inboundFromStore)
+
+	subToken := newToken(packets.Subscribe).(*SubscribeToken)
+	subToken.subs = []string{"a/b"}
+	sa := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+	sa.MessageID = c.getID(subToken)
+	sa.ReturnCodes = []byte{1}
+	go sa.Write(remote)
+	if !subToken.WaitTimeout(time.Second) {
+		t.Fatalf("subscribe token not completed")
+	}
+
+	pubToken := newToken(packets.Publish).(*PublishToken)
+	pa := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+	pa.MessageID = c.getID(pubToken)
+	go pa.Write(remote)
+	if !pubToken.WaitTimeout(time.Second) {
+		t.Fatalf("publish token not completed")
+	}
+
+	if e := <-events; e.Type != EventSubscribed || e.Topic != "a/b" || e.QoS != 1 || e.Time.IsZero() {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	if e := <-events; e.Type != EventPublishAcked || e.MessageID != pa.MessageID {
+		t.Fatalf("unexpected event %+v", e)
+	}
+
+	// The sink is never blocked on; events are dropped (and counted) when it is full
+	for i := 0; i < 5; i++ {
+		c.emitEvent(ClientEvent{Type: EventError, Err: errors.New("test")})
+	}
+	if d := c.DroppedEvents(); d != 2 {
+		t.Fatalf("expected 2 dropped events, got %d", d)
+	}
+	if EventPublishAcked.String() != "publish acked" || ClientEventType(99).String() != "unknown" {
+		t.Fatalf("unexpected event type names")
+	}
+}
+
+func Test_OnPublishComplete(t *testing.T) {
+	type completed struct {
+		id    uint16
+		topic string
+	}
+	done := make(chan completed, 1)
+	c := NewClient(NewClientOptions().SetOnPublishComplete(func(id uint16, topic string) {
+		done <- completed{id, topic}
+	})).(*client)
+	c.persist.Open()
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	inboundFromStore := make(chan packets.ControlPacket)
+	close(inboundFromStore)
+	startIncommingComms(local, c, inboundFromStore)
+
+	token := newToken(packets.Publish).(*PublishToken)
+	token.topic = "a/b"
+	token.messageID = c.getID(token)
+	pc := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+	pc.MessageID = token.messageID
+	go pc.Write(remote)
+
+	if !token.WaitTimeout(time.Second) {
+		t.Fatalf("publish token not completed")
+	}
+	select {
+	case got := <-done:
+		if got.id != token.messageID || got.topic != "a/b" {
+			t.Fatalf("unexpected completion %+v", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("OnPublishComplete not called")
+	}
+}
+
+// countingConn counts the calls to Write
+type countingConn struct {
+	net.Conn
+	writes int32
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	atomic.AddInt32(&c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+func Test_startOutgoingComms_writeBuffer(t *testing.T) {
+	c := NewClient(NewClientOptions().SetWriteBuffer(4096, 0)).(*client)
+	local, remote := net.Pipe()
+	defer remote.Close()
+	conn := &countingConn{Conn: local}
+
+	obound := make(chan *PacketAndToken, 3)
+	oboundP := make(chan *PacketAndToken)
+	fromIncomming := make(chan *PacketAndToken)
+	tokens := make([]Token, 3)
+	for i := range tokens {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.TopicName = "a/b"
+		pub.Payload = []byte("payload")
+		token := newToken(packets.Publish).(*PublishToken)
+		tokens[i] = token
+		obound <- &PacketAndToken{p: pub, t: token}
+	}
+	errs := startOutgoingComms(conn, c, oboundP, obound, fromIncomming)
+
+	for i := range tokens {
+		cp, err := packets.ReadPacket(remote)
+		if err != nil {
+			t.Fatalf("failed to read packet %d: %v", i, err)
+		}
+		if _, ok := cp.(*packets.PublishPacket); !ok {
+			t.Fatalf("expected a publish, got %v", cp)
+		}
+	}
+	if n := atomic.LoadInt32(&conn.writes); n != 1 {
+		t.Fatalf("expected the queued packets to be sent with a single write, got %d", n)
+	}
+
+	// A single packet is flushed immediately
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = "c/d"
+	obound <- &PacketAndToken{p: pub, t: newToken(packets.Publish).(*PublishToken)}
+	if cp, err := packets.ReadPacket(remote); err != nil || cp.(*packets.PublishPacket).TopicName != "c/d" {
+		t.Fatalf("expected the publish to be flushed: %v", err)
+	}
+
+	close(obound)
+	close(oboundP)
+	close(fromIncomming)
+	for range errs {
+	}
+}
+
+func Test_startOutgoingComms_writeBufferShutdown(t *testing.T) {
+	c := NewClient(NewClientOptions().SetWriteBuffer(4096, 0)).(*client)
+	local, remote := net.Pipe()
+	remote.Close() // so flushing the buffer fails
+
+	obound := make(chan *PacketAndToken, 1)
+	oboundP := make(chan *PacketAndToken)
+	fromIncomming := make(chan *PacketAndToken)
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = "a/b"
+	obound <- &PacketAndToken{p: pub, t: newToken(packets.Publish).(*PublishToken)}
+	close(obound)
+	close(oboundP)
+	close(fromIncomming)
+	errs := startOutgoingComms(local, c, oboundP, obound, fromIncomming)
+
+	// The failure of the final flush must not be sent as nothing may be reading errs by then
+	select {
+	case err, ok := <-errs:
+		if ok {
+			t.Fatalf("expected errs to be closed without an error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("outgoing comms did not stop")
+	}
+}
+
+func Test_startOutgoingComms_qos0ConfirmWrite(t *testing.T) {
+	c := NewClient(NewClientOptions().SetWriteBuffer(4096, 0).SetQoS0ConfirmWrite(true)).(*client)
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	obound := make(chan *PacketAndToken, 2)
+	oboundP := make(chan *PacketAndToken)
+	fromIncomming := make(chan *PacketAndToken)
+	tokens := make([]Token, 2)
+	for i := range tokens {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.TopicName = "a/b"
+		token := newToken(packets.Publish).(*PublishToken)
+		tokens[i] = token
+		obound <- &PacketAndToken{p: pub, t: token}
+	}
+	errs := startOutgoingComms(local, c, oboundP, obound, fromIncomming)
+
+	// Nothing is read from the pipe so the buffer cannot be flushed
+	if tokens[0].WaitTimeout(50 * time.Millisecond) {
+		t.Fatal("token completed before the publish was written to the connection")
+	}
+	for i := range tokens {
+		if _, err := packets.ReadPacket(remote); err != nil {
+			t.Fatalf("failed to read packet %d: %v", i, err)
+		}
+	}
+	for i, token := range tokens {
+		if !token.WaitTimeout(time.Second) || token.Error() != nil {
+			t.Errorf("token %d not completed successfully once written: %v", i, token.Error())
+		}
+	}
+
+	close(obound)
+	close(oboundP)
+	close(fromIncomming)
+	for range errs {
+	}
+}
+
+func Test_startOutgoingComms_qos0ConfirmWriteError(t *testing.T) {
+	c := NewClient(NewClientOptions().SetWriteBuffer(64, 0).SetQoS0ConfirmWrite(true)).(*client)
+	local, remote := net.Pipe()
+	remote.Close() // so writing to the connection fails
+
+	obound := make(chan *PacketAndToken, 1)
+	oboundP := make(chan *PacketAndToken, 1)
+	fromIncomming := make(chan *PacketAndToken)
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = "a/b"
+	token := newToken(packets.Publish).(*PublishToken)
+	obound <- &PacketAndToken{p: pub, t: token}
+	sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	sub.Topics = []string{strings.Repeat("x", 100)} // too large to buffer so written straight away
+	sub.Qoss = []byte{0}
+	oboundP <- &PacketAndToken{p: sub, t: newToken(packets.Subscribe).(*SubscribeToken)}
+	errs := startOutgoingComms(local, c, oboundP, obound, fromIncomming)
+
+	// Whichever packet is written first the publish cannot be confirmed
+	<-errs
+	if !token.WaitTimeout(time.Second) || token.Error() == nil {
+		t.Fatalf("expected the publish token to fail when a write fails")
+	}
+
+	close(obound)
+	close(oboundP)
+	close(fromIncomming)
+	for range errs {
+	}
+}
+
+func Test_Errors(t *testing.T) {
+	c := NewClient(NewClientOptions()).(*client)
+
+	callHandler(func(Client, Message) { panic("boom") }, c, &message{topic: "a/b"})
+	select {
+	case err := <-c.Errors():
+		if !strings.Contains(err.Error(), "boom") {
+			t.Fatalf("unexpected error %v", err)
+		}
+	default:
+		t.Fatalf("handler panic not reported")
+	}
+
+	for i := 0; i < errorsChannelDepth+3; i++ {
+		c.reportError(errors.New("test error"))
+	}
+	if d := c.DroppedErrors(); d != 3 {
+		t.Fatalf("expected 3 dropped errors, got %d", d)
+	}
+}
+
+func Test_startIncommingComms_maxPacketSize(t *testing.T) {
+	c := NewClient(NewClientOptions().SetMaxPacketSize(64)).(*client)
+	c.persist.Open()
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	inboundFromStore := make(chan packets.ControlPacket)
+	close(inboundFromStore)
+	output := startIncommingComms(local, c, inboundFromStore)
+
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = "a/b"
+	pub.Payload = make([]byte, 1024)
+	go pub.Write(remote)
+
+	select {
+	case msg := <-output:
+		var tooLarge *packets.PacketTooLargeError
+		if !errors.As(msg.err, &tooLarge) || tooLarge.Max != 64 {
+			t.Fatalf("expected a PacketTooLargeError, got %v", msg.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("oversized packet not rejected")
+	}
+}
+
+// flakyWriter accepts at most limit bytes per call, failing with EAGAIN on the first fails calls
+type flakyWriter struct {
+	buf   []byte
+	limit int
+	fails int
+	calls int
+}
+
+func (f *flakyWriter) Write(p []byte) (int, error) {
+	f.calls++
+	n := len(p)
+	if n > f.limit {
+		n = f.limit
+	}
+	f.buf = append(f.buf, p[:n]...)
+	if f.calls <= f.fails {
+		return n, syscall.EAGAIN
+	}
+	return n, nil
+}
+
+func Test_retryWriter(t *testing.T) {
+	data := []byte("0123456789")
+
+	f := &flakyWriter{limit: 3, fails: 2}
+	w := &retryWriter{w: f, retries: 5, logs: clientLoggers(nil)}
+	if n, err := w.Write(data); err != nil || n != len(data) {
+		t.Fatalf("expected %d bytes written without error, got %d, %v", len(data), n, err)
+	}
+	if string(f.buf) != string(data) {
+		t.Errorf("partial writes not resumed correctly, got %q", f.buf)
+	}
+
+	f = &flakyWriter{limit: 3, fails: 10}
+	w = &retryWriter{w: f, retries: 2, logs: clientLoggers(nil)}
+	if n, err := w.Write(data); err != syscall.EAGAIN || n != 9 {
+		t.Errorf("expected EAGAIN after 9 bytes once retries exhausted, got %d, %v", n, err)
+	}
+	if f.calls != 3 {
+		t.Errorf("expected 3 write attempts, got %d", f.calls)
+	}
+
+	if transientWriteError(errors.New("broken pipe")) {
+		t.Error("unexpected transient error")
+	}
+}
@@ -0,0 +1,335 @@
+/*
+ * Copyright (c) 2013 IBM Corp.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ *
+ * Contributors:
+ *    Seth Hoenig
+ *    Allan Stockdill-Mander
+ *    Mike Robertson
+ */
+
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_dialHTTPProxy(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	requests := make(chan *http.Request, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		requests <- req
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	}()
+
+	proxyURL, _ := url.Parse("http://user:pass@" + l.Addr().String())
+	conn, err := dialHTTPProxy(proxyURL, "broker:1883", time.Second)
+	if err != nil {
+		t.Fatalf("dialHTTPProxy failed: %v", err)
+	}
+	conn.Close()
+
+	req := <-requests
+	if req.Method != http.MethodConnect || req.Host != "broker:1883" {
+		t.Fatalf("unexpected proxy request: %s %s", req.Method, req.Host)
+	}
+	if auth := req.Header.Get("Proxy-Authorization"); auth != "Basic dXNlcjpwYXNz" {
+		t.Fatalf("unexpected Proxy-Authorization header: %q", auth)
+	}
+}
+
+func Test_httpProxyForBroker(t *testing.T) {
+	explicit, _ := url.Parse("http://proxy:3128")
+	broker, _ := url.Parse("tcp://broker:1883")
+
+	p, err := httpProxyForBroker(broker, explicit)
+	if err != nil || p != explicit {
+		t.Fatalf("explicit proxy not used: %v %v", p, err)
+	}
+}
+
+func Test_openConnection_timings(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+
+	var timings ConnectTimings
+	conn, err := openConnection(&url.URL{Scheme: "tcp", Host: l.Addr().String()}, nil, time.Second, nil, nil, nil, nil, &timings, nil)
+	if err != nil {
+		t.Fatalf("openConnection failed: %v", err)
+	}
+	conn.Close()
+	if timings.DNS+timings.Dial <= 0 {
+		t.Errorf("expected the dial to be timed, got %+v", timings)
+	}
+	if timings.TLSHandshake != 0 || timings.MQTTHandshake != 0 {
+		t.Errorf("unexpected timings for phases that did not happen: %+v", timings)
+	}
+}
+
+func Test_tlsConfigWithServerName(t *testing.T) {
+	if tlsConfigWithServerName(nil, "") != nil {
+		t.Errorf("nil config should be unchanged without a server name")
+	}
+	if c := tlsConfigWithServerName(nil, "broker.example.com"); c == nil || c.ServerName != "broker.example.com" {
+		t.Errorf("expected server name to be set, got %v", c)
+	}
+
+	orig := &tls.Config{ServerName: "other.example.com", MinVersion: tls.VersionTLS12}
+	c := tlsConfigWithServerName(orig, "broker.example.com")
+	if c.ServerName != "broker.example.com" || c.MinVersion != tls.VersionTLS12 {
+		t.Errorf("expected server name to be overridden keeping other settings, got %v", c)
+	}
+	if orig.ServerName != "other.example.com" {
+		t.Errorf("original config should not be modified")
+	}
+}
+
+// selfSignedCert generates a certificate for "broker.example.com" returning it with its SHA-256 fingerprint
+func selfSignedCert(t *testing.T) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "broker.example.com"},
+		DNSNames:     []string{"broker.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, hex.EncodeToString(sum[:])
+}
+
+// tlsHandshakeWith performs a handshake with a server presenting cert using the client config from o
+func tlsHandshakeWith(t *testing.T, cert tls.Certificate, o *ClientOptions) error {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	local, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	_, err = tlsHandshake(local, &url.URL{Host: "broker.example.com:8883"}, tlsConfigFromOptions(o), time.Second, &ConnectTimings{}, nil)
+	return err
+}
+
+func Test_tlsConfigFromOptions_pinning(t *testing.T) {
+	cert, fingerprint := selfSignedCert(t)
+	_, otherFingerprint := selfSignedCert(t)
+
+	// Matching pin (upper case with colons is accepted)
+	formatted := strings.ToUpper(fingerprint[:2] + ":" + fingerprint[2:])
+	if err := tlsHandshakeWith(t, cert, NewClientOptions().SetTLSPinnedFingerprints([]string{otherFingerprint, formatted}).SetTLSPinningOnly(true)); err != nil {
+		t.Errorf("handshake with a pinned certificate failed: %v", err)
+	}
+	// Mismatching pin
+	if err := tlsHandshakeWith(t, cert, NewClientOptions().SetTLSPinnedFingerprints([]string{otherFingerprint}).SetTLSPinningOnly(true)); err == nil {
+		t.Errorf("handshake should fail when the certificate is not pinned")
+	}
+	// Without PinningOnly the chain must still be valid (this certificate is self signed)
+	if err := tlsHandshakeWith(t, cert, NewClientOptions().SetTLSPinnedFingerprints([]string{fingerprint})); err == nil {
+		t.Errorf("handshake should fail when the chain cannot be verified")
+	}
+
+	// Options are not modified
+	o := NewClientOptions().SetTLSConfig(&tls.Config{}).SetTLSPinnedFingerprints([]string{fingerprint}).SetTLSPinningOnly(true)
+	tlsConfigFromOptions(o)
+	if o.TLSConfig.InsecureSkipVerify || o.TLSConfig.VerifyPeerCertificate != nil {
+		t.Errorf("TLSConfig should not be modified")
+	}
+}
+
+func Test_tlsConfigFromOptions_clientCertificateProvider(t *testing.T) {
+	serverCert, _ := selfSignedCert(t)
+	clientCert, clientFingerprint := selfSignedCert(t)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{serverCert}, ClientAuth: tls.RequireAnyClientCert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	presented := make(chan string, 1)
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			tc := conn.(*tls.Conn)
+			if tc.Handshake() == nil {
+				sum := sha256.Sum256(tc.ConnectionState().PeerCertificates[0].Raw)
+				presented <- hex.EncodeToString(sum[:])
+			}
+			conn.Close()
+		}
+	}()
+
+	calls := 0
+	orig := &tls.Config{InsecureSkipVerify: true}
+	o := NewClientOptions().SetTLSConfig(orig).SetClientCertificateProvider(func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		calls++
+		return &clientCert, nil
+	})
+	local, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	if _, err = tlsHandshake(local, &url.URL{Host: "broker.example.com:8883"}, tlsConfigFromOptions(o), time.Second, &ConnectTimings{}, nil); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("expected the provider to be called once, got %d", calls)
+	}
+	if fp := <-presented; fp != clientFingerprint {
+		t.Errorf("expected the provided certificate to be presented")
+	}
+	if orig.GetClientCertificate != nil {
+		t.Errorf("TLSConfig should not be modified")
+	}
+}
+
+func Test_netDialer_dnsCache(t *testing.T) {
+	if newNetDialer(NewClientOptions()) != nil {
+		t.Fatalf("default options should use the default dialer")
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	nd := newNetDialer(NewClientOptions().SetDNSCacheTTL(time.Minute))
+	nd.cache.entries["broker.invalid"] = dnsCacheEntry{addrs: []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}, expires: time.Now().Add(time.Minute)}
+	var timings ConnectTimings
+	conn, err := dialTimed("tcp", net.JoinHostPort("broker.invalid", port), time.Second, nd, &timings)
+	if err != nil {
+		t.Fatalf("expected the cached address to be used: %v", err)
+	}
+	conn.Close()
+
+	// Entry is discarded if the cached addresses cannot be reached
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	_, closedPort, _ := net.SplitHostPort(closed.Addr().String())
+	if _, err = nd.dial(net.JoinHostPort("broker.invalid", closedPort), time.Second, &timings); err == nil {
+		t.Fatalf("expected connection to fail")
+	}
+	if _, ok := nd.cache.entries["broker.invalid"]; ok {
+		t.Fatalf("expected failed entry to be removed from the cache")
+	}
+
+	// Expired entries are resolved again (which fails for this name)
+	nd.cache.entries["broker.invalid"] = dnsCacheEntry{addrs: []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}, expires: time.Now().Add(-time.Second)}
+	if _, err = nd.dial(net.JoinHostPort("broker.invalid", port), time.Second, &timings); err == nil {
+		t.Fatalf("expected expired entry to be resolved again")
+	}
+}
+
+func Test_netDialer_dialParallel(t *testing.T) {
+	v4, v6 := net.IPAddr{IP: net.ParseIP("127.0.0.1")}, net.IPAddr{IP: net.ParseIP("::1")}
+	primaries, fallbacks := partitionAddrs([]net.IPAddr{v6, v4, v6})
+	if len(primaries) != 2 || len(fallbacks) != 1 || !fallbacks[0].IP.Equal(v4.IP) {
+		t.Fatalf("unexpected partition %v %v", primaries, fallbacks)
+	}
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	// The IPv6 address is not listening; the IPv4 fallback must be tried as soon as it fails
+	// (rather than after the fallback delay)
+	nd := &netDialer{fallbackDelay: time.Minute}
+	start := time.Now()
+	conn, err := nd.dialParallel(context.Background(), []net.IPAddr{v6, v4}, port)
+	if err != nil {
+		t.Fatalf("expected to connect using the fallback: %v", err)
+	}
+	conn.Close()
+	if time.Since(start) > 10*time.Second {
+		t.Fatalf("fallback should not wait for the delay")
+	}
+
+	// Fails if no address can be reached
+	closed, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	_, closedPort, _ := net.SplitHostPort(closed.Addr().String())
+	if _, err := nd.dialParallel(context.Background(), []net.IPAddr{v6, v4}, closedPort); err == nil {
+		t.Fatalf("expected an error when no address is reachable")
+	}
+}
@@ -124,3 +124,47 @@ func Test_OnConnectionLost(t *testing.T) {
 		t.Fatalf("client options.onconnlost was nil")
 	}
 }
+
+func Test_WebsocketOptions(t *testing.T) {
+	o := NewClientOptions().SetWebsocketSubprotocols([]string{"mqttv3.1"}).SetWebsocketCompression(true)
+
+	if len(o.WebsocketOptions.Subprotocols) != 1 || o.WebsocketOptions.Subprotocols[0] != "mqttv3.1" {
+		t.Fatalf("bad websocket subprotocols: %v", o.WebsocketOptions.Subprotocols)
+	}
+
+	if !o.WebsocketOptions.EnableCompression {
+		t.Fatalf("websocket compression not enabled")
+	}
+
+	o = NewClientOptions().SetWebsocketOptions(nil).SetWebsocketCompression(true)
+	if o.WebsocketOptions == nil || !o.WebsocketOptions.EnableCompression {
+		t.Fatalf("websocket compression not enabled with nil WebsocketOptions")
+	}
+
+	o = NewClientOptions().SetWebsocketOptions(nil).SetWebsocketCompressionThreshold(512)
+	if o.WebsocketOptions == nil || o.WebsocketOptions.CompressionThreshold != 512 {
+		t.Fatalf("websocket compression threshold not set")
+	}
+}
+
+func Test_UnsetWill(t *testing.T) {
+	o := NewClientOptions().SetWill("will/topic", "gone", 1, true).UnsetWill()
+
+	if o.WillEnabled || o.WillTopic != "" || o.WillPayload != nil || o.WillQos != 0 || o.WillRetained {
+		t.Fatalf("will not cleared: %+v", o)
+	}
+}
+
+func Test_SessionExpiryInterval(t *testing.T) {
+	o := NewClientOptions().SetSessionExpiryInterval(time.Hour)
+	c := NewClient(o).(*client)
+
+	if c.options.CleanSession {
+		t.Fatalf("non-zero session expiry interval should clear CleanSession")
+	}
+
+	c = NewClient(NewClientOptions().SetSessionExpiryInterval(0)).(*client)
+	if !c.options.CleanSession {
+		t.Fatalf("zero session expiry interval should not alter CleanSession")
+	}
+}
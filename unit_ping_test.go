@@ -16,7 +16,11 @@ package mqtt
 
 import (
 	"bytes"
+	"net/url"
+	"strconv"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/90poe/paho.mqtt.golang/packets"
 )
@@ -63,3 +67,106 @@ func Test_DecodeMessage_pingresp(t *testing.T) {
 		t.Errorf("DecodeMessage ping response wrong rem len: %d", presp.(*packets.PingrespPacket).RemainingLength)
 	}
 }
+
+func Test_keepalive_disabled(t *testing.T) {
+	c := NewClient(NewClientOptions().SetKeepAlive(0)).(*client)
+	c.stop = make(chan struct{})
+	defer close(c.stop)
+
+	c.oboundP = make(chan *PacketAndToken, 1)
+	c.workers.Add(1)
+	done := make(chan struct{})
+	go func() {
+		keepalive(c)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("keepalive should exit immediately when disabled")
+	}
+	if len(c.oboundP) != 0 {
+		t.Fatalf("no PINGREQ should be sent when keepalive is disabled")
+	}
+
+	if m := newConnectMsgFromOptions(&c.options, &url.URL{}); m.Keepalive != 0 {
+		t.Fatalf("CONNECT should have a keepalive of 0, got %d", m.Keepalive)
+	}
+}
+
+func Test_keepalive_oneSecond(t *testing.T) {
+	c := NewClient(NewClientOptions().SetKeepAlive(time.Second)).(*client)
+	c.stop = make(chan struct{})
+	c.lastSent.Store(time.Now().Add(-time.Minute))
+	c.lastReceived.Store(time.Now().Add(-time.Minute))
+
+	c.oboundP = make(chan *PacketAndToken, 1)
+	c.workers.Add(1)
+	go keepalive(c) // previously panicked as the check interval was 0
+	defer close(c.stop)
+
+	select {
+	case pt := <-c.oboundP:
+		if _, ok := pt.p.(*packets.PingreqPacket); !ok {
+			t.Fatalf("expected PINGREQ, got %s", pt.p)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("PINGREQ not sent")
+	}
+}
+
+func Test_keepalive_pingMissedHandler(t *testing.T) {
+	missed := make(chan int, 10)
+	c := NewClient(NewClientOptions().SetKeepAlive(time.Second).SetPingTimeout(time.Minute).
+		SetPingMissedHandler(func(n int) { missed <- n })).(*client)
+	c.stop = make(chan struct{})
+	c.lastSent.Store(time.Now().Add(-time.Minute))
+	c.lastReceived.Store(time.Now().Add(-time.Minute))
+
+	c.oboundP = make(chan *PacketAndToken, 1) // nothing responds to the PINGREQ
+	c.workers.Add(1)
+	go keepalive(c)
+	defer close(c.stop)
+
+	for want := 1; want <= 2; want++ {
+		select {
+		case n := <-missed:
+			if n != want {
+				t.Fatalf("expected %d missed, got %d", want, n)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("PingMissedHandler not called")
+		}
+	}
+	if atomic.LoadInt32(&c.pingOutstanding) != 1 {
+		t.Fatalf("the PINGRESP should still be outstanding")
+	}
+}
+
+func Test_appHeartbeat(t *testing.T) {
+	var seq int32
+	opts := NewClientOptions().SetAppHeartbeat("app/heartbeat", 0, 10*time.Millisecond, func() []byte {
+		return []byte(strconv.Itoa(int(atomic.AddInt32(&seq, 1))))
+	})
+	c := NewClient(opts).(*client)
+	c.persist.Open()
+	c.setConnected(connected)
+	c.obound = make(chan *PacketAndToken, 10)
+	c.stop = make(chan struct{})
+	c.workers.Add(1)
+	go appHeartbeat(c)
+
+	for _, want := range []string{"1", "2"} {
+		select {
+		case pt := <-c.obound:
+			pub := pt.p.(*packets.PublishPacket)
+			if pub.TopicName != "app/heartbeat" || string(pub.Payload) != want {
+				t.Fatalf("unexpected heartbeat %q on %q, expected %q", pub.Payload, pub.TopicName, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("heartbeat %s not published", want)
+		}
+	}
+	close(c.stop)
+	c.workers.Wait() // the heartbeat must stop
+}
@@ -15,6 +15,8 @@
 package mqtt
 
 import (
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -277,6 +279,40 @@ func Test_match(t *testing.T) {
 	check(R, T, true)
 }
 
+// Test_match_dollarTopics checks that, as per the spec, a route beginning with a wildcard
+// does not match topics whose first level begins with $
+func Test_match_dollarTopics(t *testing.T) {
+	for _, tc := range []struct {
+		route, topic string
+		match        bool
+	}{
+		{"#", "$SYS/broker/uptime", false},
+		{"+/broker/uptime", "$SYS/broker/uptime", false},
+		{"+/#", "$SYS/broker/uptime", false},
+		{"#", "$other", false},
+		{"$SYS/#", "$SYS/broker/uptime", true},
+		{"$SYS/+/uptime", "$SYS/broker/uptime", true},
+		{"$SYS/broker/uptime", "$SYS/broker/uptime", true},
+		{"a/#", "a/$b", true},
+		{"a/+", "a/$b", true},
+		{"#", "a/b", true},
+		{"$share/grp/#", "$SYS/broker/uptime", false},
+		{"$share/grp/+/broker/uptime", "$SYS/broker/uptime", false},
+		{"$share/grp/$SYS/#", "$SYS/broker/uptime", true},
+		{"$share/grp/#", "a/b", true},
+	} {
+		if got := routeIncludesTopic(tc.route, tc.topic); got != tc.match {
+			t.Errorf("routeIncludesTopic(%q, %q) = %v, expected %v", tc.route, tc.topic, got, tc.match)
+		}
+	}
+
+	router := newRouter()
+	router.addRoute("#", nil)
+	if router.routes.Front().Value.(*route).match("$SYS/broker/uptime") {
+		t.Fatalf("a # route should not match $SYS topics")
+	}
+}
+
 func Test_MatchAndDispatch(t *testing.T) {
 	calledback := make(chan bool)
 
@@ -350,3 +386,734 @@ func Test_SharedSubscription_MatchAndDispatch(t *testing.T) {
 	}
 
 }
+
+func Test_MatchAndDispatch_InboundFilter(t *testing.T) {
+	calledback := make(chan bool, 1)
+
+	cb := func(c Client, m Message) {
+		calledback <- true
+	}
+
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.Qos = 1
+	pub.MessageID = 1
+	pub.TopicName = "a"
+	pub.Payload = []byte("foo")
+
+	msgs := make(chan *packets.PublishPacket)
+
+	router := newRouter()
+	router.addRoute("a", cb)
+
+	store := NewMemoryStore()
+	store.Open()
+	c := &client{oboundP: make(chan *PacketAndToken, 100), persist: store}
+	c.options.InboundFilter = func(topic string, payload []byte, qos byte) bool {
+		return topic != "a"
+	}
+
+	stopped := make(chan bool)
+	go func() {
+		router.matchAndDispatch(msgs, true, c)
+		stopped <- true
+	}()
+	msgs <- pub
+	close(msgs)
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("matchAndDispatch should have exited")
+	}
+
+	select {
+	case <-calledback:
+		t.Fatalf("filtered message should not be passed to the handler")
+	default:
+	}
+
+	select {
+	case pt := <-c.oboundP:
+		if _, ok := pt.p.(*packets.PubackPacket); !ok {
+			t.Fatalf("expected puback for filtered message, got %s", pt.p)
+		}
+	default:
+		t.Fatalf("filtered message was not acknowledged")
+	}
+}
+
+func Test_MatchAndDispatch_InboundFilterQoS2(t *testing.T) {
+	calledback := make(chan bool, 1)
+	router := newRouter()
+	router.addRoute("a", func(c Client, m Message) { calledback <- true })
+
+	store := NewMemoryStore()
+	store.Open()
+	c := &client{oboundP: make(chan *PacketAndToken, 100), persist: store}
+	c.options.InboundFilter = func(topic string, payload []byte, qos byte) bool { return false }
+
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.Qos = 2
+	pub.MessageID = 7
+	pub.TopicName = "a"
+	msgs := make(chan *packets.PublishPacket, 1)
+	msgs <- pub
+	close(msgs)
+	router.matchAndDispatch(msgs, true, c)
+
+	pt := <-c.oboundP
+	if _, ok := pt.p.(*packets.PubrecPacket); !ok {
+		t.Fatalf("expected pubrec for filtered message, got %s", pt.p)
+	}
+	// The PUBREL must complete the flow rather than being treated as an orphan
+	if found, ackPending := router.handleQoS2Packets(7, true, c); !found || ackPending {
+		t.Fatalf("expected the filtered message to be found (found %t, ackPending %t)", found, ackPending)
+	}
+	if len(calledback) != 0 {
+		t.Fatalf("filtered message should not be passed to the handler")
+	}
+	if store.Get(pubKey(7)) != nil {
+		t.Fatalf("marker not removed from the store")
+	}
+}
+
+func Test_MatchAndDispatch_InboundFilterQoS2Redelivery(t *testing.T) {
+	calledback := make(chan bool, 2)
+	router := newRouter()
+	router.addRoute("a", func(c Client, m Message) { calledback <- true })
+
+	store := NewMemoryStore()
+	store.Open()
+	c := &client{oboundP: make(chan *PacketAndToken, 100), persist: store}
+	seen := 0
+	c.options.InboundFilter = func(topic string, payload []byte, qos byte) bool { // accepts only the first delivery
+		seen++
+		return seen == 1
+	}
+
+	msgs := make(chan *packets.PublishPacket, 2)
+	for i := 0; i < 2; i++ { // the broker resends the PUBLISH (e.g. following a reconnect) before the PUBREL
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.Qos = 2
+		pub.MessageID = 7
+		pub.TopicName = "a"
+		pub.Dup = i > 0
+		msgs <- pub
+	}
+	close(msgs)
+	router.matchAndDispatch(msgs, true, c)
+
+	if found, _ := router.handleQoS2Packets(7, true, c); !found {
+		t.Fatalf("expected the stored message to be found")
+	}
+	if len(calledback) != 1 {
+		t.Fatalf("expected the handler to be called once, got %d", len(calledback))
+	}
+}
+
+func Test_MatchAndDispatch_ReceiveMaximum(t *testing.T) {
+	release := make(chan bool)
+	cb := func(c Client, m Message) {
+		<-release
+	}
+
+	msgs := make(chan *packets.PublishPacket)
+
+	router := newRouter()
+	router.addRoute("a", cb)
+	router.setReceiveMaximum(1)
+
+	store := NewMemoryStore()
+	store.Open()
+	c := &client{oboundP: make(chan *PacketAndToken, 100), persist: store}
+
+	stopped := make(chan bool)
+	go func() {
+		router.matchAndDispatch(msgs, false, c)
+		stopped <- true
+	}()
+
+	for i := uint16(1); i <= 2; i++ {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.Qos = 1
+		pub.MessageID = i
+		pub.TopicName = "a"
+		msgs <- pub
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if n := len(c.oboundP); n != 1 {
+		t.Fatalf("expected only the first message to be acknowledged, got %d acks", n)
+	}
+
+	release <- true
+	release <- true
+	close(msgs)
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("matchAndDispatch should have exited")
+	}
+	if n := len(c.oboundP); n != 2 {
+		t.Fatalf("expected both messages to be acknowledged, got %d acks", n)
+	}
+}
+
+func Test_handleQoS2Packets_ReceiveMaximum(t *testing.T) {
+	release := make(chan bool)
+	handled := make(chan uint16, 2)
+	router := newRouter()
+	router.addRoute("a", func(c Client, m Message) {
+		<-release
+		handled <- m.MessageID()
+	})
+	router.setReceiveMaximum(1)
+
+	store := NewMemoryStore()
+	store.Open()
+	c := &client{oboundP: make(chan *PacketAndToken, 100), persist: store}
+	for i := uint16(1); i <= 2; i++ {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.Qos = 2
+		pub.MessageID = i
+		pub.TopicName = "a"
+		store.Put(pubKey(i), pub)
+	}
+
+	if found, ackPending := router.handleQoS2Packets(1, false, c); !found || ackPending {
+		t.Fatalf("expected the first message to be handled (found %t, ackPending %t)", found, ackPending)
+	}
+	// No slot is available; the network reader must not be blocked so the PUBCOMP is deferred
+	done := make(chan bool)
+	go func() {
+		found, ackPending := router.handleQoS2Packets(2, false, c)
+		done <- found && ackPending
+	}()
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Fatalf("expected the PUBCOMP for the second message to be deferred")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("handleQoS2Packets blocked waiting for an inflight slot")
+	}
+	if found, ackPending := router.handleQoS2Packets(2, false, c); !found || !ackPending {
+		t.Fatalf("a resent PUBREL should not run the handlers again")
+	}
+
+	release <- true
+	release <- true
+	for _, want := range []uint16{1, 2} {
+		if id := <-handled; id != want {
+			t.Fatalf("expected message %d to be handled, got %d", want, id)
+		}
+	}
+	select {
+	case pt := <-c.oboundP:
+		if pc, ok := pt.p.(*packets.PubcompPacket); !ok || pc.MessageID != 2 {
+			t.Fatalf("expected the deferred pubcomp, got %s", pt.p)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("deferred pubcomp not sent")
+	}
+	if store.Get(pubKey(2)) != nil {
+		t.Fatalf("deferred message not removed from the store")
+	}
+}
+
+func Test_runHandlers_TopicPrefix(t *testing.T) {
+	topics := make(chan string, 1)
+
+	router := newRouter()
+	router.addRoute("tenant/a/+", func(c Client, m Message) {
+		topics <- m.Topic()
+	})
+
+	c := &client{}
+	c.options.TopicPrefix = "tenant/"
+
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = "tenant/a/b"
+	router.runHandlers(pub, true, c)
+
+	if topic := <-topics; topic != "a/b" {
+		t.Fatalf("expected prefix to be stripped from topic, got %q", topic)
+	}
+}
+
+func Test_runHandlers_InboundTopicRewriter(t *testing.T) {
+	topics := make(chan string, 1)
+
+	router := newRouter()
+	router.addRoute("a/+", func(c Client, m Message) {
+		topics <- m.Topic()
+	})
+
+	c := &client{}
+	c.options.InboundTopicRewriter = func(topic string) string {
+		return strings.TrimPrefix(topic, "bridge/")
+	}
+
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = "bridge/a/b"
+	router.runHandlers(pub, true, c)
+	if topic := <-topics; topic != "a/b" {
+		t.Fatalf("expected the rewritten topic, got %q", topic)
+	}
+
+	c.options.KeepOriginalTopic = true
+	router.runHandlers(pub, true, c)
+	if topic := <-topics; topic != "bridge/a/b" {
+		t.Fatalf("expected the original topic, got %q", topic)
+	}
+}
+
+func Test_runHandlers_AutoAckDisabled(t *testing.T) {
+	c := NewClient(NewClientOptions().SetAutoAckDisabled(true)).(*client)
+	c.persist.Open()
+	defer c.persist.Close()
+
+	messages := make(chan Message, 1)
+	c.msgRouter.addRoute("a/b", func(_ Client, m Message) { messages <- m })
+
+	for qos, expected := range map[byte]string{1: "PUBACK", 2: "PUBCOMP"} {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.TopicName = "a/b"
+		pub.Qos = qos
+		pub.MessageID = 7
+		c.msgRouter.runHandlers(pub, true, c)
+		m := <-messages
+		if c.PendingAcks() != 1 {
+			t.Fatalf("QoS %d: expected 1 pending ack, got %d", qos, c.PendingAcks())
+		}
+
+		go func() {
+			m.Ack()
+			m.Ack() // must be a no-op
+		}()
+		select {
+		case pt := <-c.oboundP:
+			if pt.p.Details().MessageID != 7 || !strings.HasPrefix(pt.p.String(), expected) {
+				t.Fatalf("QoS %d: unexpected ack %v", qos, pt.p)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("QoS %d: ack not sent", qos)
+		}
+		select {
+		case pt := <-c.oboundP:
+			t.Fatalf("QoS %d: second ack sent %v", qos, pt.p)
+		case <-time.After(50 * time.Millisecond):
+		}
+		if c.PendingAcks() != 0 {
+			t.Fatalf("QoS %d: expected no pending acks, got %d", qos, c.PendingAcks())
+		}
+	}
+}
+
+func Test_runHandlers_panic(t *testing.T) {
+	panics := make(chan interface{}, 1)
+	c := NewClient(NewClientOptions().SetHandlerPanicHandler(func(m Message, p interface{}) {
+		panics <- p
+	})).(*client)
+
+	called := false
+	c.msgRouter.addRoute("a/b", func(Client, Message) { panic("boom") })
+	c.msgRouter.addRoute("a/+", func(Client, Message) { called = true })
+
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = "a/b"
+	c.msgRouter.runHandlers(pub, true, c)
+
+	if !called {
+		t.Fatalf("handlers after the panicking one should still be called")
+	}
+	select {
+	case p := <-panics:
+		if p != "boom" {
+			t.Fatalf("unexpected panic value %v", p)
+		}
+	default:
+		t.Fatalf("panic handler not called")
+	}
+}
+
+func Test_runHandlers_observers(t *testing.T) {
+	var calls []string
+	c := NewClient(NewClientOptions()).(*client)
+	c.AddObserver(func(_ Client, m Message) { calls = append(calls, "observer1 "+m.Topic()) })
+	c.AddObserver(func(Client, Message) { panic("observer panic") })
+	c.AddObserver(func(_ Client, m Message) { calls = append(calls, "observer2 "+m.Topic()) })
+	c.AddRoute("a/b", func(_ Client, m Message) { calls = append(calls, "route "+m.Topic()) })
+
+	for _, topic := range []string{"a/b", "c/d"} {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.TopicName = topic
+		c.msgRouter.runHandlers(pub, true, c)
+	}
+
+	expected := []string{"observer1 a/b", "observer2 a/b", "route a/b", "observer1 c/d", "observer2 c/d"}
+	if strings.Join(calls, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected calls %v, got %v", expected, calls)
+	}
+}
+
+func Test_MatchAndDispatch_SuppressOwnRetained(t *testing.T) {
+	received := make(chan string, 2)
+	cb := func(c Client, m Message) {
+		received <- string(m.Payload())
+	}
+
+	router := newRouter()
+	router.addRoute("a", cb)
+
+	store := NewMemoryStore()
+	store.Open()
+	c := &client{oboundP: make(chan *PacketAndToken, 100), persist: store, ownRetained: newOwnRetained()}
+	c.ownRetained.record("a", []byte("mine"))
+
+	msgs := make(chan *packets.PublishPacket)
+	stopped := make(chan bool)
+	go func() {
+		router.matchAndDispatch(msgs, true, c)
+		stopped <- true
+	}()
+	// The first "mine" is our own message coming back; the second was published by someone else
+	for _, payload := range []string{"mine", "theirs", "mine"} {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.TopicName = "a"
+		pub.Payload = []byte(payload)
+		msgs <- pub
+	}
+	close(msgs)
+	<-stopped
+
+	for _, expected := range []string{"theirs", "mine"} {
+		select {
+		case payload := <-received:
+			if payload != expected {
+				t.Fatalf("expected %q, got %q", expected, payload)
+			}
+		default:
+			t.Fatalf("expected %q to be passed to the handler", expected)
+		}
+	}
+}
+
+func Test_MatchAndDispatch_OwnRetainedQoS2Redelivery(t *testing.T) {
+	calledback := make(chan bool, 2)
+	router := newRouter()
+	router.addRoute("a", func(c Client, m Message) { calledback <- true })
+
+	store := NewMemoryStore()
+	store.Open()
+	c := &client{oboundP: make(chan *PacketAndToken, 100), persist: store, ownRetained: newOwnRetained()}
+
+	dispatch := func(dup bool) {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.Qos = 2
+		pub.MessageID = 7
+		pub.TopicName = "a"
+		pub.Payload = []byte("same")
+		pub.Dup = dup
+		msgs := make(chan *packets.PublishPacket, 1)
+		msgs <- pub
+		close(msgs)
+		router.matchAndDispatch(msgs, true, c)
+	}
+	dispatch(false)
+	// We publish the same retained message before the broker resends the PUBLISH; the redelivery must
+	// not be mistaken for our own message
+	c.ownRetained.record("a", []byte("same"))
+	dispatch(true)
+
+	if found, _ := router.handleQoS2Packets(7, true, c); !found {
+		t.Fatalf("expected the stored message to be found")
+	}
+	if len(calledback) != 1 {
+		t.Fatalf("expected the handler to be called once, got %d", len(calledback))
+	}
+}
+
+func Test_MatchAndDispatch_Dedup(t *testing.T) {
+	received := make(chan string, 5)
+	router := newRouter()
+	router.addRoute("a", func(c Client, m Message) { received <- string(m.Payload()) })
+
+	store := NewMemoryStore()
+	store.Open()
+	keyFunc := func(m Message) string { return strings.SplitN(string(m.Payload()), ":", 2)[0] }
+	c := &client{oboundP: make(chan *PacketAndToken, 100), persist: store, dedup: newDedupCache(keyFunc, time.Minute)}
+
+	msgs := make(chan *packets.PublishPacket)
+	stopped := make(chan bool)
+	go func() {
+		router.matchAndDispatch(msgs, true, c)
+		stopped <- true
+	}()
+	for _, payload := range []string{"1:first", "2:second", "1:again", ":no key", ":no key"} {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.TopicName = "a"
+		pub.Payload = []byte(payload)
+		msgs <- pub
+	}
+	close(msgs)
+	<-stopped
+
+	close(received)
+	var got []string
+	for payload := range received {
+		got = append(got, payload)
+	}
+	if want := []string{"1:first", "2:second", ":no key", ":no key"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func Test_MatchAndDispatch_DedupQoS2Redelivery(t *testing.T) {
+	calledback := make(chan bool, 2)
+	router := newRouter()
+	router.addRoute("a", func(c Client, m Message) { calledback <- true })
+
+	store := NewMemoryStore()
+	store.Open()
+	c := &client{oboundP: make(chan *PacketAndToken, 100), persist: store, dedup: newDedupCache(func(m Message) string { return string(m.Payload()) }, time.Minute)}
+
+	msgs := make(chan *packets.PublishPacket, 2)
+	for i := 0; i < 2; i++ { // the broker resends the PUBLISH (e.g. following a reconnect) before the PUBREL
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.Qos = 2
+		pub.MessageID = 7
+		pub.TopicName = "a"
+		pub.Payload = []byte("1")
+		pub.Dup = i > 0
+		msgs <- pub
+	}
+	close(msgs)
+	router.matchAndDispatch(msgs, true, c)
+
+	if found, _ := router.handleQoS2Packets(7, true, c); !found {
+		t.Fatalf("expected the stored message to be found")
+	}
+	if len(calledback) != 1 {
+		t.Fatalf("expected the handler to be called once, got %d", len(calledback))
+	}
+	if store.Get(pubKey(7)) != nil {
+		t.Fatalf("message not removed from the store")
+	}
+}
+
+func Test_dedupCache(t *testing.T) {
+	d := newDedupCache(func(m Message) string { return m.Topic() }, 20*time.Millisecond)
+	if d.duplicate(&message{topic: "a"}) || !d.duplicate(&message{topic: "a"}) {
+		t.Fatalf("second message within the window should be a duplicate")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if d.duplicate(&message{topic: "a"}) {
+		t.Fatalf("message after the window should not be a duplicate")
+	}
+
+	d = newDedupCache(func(m Message) string { return m.Topic() }, time.Minute)
+	for i := 0; i <= dedupMaxKeys; i++ {
+		d.duplicate(&message{topic: strconv.Itoa(i)})
+	}
+	if len(d.index) != dedupMaxKeys || d.order.Len() != dedupMaxKeys {
+		t.Fatalf("expected %d keys to be retained, got %d", dedupMaxKeys, len(d.index))
+	}
+	if d.duplicate(&message{topic: "0"}) {
+		t.Errorf("the oldest key should have been forgotten")
+	}
+}
+
+func Test_SetDefaultHandler(t *testing.T) {
+	received := make(chan string, 1)
+	c := NewClient(NewClientOptions().SetDefaultPublishHandler(func(Client, Message) {
+		received <- "initial"
+	})).(*client)
+
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = "a/b"
+	c.msgRouter.runHandlers(pub, true, c)
+	if h := <-received; h != "initial" {
+		t.Fatalf("expected the initial default handler, got %q", h)
+	}
+
+	c.SetDefaultHandler(func(Client, Message) { received <- "replacement" })
+	c.msgRouter.runHandlers(pub, true, c)
+	if h := <-received; h != "replacement" {
+		t.Fatalf("expected the replacement default handler, got %q", h)
+	}
+
+	c.SetDefaultHandler(nil)
+	c.msgRouter.runHandlers(pub, true, c)
+	select {
+	case h := <-received:
+		t.Fatalf("no default handler should be called, got %q", h)
+	default:
+	}
+}
+
+func Test_SubscriptionStats(t *testing.T) {
+	c := NewClient(NewClientOptions().SetSubscriptionStats(true)).(*client)
+	c.msgRouter.addRoute("a/+", func(Client, Message) {})
+	c.msgRouter.addRoute("b", func(Client, Message) {})
+
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = "a/b"
+	c.msgRouter.runHandlers(pub, true, c)
+	c.msgRouter.runHandlers(pub, true, c)
+
+	st := c.SubscriptionStats("a/+")
+	if st.Messages != 2 || st.LastReceived.IsZero() || st.Rate <= 0 {
+		t.Fatalf("unexpected stats for a/+: %+v", st)
+	}
+	if st := c.SubscriptionStats("b"); st.Messages != 0 || !st.LastReceived.IsZero() {
+		t.Fatalf("expected no stats for b, got %+v", st)
+	}
+
+	s := newSubStats()
+	now := time.Now()
+	s.record([]string{"x"}, now)
+	s.record([]string{"x"}, now.Add(time.Second))
+	if st := s.get("x"); st.Rate != 1 {
+		t.Fatalf("expected a rate of 1/s, got %v", st.Rate)
+	}
+	s.record([]string{"x"}, now.Add(1500*time.Millisecond))
+	if st := s.get("x"); st.Rate <= 1 || st.Rate >= 2 {
+		t.Fatalf("expected the rate to move towards 2/s, got %v", st.Rate)
+	}
+
+	if st := NewClient(NewClientOptions()).SubscriptionStats("a/+"); st.Messages != 0 {
+		t.Fatalf("stats should not be collected unless enabled")
+	}
+}
+
+func Test_ServerTimestampExtractor(t *testing.T) {
+	sent := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	received := make(chan Message, 1)
+	c := NewClient(NewClientOptions().SetServerTimestampExtractor(func(topic string, payload []byte) (time.Time, bool) {
+		ts, err := time.Parse(time.RFC3339, string(payload))
+		return ts, err == nil
+	})).(*client)
+	c.msgRouter.addRoute("a/b", func(_ Client, m Message) { received <- m })
+
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = "a/b"
+	pub.Payload = []byte(sent.Format(time.RFC3339))
+	c.msgRouter.runHandlers(pub, true, c)
+	if ts, ok := (<-received).ServerTimestamp(); !ok || !ts.Equal(sent) {
+		t.Fatalf("expected server timestamp %v, got %v (%v)", sent, ts, ok)
+	}
+
+	pub.Payload = []byte("no timestamp")
+	c.msgRouter.runHandlers(pub, true, c)
+	if _, ok := (<-received).ServerTimestamp(); ok {
+		t.Fatalf("expected no server timestamp")
+	}
+}
+
+func Test_ActiveHandlerGoroutines(t *testing.T) {
+	c := NewClient(NewClientOptions().SetOrderMatters(false)).(*client)
+	release := make(chan struct{})
+	c.msgRouter.addRoute("a/+", func(Client, Message) { <-release })
+
+	for i := 0; i < 3; i++ {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.TopicName = "a/" + strconv.Itoa(i)
+		c.msgRouter.runHandlers(pub, false, c)
+	}
+	if n := c.ActiveHandlerGoroutines(); n != 3 {
+		t.Fatalf("expected 3 active handler goroutines, got %d", n)
+	}
+
+	close(release)
+	c.msgRouter.handlers.Wait()
+	if n := c.ActiveHandlerGoroutines(); n != 0 {
+		t.Fatalf("expected no active handler goroutines, got %d", n)
+	}
+}
+
+func Test_ActiveHandlerGoroutines_ReceiveMaximum(t *testing.T) {
+	c := NewClient(NewClientOptions().SetOrderMatters(false).SetReceiveMaximum(2)).(*client)
+	release := make(chan struct{})
+	c.msgRouter.addRoute("a/+", func(Client, Message) { <-release })
+
+	dispatched := make(chan struct{})
+	go func() {
+		for i := 0; i < 3; i++ { // QoS 0 messages are also limited
+			pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+			pub.TopicName = "a/" + strconv.Itoa(i)
+			c.msgRouter.runHandlers(pub, false, c)
+		}
+		close(dispatched)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if n := c.ActiveHandlerGoroutines(); n != 2 {
+		t.Fatalf("expected 2 active handler goroutines, got %d", n)
+	}
+
+	close(release)
+	<-dispatched
+	c.msgRouter.handlers.Wait()
+	if n := c.ActiveHandlerGoroutines(); n != 0 {
+		t.Fatalf("expected no active handler goroutines, got %d", n)
+	}
+}
+
+func Test_StopDispatch(t *testing.T) {
+	c := NewClient(NewClientOptions()).(*client)
+	c.persist.Open()
+	c.oboundP = make(chan *PacketAndToken, 10)
+	received := make(chan string, 10)
+	c.msgRouter.addRoute("a", func(_ Client, m Message) { received <- string(m.Payload()) })
+
+	msgs := make(chan *packets.PublishPacket)
+	stopped := make(chan bool)
+	go func() {
+		c.msgRouter.matchAndDispatch(msgs, true, c)
+		stopped <- true
+	}()
+	send := func(id uint16) {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.TopicName = "a"
+		pub.Qos = 1
+		pub.MessageID = id
+		pub.Payload = []byte(strconv.Itoa(int(id)))
+		msgs <- pub
+	}
+
+	c.StopDispatch()
+	for id := uint16(1); id <= 3; id++ {
+		send(id)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if len(received) != 0 || len(c.oboundP) != 0 {
+		t.Fatalf("messages dispatched or acknowledged whilst dispatch was stopped")
+	}
+	c.StartDispatch()
+	send(4)
+
+	for _, want := range []string{"1", "2", "3", "4"} {
+		select {
+		case got := <-received:
+			if got != want {
+				t.Fatalf("expected message %s, got %s", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message %s not dispatched", want)
+		}
+	}
+
+	// Messages held when the connection is lost are discarded
+	c.StopDispatch()
+	send(5)
+	close(msgs)
+	<-stopped
+	c.StartDispatch()
+	if len(received) != 0 {
+		t.Fatalf("held message dispatched after the connection was lost")
+	}
+	if n := len(c.oboundP); n != 4 {
+		t.Fatalf("expected 4 PUBACKs, got %d", n)
+	}
+}
@@ -16,6 +16,7 @@ package mqtt
 
 import (
 	"testing"
+	"time"
 
 	"github.com/90poe/paho.mqtt.golang/packets"
 )
@@ -566,3 +567,98 @@ func Test_persistInbound_pingresp(t *testing.T) {
 		t.Fatalf("persistInbound in bad state")
 	}
 }
+
+func Test_accountingStore(t *testing.T) {
+	a := newAccountingStore(NewMemoryStore(), 0)
+	a.Open()
+
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.Qos = 1
+	pub.MessageID = 1
+	pub.TopicName = "a/b"
+	pub.Payload = make([]byte, 100)
+	a.Put(inboundKeyFromMID(1), pub)
+	if len(a.sizes) != 0 {
+		t.Fatalf("sizes should only be tracked when there is a limit")
+	}
+
+	if s := a.stats(); s.Messages != 1 || s.Bytes != packetSize(pub) {
+		t.Fatalf("unexpected stats after put: %+v", s)
+	}
+	a.Del(inboundKeyFromMID(1))
+	if s := a.stats(); s.Messages != 0 || s.Bytes != 0 {
+		t.Fatalf("unexpected stats after del: %+v", s)
+	}
+}
+
+func Test_accountingStore_backpressure(t *testing.T) {
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.Qos = 1
+	pub.TopicName = "a/b"
+	pub.Payload = make([]byte, 100)
+
+	a := newAccountingStore(NewMemoryStore(), packetSize(pub)+10)
+	a.Open()
+	a.Put(inboundKeyFromMID(1), pub)
+
+	stored := make(chan bool)
+	go func() {
+		a.Put(inboundKeyFromMID(2), pub)
+		stored <- true
+	}()
+
+	select {
+	case <-stored:
+		t.Fatalf("put should block whilst the store is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	a.Del(inboundKeyFromMID(1))
+	select {
+	case <-stored:
+	case <-time.After(time.Second):
+		t.Fatalf("put should complete once space is freed")
+	}
+}
+
+func Test_accountingStore_migrate(t *testing.T) {
+	old := NewMemoryStore()
+	a := newAccountingStore(old, 0)
+	a.Open()
+	for id := uint16(1); id <= 2; id++ {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.Qos = 1
+		pub.MessageID = id
+		pub.TopicName = "a/b"
+		a.Put(outboundKeyFromMID(id), pub)
+	}
+	before := a.stats()
+
+	s := NewMemoryStore()
+	if err := a.migrate(s); err != nil {
+		t.Fatalf("migrate failed: %v", err)
+	}
+	if a.Store != s || len(s.All()) != 2 || s.Get(outboundKeyFromMID(2)) == nil {
+		t.Fatalf("messages not moved to the new store: %v", s.All())
+	}
+	if old.opened {
+		t.Errorf("previous store should have been closed")
+	}
+	if after := a.stats(); after != before {
+		t.Errorf("stats changed by migration: %+v, expected %+v", after, before)
+	}
+	a.Del(outboundKeyFromMID(1))
+	if len(s.All()) != 1 {
+		t.Errorf("operations should use the new store")
+	}
+
+	// if the store is not open it is simply replaced
+	a.Close()
+	closed := NewMemoryStore()
+	if err := a.migrate(closed); err != nil || a.Store != closed || closed.opened {
+		t.Errorf("closed store not replaced: %v", err)
+	}
+	if a.migrate(nil) == nil {
+		t.Errorf("expected an error migrating to a nil store")
+	}
+}
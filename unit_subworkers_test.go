@@ -0,0 +1,268 @@
+/*
+ * Copyright (c) 2013 IBM Corp.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ *
+ * Contributors:
+ *    Seth Hoenig
+ *    Allan Stockdill-Mander
+ *    Mike Robertson
+ */
+
+package mqtt
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/90poe/paho.mqtt.golang/packets"
+)
+
+func Test_sharedWorkers_orderPerKey(t *testing.T) {
+	var mu sync.Mutex
+	received := make(map[string][]int)
+
+	w := newSharedWorkers(nil, 4, func(c Client, m Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		n, _ := strconv.Atoi(string(m.Payload()))
+		received[m.Topic()] = append(received[m.Topic()], n)
+	})
+	dispatch := w.dispatch(func(m Message) string { return m.Topic() })
+
+	keys := []string{"a", "b", "c", "d", "e"}
+	for i := 0; i < 100; i++ {
+		for _, k := range keys {
+			dispatch(nil, &message{topic: k, payload: []byte(strconv.Itoa(i))})
+		}
+	}
+	w.stop()
+	<-w.done()
+
+	for _, k := range keys {
+		if len(received[k]) != 100 {
+			t.Fatalf("expected 100 messages for key %s, got %d", k, len(received[k]))
+		}
+		for i, n := range received[k] {
+			if n != i {
+				t.Fatalf("messages for key %s out of order: %v", k, received[k])
+			}
+		}
+	}
+
+	// Dispatching after stop must not panic
+	dispatch(nil, &message{topic: "a"})
+}
+
+func Test_SubscribeShared_notConnected(t *testing.T) {
+	c := NewClient(NewClientOptions()).(*client)
+
+	token := c.SubscribeShared("group", "a/b", 1, 2, func(m Message) string { return "" }, func(Client, Message) {})
+	if token.Wait() && token.Error() != ErrNotConnected {
+		t.Fatalf("expected ErrNotConnected, got %v", token.Error())
+	}
+	if len(c.subscriptionWorkers) != 0 {
+		t.Fatalf("workers should not be retained when the subscribe fails")
+	}
+}
+
+func Test_SubscribeWithOptions_notConnected(t *testing.T) {
+	c := NewClient(NewClientOptions()).(*client)
+
+	token := c.SubscribeWithOptions("a/b", 1, func(Client, Message) {}, SubOptions{DedicatedWorker: true})
+	if token.Wait() && token.Error() != ErrNotConnected {
+		t.Fatalf("expected ErrNotConnected, got %v", token.Error())
+	}
+	if len(c.subscriptionWorkers) != 0 {
+		t.Fatalf("worker should not be retained when the subscribe fails")
+	}
+}
+
+func Test_SubscribeWithOptions_failIfExists(t *testing.T) {
+	c := NewClient(NewClientOptions().SetDeferredSubscribe(true)).(*client)
+	handler := func(Client, Message) {}
+
+	if err := c.SubscribeWithOptions("a/b", 1, handler, SubOptions{FailIfExists: true}).Error(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.SubscribeWithOptions("a/b", 1, handler, SubOptions{FailIfExists: true}).Error(); err != ErrRouteExists {
+		t.Fatalf("expected ErrRouteExists, got %v", err)
+	}
+	if err := c.SubscribeWithOptions("a/b", 1, handler, SubOptions{}).Error(); err != nil {
+		t.Fatalf("expected the handler to be replaced by default, got %v", err)
+	}
+
+	// The route claimed is removed if the subscribe fails
+	c = NewClient(NewClientOptions()).(*client)
+	if err := c.SubscribeWithOptions("a/b", 1, handler, SubOptions{FailIfExists: true}).Error(); err != ErrNotConnected {
+		t.Fatalf("expected ErrNotConnected, got %v", err)
+	}
+	if c.msgRouter.routes.Len() != 0 {
+		t.Fatalf("route retained when the subscribe failed")
+	}
+}
+
+func Test_SubscribeWithOptions_dedicatedWorker(t *testing.T) {
+	c := NewClient(NewClientOptions().SetDeferredSubscribe(true)).(*client)
+
+	received := make(chan string, 1)
+	c.SubscribeWithOptions("a/b", 1, func(_ Client, m Message) { received <- m.Topic() }, SubOptions{DedicatedWorker: true})
+	if c.subscriptionWorkers["a/b"] == nil {
+		t.Fatalf("dedicated worker not registered")
+	}
+
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = "a/b"
+	c.msgRouter.runHandlers(pub, true, c)
+	select {
+	case topic := <-received:
+		if topic != "a/b" {
+			t.Fatalf("unexpected topic %q", topic)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("message not passed to the dedicated worker")
+	}
+
+	c.stopSubscriptionWorkers("a/b")
+	if len(c.subscriptionWorkers) != 0 {
+		t.Fatalf("worker not removed")
+	}
+}
+
+func Test_messageBatcher(t *testing.T) {
+	batches := make(chan []Message, 10)
+	b := newMessageBatcher(nil, 3, 50*time.Millisecond, func(_ Client, msgs []Message) { batches <- msgs })
+
+	var acked int32
+	for i := 0; i < 4; i++ {
+		b.dispatch(nil, &message{topic: "a", payload: []byte(strconv.Itoa(i)), ack: func() { atomic.AddInt32(&acked, 1) }})
+	}
+	for _, want := range []string{"012", "3"} { // a full batch then, after maxWait, the remainder
+		select {
+		case msgs := <-batches:
+			got := ""
+			for _, m := range msgs {
+				got += string(m.Payload())
+			}
+			if got != want {
+				t.Fatalf("expected batch %q, got %q", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("batch %q not passed to the handler", want)
+		}
+	}
+	if n := atomic.LoadInt32(&acked); n != 4 {
+		t.Errorf("expected 4 messages to be acknowledged, got %d", n)
+	}
+
+	// a partial batch is passed on when stopped
+	b.dispatch(nil, &message{topic: "a", payload: []byte("4"), ack: func() {}})
+	b.stop()
+	<-b.done()
+	if len(batches) != 1 {
+		t.Fatalf("partial batch not passed on when stopped")
+	}
+	b.dispatch(nil, &message{topic: "a"}) // must not panic
+}
+
+func Test_SubscribeBatch_notConnected(t *testing.T) {
+	c := NewClient(NewClientOptions()).(*client)
+
+	token := c.SubscribeBatch("a/b", 1, 10, time.Second, func(Client, []Message) {})
+	if token.Wait() && token.Error() != ErrNotConnected {
+		t.Fatalf("expected ErrNotConnected, got %v", token.Error())
+	}
+	if len(c.subscriptionWorkers) != 0 {
+		t.Fatalf("batcher should not be retained when the subscribe fails")
+	}
+}
+
+func Test_sharedWorkers_stopFromHandler(t *testing.T) {
+	var w *sharedWorkers
+	w = newSharedWorkers(nil, 1, func(Client, Message) { w.stop() }) // e.g. the handler unsubscribes
+	w.dispatch(func(Message) string { return "" })(nil, &message{topic: "a"})
+	select {
+	case <-w.done():
+	case <-time.After(time.Second):
+		t.Fatalf("workers did not exit when stopped from the handler")
+	}
+}
+
+func Test_sharedWorkers_handlerPanic(t *testing.T) {
+	c := NewClient(NewClientOptions()).(*client)
+	handled := make(chan struct{}, 2)
+	w := newSharedWorkers(c, 1, func(_ Client, m Message) {
+		handled <- struct{}{}
+		if m.Topic() == "panic" {
+			panic("boom")
+		}
+	})
+	dispatch := w.dispatch(func(Message) string { return "" })
+	dispatch(nil, &message{topic: "panic"})
+	dispatch(nil, &message{topic: "a"})
+	w.stop()
+	<-w.done()
+	if len(handled) != 2 {
+		t.Fatalf("worker did not survive the handler panicking")
+	}
+	if len(c.errs) != 1 {
+		t.Fatalf("expected the panic to be reported")
+	}
+}
+
+func Test_messageBatcher_handlerPanic(t *testing.T) {
+	c := NewClient(NewClientOptions()).(*client)
+	var acked int32
+	b := newMessageBatcher(c, 2, 0, func(Client, []Message) { panic("boom") })
+	for i := 0; i < 2; i++ {
+		b.dispatch(nil, &message{topic: "a", ack: func() { atomic.AddInt32(&acked, 1) }})
+	}
+	b.stop()
+	<-b.done()
+	if n := atomic.LoadInt32(&acked); n != 2 {
+		t.Errorf("expected 2 messages to be acknowledged, got %d", n)
+	}
+	if len(c.errs) != 1 {
+		t.Fatalf("expected the panic to be reported")
+	}
+}
+
+func Test_SubscribeWithOptions_subscribeFails(t *testing.T) {
+	c := NewClient(NewClientOptions().SetDeferredSubscribe(true)).(*client)
+
+	token := c.SubscribeWithOptions("a/b", 1, func(Client, Message) {}, SubOptions{DedicatedWorker: true}).(*SubscribeToken)
+	c.subscriptionWorkersMu.Lock()
+	w := c.subscriptionWorkers["a/b"]
+	c.subscriptionWorkersMu.Unlock()
+	if w == nil {
+		t.Fatalf("dedicated worker not registered")
+	}
+	token.setError(ErrNotConnected) // the subscribe fails once the request has been queued
+	select {
+	case <-w.done():
+	case <-time.After(time.Second):
+		t.Fatalf("worker not stopped when the subscribe failed")
+	}
+}
+
+func Test_Disconnect_stopsSubscriptionWorkers(t *testing.T) {
+	c := NewClient(NewClientOptions().SetDeferredSubscribe(true)).(*client)
+
+	c.SubscribeBatch("a/b", 1, 10, 0, func(Client, []Message) {})
+	w := c.subscriptionWorkers["a/b"]
+	c.Disconnect(0)
+	select {
+	case <-w.done():
+	case <-time.After(time.Second):
+		t.Fatalf("worker not stopped by Disconnect")
+	}
+	if len(c.subscriptionWorkers) != 0 || c.msgRouter.routes.Len() != 0 {
+		t.Fatalf("worker or route retained after Disconnect")
+	}
+}
@@ -15,6 +15,7 @@
 package mqtt
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -45,3 +46,60 @@ func Test_ValidateTopicAndQos_H(t *testing.T) {
 		t.Fatalf("invalid error for bad multilevel topic filter")
 	}
 }
+
+func Test_filtersOverlap(t *testing.T) {
+	for _, tc := range []struct {
+		a, b    string
+		overlap bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"a/#", "b/#", false},
+		{"+/c", "a/#", true},
+		{"+/+", "a", false},
+		{"$share/grp/a/+", "a/b", true},
+		{"$queue/a/b", "a/c", false},
+		{"#", "$SYS/#", false},
+		{"+/broker", "$SYS/broker", false},
+		{"$SYS/+", "$SYS/broker", true},
+	} {
+		if got := filtersOverlap(tc.a, tc.b); got != tc.overlap {
+			t.Errorf("filtersOverlap(%q, %q) = %v, expected %v", tc.a, tc.b, got, tc.overlap)
+		}
+		if got := filtersOverlap(tc.b, tc.a); got != tc.overlap {
+			t.Errorf("filtersOverlap(%q, %q) = %v, expected %v", tc.b, tc.a, got, tc.overlap)
+		}
+	}
+}
+
+func Test_validatePublishTopic(t *testing.T) {
+	for topic, expected := range map[string]error{
+		"a/b":                      nil,
+		"":                         ErrInvalidTopicEmptyString,
+		"a/+/c":                    ErrInvalidTopicWildcard,
+		"a/#":                      ErrInvalidTopicWildcard,
+		"a\x00b":                   ErrInvalidTopicNull,
+		"a/\xff":                   ErrInvalidTopicUTF8,
+		strings.Repeat("a", 65536): ErrInvalidTopicLength,
+	} {
+		if err := validatePublishTopic(topic); err != expected {
+			t.Errorf("validatePublishTopic(%.20q) = %v, expected %v", topic, err, expected)
+		}
+	}
+}
+
+func Test_Publish_InvalidTopic(t *testing.T) {
+	c := NewClient(NewClientOptions())
+	for _, topic := range []string{"", "a/+", "a/#", "a\x00", "\xc3\x28"} {
+		if token := c.Publish(topic, 0, false, "payload"); token.Error() == nil || token.Error() == ErrNotConnected {
+			t.Errorf("expected an invalid topic error for %q, got %v", topic, token.Error())
+		}
+		if token := c.PublishReader(topic, 0, false, strings.NewReader("payload"), 7); token.Error() == nil || token.Error() == ErrNotConnected {
+			t.Errorf("expected an invalid topic error from PublishReader for %q, got %v", topic, token.Error())
+		}
+	}
+}
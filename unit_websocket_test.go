@@ -0,0 +1,131 @@
+/*
+ * Copyright (c) 2013 IBM Corp.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ *
+ * Contributors:
+ *    Seth Hoenig
+ *    Allan Stockdill-Mander
+ *    Mike Robertson
+ */
+
+package mqtt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// recordingListener records all of the data read from accepted connections
+type recordingListener struct {
+	net.Listener
+	mu   sync.Mutex
+	data bytes.Buffer
+}
+
+type recordingConn struct {
+	net.Conn
+	l *recordingListener
+}
+
+func (l *recordingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &recordingConn{Conn: conn, l: l}, nil
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.l.mu.Lock()
+	c.l.data.Write(p[:n])
+	c.l.mu.Unlock()
+	return n, err
+}
+
+// frameCompression returns, for each websocket frame in data (which must begin with a frame), whether
+// the RSV1 (compressed) bit is set
+func frameCompression(data []byte) []bool {
+	var compressed []bool
+	for len(data) >= 2 {
+		n, off := int(data[1]&0x7f), 2
+		switch n {
+		case 126:
+			n, off = int(binary.BigEndian.Uint16(data[2:4])), 4
+		case 127:
+			n, off = int(binary.BigEndian.Uint64(data[2:10])), 10
+		}
+		if data[1]&0x80 != 0 {
+			off += 4 // masking key
+		}
+		compressed = append(compressed, data[0]&0x40 != 0)
+		data = data[off+n:]
+	}
+	return compressed
+}
+
+func Test_Websocket_CompressionThreshold(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl := &recordingListener{Listener: l}
+	received := make(chan struct{})
+	upgrader := websocket.Upgrader{EnableCompression: true, Subprotocols: []string{"mqtt"}}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		for i := 0; i < 2; i++ {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+		close(received)
+	})}
+	go srv.Serve(rl)
+	defer srv.Close()
+
+	opts := &WebsocketOptions{EnableCompression: true, CompressionThreshold: 100}
+	conn, err := NewWebsocket("ws://"+l.Addr().String(), nil, time.Second, nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(bytes.Repeat([]byte{'a'}, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(bytes.Repeat([]byte{'a'}, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatalf("messages not received")
+	}
+
+	rl.mu.Lock()
+	data := rl.data.Bytes()
+	rl.mu.Unlock()
+	i := bytes.Index(data, []byte("\r\n\r\n"))
+	if i < 0 {
+		t.Fatalf("handshake not found")
+	}
+	compressed := frameCompression(data[i+4:])
+	if len(compressed) != 2 || compressed[0] || !compressed[1] {
+		t.Fatalf("expected only the large frame to be compressed, got %v", compressed)
+	}
+}
@@ -5,16 +5,27 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// defaultWebsocketSubprotocols are offered in the opening handshake if no Subprotocols are configured
+var defaultWebsocketSubprotocols = []string{"mqtt"}
+
+// ProxyFunction returns the proxy to use for the request (nil for no proxy); see http.ProxyFromEnvironment
+type ProxyFunction func(req *http.Request) (*url.URL, error)
+
 // WebsocketOptions are config options for a websocket dialer
 type WebsocketOptions struct {
-	ReadBufferSize  int
-	WriteBufferSize int
+	ReadBufferSize       int
+	WriteBufferSize      int
+	Subprotocols         []string      // subprotocols offered in the opening handshake (defaults to "mqtt")
+	EnableCompression    bool          // negotiate permessage-deflate compression
+	CompressionThreshold int           // frames smaller than this (in bytes) are not compressed (0 to compress all)
+	Proxy                ProxyFunction // proxy to use for the connection (defaults to http.ProxyFromEnvironment)
 }
 
 // NewWebsocket returns a new websocket and returns a net.Conn compatible interface using the gorilla/websocket package
@@ -28,12 +39,22 @@ func NewWebsocket(host string, tlsc *tls.Config, timeout time.Duration, requestH
 		options = &WebsocketOptions{}
 	}
 
+	subprotocols := options.Subprotocols
+	if len(subprotocols) == 0 {
+		subprotocols = defaultWebsocketSubprotocols
+	}
+
+	proxy := options.Proxy
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
+	}
+
 	dialer := &websocket.Dialer{
-		Proxy:             http.ProxyFromEnvironment,
+		Proxy:             proxy,
 		HandshakeTimeout:  timeout,
-		EnableCompression: false,
+		EnableCompression: options.EnableCompression,
 		TLSClientConfig:   tlsc,
-		Subprotocols:      []string{"mqtt"},
+		Subprotocols:      subprotocols,
 		ReadBufferSize:    options.ReadBufferSize,
 		WriteBufferSize:   options.WriteBufferSize,
 	}
@@ -45,7 +66,8 @@ func NewWebsocket(host string, tlsc *tls.Config, timeout time.Duration, requestH
 	}
 
 	wrapper := &websocketConnector{
-		Conn: ws,
+		Conn:                 ws,
+		compressionThreshold: options.CompressionThreshold,
 	}
 	return wrapper, err
 }
@@ -58,6 +80,8 @@ type websocketConnector struct {
 	r   io.Reader
 	rio sync.Mutex
 	wio sync.Mutex
+
+	compressionThreshold int // frames smaller than this are sent uncompressed (if compression was negotiated)
 }
 
 // SetDeadline sets both the read and write deadlines
@@ -74,6 +98,9 @@ func (c *websocketConnector) Write(p []byte) (int, error) {
 	c.wio.Lock()
 	defer c.wio.Unlock()
 
+	if c.compressionThreshold > 0 {
+		c.EnableWriteCompression(len(p) >= c.compressionThreshold) // no-op if compression was not negotiated
+	}
 	err := c.WriteMessage(websocket.BinaryMessage, p)
 	if err != nil {
 		return 0, err